@@ -0,0 +1,171 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gabriel-samfira/localshow/config"
+	"github.com/gabriel-samfira/localshow/params"
+	"github.com/gabriel-samfira/localshow/sshsrv"
+	"github.com/spf13/cobra"
+)
+
+var domainsVerified bool
+
+var domainsCmd = &cobra.Command{
+	Use:          "domains",
+	SilenceUsage: true,
+	Short:        "Manage custom domains",
+	Long: `Manage custom domains.
+
+A custom domain is a hostname outside of the domain of the server, owned by
+the key with the given SHA256 fingerprint. Once verified, the key may register
+tunnels on it. The owner proves they control the hostname by publishing the
+token of the custom domain in a TXT record named ` + params.CustomDomainTXTPrefix + `<hostname>.
+
+Users can also manage the custom domains of their key using the "domains"
+remote command.`,
+}
+
+var domainsAddCmd = &cobra.Command{
+	Use:          "add <hostname> <fingerprint>",
+	SilenceUsage: true,
+	Short:        "Register a custom domain for a key",
+	Args:         cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), signals...)
+		defer stop()
+
+		cfg, err := config.NewConfig(cfgFile)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		hostname, err := config.ParseHostname(args[0])
+		if err != nil {
+			return err
+		}
+		if cfg.HTTPServer.IsOwnDomain(hostname) {
+			return fmt.Errorf("%s is part of the domain of this server", hostname)
+		}
+		db, err := openDatabase(ctx)
+		if err != nil {
+			return err
+		}
+		domain, err := db.AddCustomDomain(hostname, args[1], domainsVerified)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Custom domain %s registered with token %s\n", domain.Hostname, domain.Token)
+		return nil
+	},
+}
+
+var domainsVerifyCmd = &cobra.Command{
+	Use:          "verify <hostname>",
+	SilenceUsage: true,
+	Short:        "Verify that the owner of a custom domain controls it",
+	Args:         cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), signals...)
+		defer stop()
+
+		cfg, err := config.NewConfig(cfgFile)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		db, err := openDatabase(ctx)
+		if err != nil {
+			return err
+		}
+		hostname, err := config.ParseHostname(args[0])
+		if err != nil {
+			return err
+		}
+		if err := sshsrv.VerifyCustomDomain(ctx, cfg, db, hostname); err != nil {
+			return err
+		}
+		fmt.Printf("Custom domain %s verified\n", hostname)
+		return nil
+	},
+}
+
+var domainsListCmd = &cobra.Command{
+	Use:          "list",
+	SilenceUsage: true,
+	Short:        "List custom domains",
+	Args:         cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), signals...)
+		defer stop()
+
+		db, err := openDatabase(ctx)
+		if err != nil {
+			return err
+		}
+		domains, err := db.ListCustomDomains("")
+		if err != nil {
+			return fmt.Errorf("failed to list custom domains: %w", err)
+		}
+
+		wr := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(wr, "HOSTNAME\tFINGERPRINT\tVERIFIED\tTOKEN")
+		for _, domain := range domains {
+			verified := "no"
+			if domain.Verified() {
+				verified = domain.VerifiedAt.Format(time.DateTime)
+			}
+			fmt.Fprintf(wr, "%s\t%s\t%s\t%s\n", domain.Hostname, domain.Fingerprint, verified, domain.Token)
+		}
+		return wr.Flush()
+	},
+}
+
+var domainsRemoveCmd = &cobra.Command{
+	Use:          "remove <hostname>",
+	SilenceUsage: true,
+	Short:        "Remove a custom domain",
+	Args:         cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), signals...)
+		defer stop()
+
+		db, err := openDatabase(ctx)
+		if err != nil {
+			return err
+		}
+		hostname, err := config.ParseHostname(args[0])
+		if err != nil {
+			return err
+		}
+		return db.RemoveCustomDomain(hostname, "")
+	},
+}
+
+func init() {
+	domainsAddCmd.Flags().BoolVar(&domainsVerified, "verified", false, "Mark the custom domain as verified without checking it")
+
+	domainsCmd.AddCommand(domainsAddCmd)
+	domainsCmd.AddCommand(domainsVerifyCmd)
+	domainsCmd.AddCommand(domainsListCmd)
+	domainsCmd.AddCommand(domainsRemoveCmd)
+
+	rootCmd.AddCommand(domainsCmd)
+}
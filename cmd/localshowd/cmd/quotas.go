@@ -0,0 +1,164 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gabriel-samfira/localshow/config"
+	"github.com/spf13/cobra"
+)
+
+var quotasMonth string
+
+var quotasCmd = &cobra.Command{
+	Use:          "quotas",
+	SilenceUsage: true,
+	Short:        "Manage monthly transfer quotas",
+	Long: `Manage monthly transfer quotas.
+
+The tunnels of each key may transfer up to the monthly_quota set in the
+bandwidth section of the config file during a calendar month (UTC). Once
+the quota is exhausted, new visitors are refused. A different quota can be
+set for a key, identified by the SHA256 fingerprint of its public key.
+
+Quotas are picked up by a running server within a minute.`,
+}
+
+var quotasSetCmd = &cobra.Command{
+	Use:          "set <fingerprint> <quota>",
+	SilenceUsage: true,
+	Short:        "Set the monthly transfer quota of a key",
+	Long: `Set the monthly transfer quota of a key.
+
+The quota is an amount of bytes, optionally followed by a unit, like 500MB or
+10GiB. A quota of 0 lets the key transfer any amount of traffic.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), signals...)
+		defer stop()
+
+		quota, err := config.ParseByteSize(args[1])
+		if err != nil {
+			return err
+		}
+		db, err := openDatabase(ctx)
+		if err != nil {
+			return err
+		}
+		return db.SetTransferQuota(args[0], int64(quota))
+	},
+}
+
+var quotasRemoveCmd = &cobra.Command{
+	Use:          "remove <fingerprint>",
+	SilenceUsage: true,
+	Short:        "Remove the quota of a key, which falls back to the default quota",
+	Args:         cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), signals...)
+		defer stop()
+
+		db, err := openDatabase(ctx)
+		if err != nil {
+			return err
+		}
+		return db.RemoveTransferQuota(args[0])
+	},
+}
+
+var quotasListCmd = &cobra.Command{
+	Use:          "list",
+	SilenceUsage: true,
+	Short:        "List the quotas and the traffic of keys during a month",
+	Args:         cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), signals...)
+		defer stop()
+
+		if _, err := time.Parse("2006-01", quotasMonth); err != nil {
+			return fmt.Errorf("invalid month %q, expected YYYY-MM", quotasMonth)
+		}
+		cfg, err := config.NewConfig(cfgFile)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		db, err := openDatabase(ctx)
+		if err != nil {
+			return err
+		}
+
+		quotas, err := db.ListTransferQuotas()
+		if err != nil {
+			return fmt.Errorf("failed to list quotas: %w", err)
+		}
+		usage, err := db.ListTransferUsage(quotasMonth)
+		if err != nil {
+			return fmt.Errorf("failed to list transfer usage: %w", err)
+		}
+
+		var fingerprints []string
+		quotaByKey := map[string]int64{}
+		for _, quota := range quotas {
+			quotaByKey[quota.Fingerprint] = quota.MonthlyBytes
+			fingerprints = append(fingerprints, quota.Fingerprint)
+		}
+		usageByKey := map[string][2]int64{}
+		for _, row := range usage {
+			usageByKey[row.Fingerprint] = [2]int64{row.BytesIn, row.BytesOut}
+			fingerprints = append(fingerprints, row.Fingerprint)
+		}
+		slices.Sort(fingerprints)
+		fingerprints = slices.Compact(fingerprints)
+
+		wr := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(wr, "FINGERPRINT\tQUOTA\tIN\tOUT\tUSED")
+		for _, fingerprint := range fingerprints {
+			quota, custom := quotaByKey[fingerprint]
+			if !custom {
+				quota = int64(cfg.Bandwidth.MonthlyQuota)
+			}
+			traffic := usageByKey[fingerprint]
+
+			quotaStr, used := "unlimited", "-"
+			if quota > 0 {
+				quotaStr = config.ByteSize(quota).String()
+				used = fmt.Sprintf("%d%%", (traffic[0]+traffic[1])*100/quota)
+			}
+			if !custom {
+				quotaStr += " (default)"
+			}
+			fmt.Fprintf(wr, "%s\t%s\t%s\t%s\t%s\n", fingerprint, quotaStr,
+				config.ByteSize(traffic[0]), config.ByteSize(traffic[1]), used)
+		}
+		return wr.Flush()
+	},
+}
+
+func init() {
+	quotasListCmd.Flags().StringVar(&quotasMonth, "month", time.Now().UTC().Format("2006-01"), "The month to show the traffic of, in the form YYYY-MM")
+
+	quotasCmd.AddCommand(quotasSetCmd)
+	quotasCmd.AddCommand(quotasRemoveCmd)
+	quotasCmd.AddCommand(quotasListCmd)
+
+	rootCmd.AddCommand(quotasCmd)
+}
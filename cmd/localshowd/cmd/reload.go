@@ -0,0 +1,105 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gabriel-samfira/localshow/config"
+	"github.com/gabriel-samfira/localshow/sshsrv"
+)
+
+// configWatchInterval is how often the config file is checked for
+// changes when --watch-config is set.
+const configWatchInterval = 5 * time.Second
+
+// reloader is implemented by the servers that can apply a new
+// configuration without a restart. PrepareReload must not change the
+// running server. The function it returns applies the configuration, and
+// can not fail.
+type reloader interface {
+	PrepareReload(cfg *config.Config) (func(), error)
+}
+
+// reloadConfig loads the config file, validates it and applies the
+// settings that can be changed at runtime. The new config is only applied
+// once every server accepted it, so a failed reload changes nothing. It
+// returns the config that is now in effect.
+func reloadConfig(current *config.Config, servers ...reloader) (*config.Config, error) {
+	newCfg, err := config.NewConfig(cfgFile)
+	if err != nil {
+		return current, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	newCfg, needRestart := current.Reloadable(newCfg)
+	if len(needRestart) > 0 {
+		log.Printf("settings that require a restart were not applied: %s", strings.Join(needRestart, ", "))
+	}
+
+	if err := sshsrv.GenerateKey(newCfg.SSHServer.HostKeyPath); err != nil {
+		return current, fmt.Errorf("failed to generate host key: %w", err)
+	}
+
+	applies := make([]func(), 0, len(servers))
+	for _, srv := range servers {
+		apply, err := srv.PrepareReload(newCfg)
+		if err != nil {
+			return current, err
+		}
+		applies = append(applies, apply)
+	}
+	for _, apply := range applies {
+		apply()
+	}
+	return newCfg, nil
+}
+
+// watchConfig sends on changed whenever the modification time or size
+// of the config file changes.
+func watchConfig(ctx context.Context, changed chan<- struct{}) {
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(cfgFile)
+		if err != nil {
+			return time.Time{}, 0
+		}
+		return info.ModTime(), info.Size()
+	}
+
+	lastMod, lastSize := stat()
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mod, size := stat()
+			if mod.IsZero() || (mod.Equal(lastMod) && size == lastSize) {
+				continue
+			}
+			lastMod, lastSize = mod, size
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gabriel-samfira/localshow/config"
+	"github.com/gabriel-samfira/localshow/database"
+	"github.com/spf13/cobra"
+)
+
+// openDatabase loads the config file and opens the database it points to.
+func openDatabase(ctx context.Context) (*database.SQLDatabase, error) {
+	cfg, err := config.NewConfig(cfgFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	db, err := database.NewSQLDatabase(ctx, cfg.Database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create database: %w", err)
+	}
+	return db, nil
+}
+
+var reservationsCmd = &cobra.Command{
+	Use:          "reservations",
+	SilenceUsage: true,
+	Short:        "Manage subdomain reservations",
+	Long: `Manage subdomain reservations.
+
+A reservation ties a subdomain, or a wildcard pattern (for example "team-*"),
+to the SHA256 fingerprints of one or more public keys. Only the listed keys
+may register tunnels on matching subdomains. You can get the fingerprint of
+a public key by running: ssh-keygen -lf ~/.ssh/id_ed25519.pub`,
+}
+
+var reservationsAddCmd = &cobra.Command{
+	Use:          "add <pattern> <fingerprint> [fingerprint...]",
+	SilenceUsage: true,
+	Short:        "Reserve a subdomain or pattern for one or more keys",
+	Args:         cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), signals...)
+		defer stop()
+
+		db, err := openDatabase(ctx)
+		if err != nil {
+			return err
+		}
+		return db.AddReservation(args[0], args[1:])
+	},
+}
+
+var reservationsListCmd = &cobra.Command{
+	Use:          "list",
+	SilenceUsage: true,
+	Short:        "List subdomain reservations",
+	Args:         cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), signals...)
+		defer stop()
+
+		db, err := openDatabase(ctx)
+		if err != nil {
+			return err
+		}
+		reservations, err := db.ListReservations()
+		if err != nil {
+			return fmt.Errorf("failed to list reservations: %w", err)
+		}
+
+		wr := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(wr, "PATTERN\tFINGERPRINTS")
+		for _, reservation := range reservations {
+			fmt.Fprintf(wr, "%s\t%s\n", reservation.Pattern, strings.Join(reservation.Fingerprints, ", "))
+		}
+		return wr.Flush()
+	},
+}
+
+var reservationsRemoveCmd = &cobra.Command{
+	Use:          "remove <pattern> [fingerprint...]",
+	SilenceUsage: true,
+	Short:        "Remove a reservation, or some of the keys allowed by it",
+	Args:         cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), signals...)
+		defer stop()
+
+		db, err := openDatabase(ctx)
+		if err != nil {
+			return err
+		}
+		return db.RemoveReservation(args[0], args[1:])
+	},
+}
+
+func init() {
+	reservationsCmd.AddCommand(reservationsAddCmd)
+	reservationsCmd.AddCommand(reservationsListCmd)
+	reservationsCmd.AddCommand(reservationsRemoveCmd)
+
+	rootCmd.AddCommand(reservationsCmd)
+}
@@ -17,6 +17,7 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"log"
 	"os"
 	"os/signal"
 	"syscall"
@@ -31,8 +32,9 @@ import (
 )
 
 var (
-	cfgFile string = "/etc/localshow/localshow.toml"
-	Version string
+	cfgFile  string = "/etc/localshow/localshow.toml"
+	watchCfg bool
+	Version  string
 )
 
 var signals = []os.Signal{
@@ -72,7 +74,14 @@ var rootCmd = &cobra.Command{
 			return fmt.Errorf("failed to create api controller: %w", err)
 		}
 
-		sshSrv, err := sshsrv.NewSSHServer(ctx, cfg, tunnelEvents, db)
+		httpSrv, err := httpsrv.NewHTTPServer(ctx, cfg, tunnelEvents, apiHan, db, Version)
+		if err != nil {
+			return fmt.Errorf("failed to create http server: %w", err)
+		}
+
+		// The SSH server exports the requests captured by the HTTP
+		// server, and connects local forwards to its tunnels.
+		sshSrv, err := sshsrv.NewSSHServer(ctx, cfg, tunnelEvents, db, httpSrv, Version)
 		if err != nil {
 			return fmt.Errorf("failed to create ssh server: %w", err)
 		}
@@ -81,17 +90,41 @@ var rootCmd = &cobra.Command{
 			return fmt.Errorf("failed to start ssh server: %w", err)
 		}
 
-		httpSrv, err := httpsrv.NewHTTPServer(ctx, cfg, tunnelEvents, apiHan)
-		if err != nil {
-			return fmt.Errorf("failed to create http server: %w", err)
-		}
-
 		if err := httpSrv.Start(); err != nil {
 			return fmt.Errorf("failed to start http server: %w", err)
 		}
 
-		<-ctx.Done()
-		return nil
+		// SIGHUP, or a change of the config file when watching it,
+		// reloads the config without dropping connected tunnels.
+		reload := make(chan struct{}, 1)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		if watchCfg {
+			go watchConfig(ctx, reload)
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				// Wait for the ssh server to record the traffic of
+				// tunnels in the database.
+				if err := sshSrv.Wait(); err != nil {
+					log.Printf("failed to stop ssh server: %s", err)
+				}
+				return nil
+			case <-hup:
+			case <-reload:
+			}
+
+			log.Printf("reloading config from %s", cfgFile)
+			cfg, err = reloadConfig(cfg, httpSrv, sshSrv)
+			if err != nil {
+				log.Printf("failed to reload config: %s", err)
+				continue
+			}
+			log.Printf("config reloaded")
+		}
 	},
 }
 
@@ -106,4 +139,5 @@ func Execute() {
 
 func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", cfgFile, "config file for localshowd")
+	rootCmd.Flags().BoolVar(&watchCfg, "watch-config", false, "reload the config when the config file changes")
 }
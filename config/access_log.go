@@ -0,0 +1,91 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+const (
+	// DefaultAccessLogMaxSize is the size at which access log files are
+	// rotated, when max_size is not set.
+	DefaultAccessLogMaxSize ByteSize = 100 * 1000 * 1000
+	// DefaultAccessLogMaxBackups is the number of rotated access log files
+	// kept, when max_backups is not set.
+	DefaultAccessLogMaxBackups = 5
+)
+
+// AccessLog writes the requests proxied to tunnels to a log file per
+// hostname, in addition to the log stream sent to the owners of tunnels.
+type AccessLog struct {
+	Enabled bool `toml:"enabled"`
+	// Dir holds the log files, named <hostname>.log.
+	Dir string `toml:"dir"`
+	// Format is the log format. Defaults to params.LogFormatCombined.
+	Format string `toml:"format"`
+	// MaxSize is the size at which a log file is rotated. Defaults to
+	// DefaultAccessLogMaxSize.
+	MaxSize ByteSize `toml:"max_size"`
+	// MaxBackups is the number of rotated log files kept for each
+	// hostname. Defaults to DefaultAccessLogMaxBackups.
+	MaxBackups int `toml:"max_backups"`
+}
+
+func (a AccessLog) Validate() error {
+	if !a.Enabled {
+		return nil
+	}
+	if a.Dir == "" {
+		return fmt.Errorf("dir is required")
+	}
+	switch a.Format {
+	case "", params.LogFormatCombined, params.LogFormatJSON:
+	default:
+		return fmt.Errorf("invalid format %q", a.Format)
+	}
+	if a.MaxSize < 0 {
+		return fmt.Errorf("max_size may not be negative")
+	}
+	if a.MaxBackups < 0 {
+		return fmt.Errorf("max_backups may not be negative")
+	}
+	return nil
+}
+
+// LogFormat returns the format of the log files.
+func (a AccessLog) LogFormat() string {
+	if a.Format == "" {
+		return params.LogFormatCombined
+	}
+	return a.Format
+}
+
+// RotateSize returns the size at which a log file is rotated.
+func (a AccessLog) RotateSize() int64 {
+	if a.MaxSize > 0 {
+		return int64(a.MaxSize)
+	}
+	return int64(DefaultAccessLogMaxSize)
+}
+
+// Backups returns the number of rotated log files kept for each hostname.
+func (a AccessLog) Backups() int {
+	if a.MaxBackups > 0 {
+		return a.MaxBackups
+	}
+	return DefaultAccessLogMaxBackups
+}
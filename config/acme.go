@@ -0,0 +1,164 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// ACMEChallengeDNS01 obtains a single wildcard certificate for the
+	// domain of the server. The TXT records are published by a hook.
+	ACMEChallengeDNS01 = "dns-01"
+	// ACMEChallengeHTTP01 obtains a certificate for each hostname, by
+	// answering challenges on the HTTP listener.
+	ACMEChallengeHTTP01 = "http-01"
+	// ACMEChallengeTLSALPN01 obtains a certificate for each hostname, by
+	// answering challenges on the TLS listener.
+	ACMEChallengeTLSALPN01 = "tls-alpn-01"
+
+	// DefaultACMEDirectoryURL is the production directory of Let's Encrypt.
+	DefaultACMEDirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
+	// DefaultACMERenewBefore is how long before they expire certificates
+	// are renewed.
+	DefaultACMERenewBefore = 30 * 24 * time.Hour
+)
+
+// ACME configures the ACME client used to obtain the certificates served
+// on the TLS listener, instead of the certificate set in the tls section.
+type ACME struct {
+	Enabled bool `toml:"enabled"`
+	// DirectoryURL is the directory of the ACME CA. Defaults to
+	// DefaultACMEDirectoryURL.
+	DirectoryURL string `toml:"directory_url"`
+	// Email is the contact address of the ACME account.
+	Email string `toml:"email"`
+	// CacheDir holds the account key and the certificates.
+	CacheDir string `toml:"cache_dir"`
+	// Challenge is the challenge type used to prove control over the
+	// domains. Defaults to http-01.
+	Challenge string `toml:"challenge"`
+	// DNSHook is the executable that publishes the TXT records of dns-01
+	// challenges. It is called with the "present" or "cleanup" action,
+	// the name of the record and its value.
+	DNSHook string `toml:"dns_hook"`
+	// CACertificates is a PEM file with additional CA certificates to
+	// trust when connecting to the ACME server, like the one of a test
+	// CA.
+	CACertificates string `toml:"ca_certificates"`
+	// RenewBefore is how long before they expire certificates are
+	// renewed. Defaults to DefaultACMERenewBefore.
+	RenewBefore time.Duration `toml:"renew_before"`
+	// AllSubdomains obtains certificates for the subdomains of all
+	// tunnels with the http-01 and tls-alpn-01 challenges. By default,
+	// they are only obtained for reserved subdomains and custom domains,
+	// so random subdomains do not exhaust the rate limits of the CA.
+	AllSubdomains bool `toml:"all_subdomains"`
+}
+
+func (a ACME) Validate() error {
+	if !a.Enabled {
+		return nil
+	}
+
+	if a.CacheDir == "" {
+		return fmt.Errorf("cache_dir is required")
+	}
+	if err := os.MkdirAll(a.CacheDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create cache dir: %w", err)
+	}
+
+	switch a.ChallengeType() {
+	case ACMEChallengeHTTP01, ACMEChallengeTLSALPN01:
+	case ACMEChallengeDNS01:
+		if a.DNSHook == "" {
+			return fmt.Errorf("the dns-01 challenge requires dns_hook to be set")
+		}
+	default:
+		return fmt.Errorf("invalid challenge %q", a.Challenge)
+	}
+
+	if a.CACertificates != "" {
+		if _, err := a.caPool(); err != nil {
+			return err
+		}
+	}
+
+	if a.RenewBefore < 0 {
+		return fmt.Errorf("renew_before may not be negative")
+	}
+	return nil
+}
+
+// ChallengeType returns the challenge type used to obtain certificates.
+func (a ACME) ChallengeType() string {
+	if a.Challenge == "" {
+		return ACMEChallengeHTTP01
+	}
+	return a.Challenge
+}
+
+// Directory returns the directory URL of the ACME CA.
+func (a ACME) Directory() string {
+	if a.DirectoryURL == "" {
+		return DefaultACMEDirectoryURL
+	}
+	return a.DirectoryURL
+}
+
+// RenewalWindow returns how long before they expire certificates are
+// renewed.
+func (a ACME) RenewalWindow() time.Duration {
+	if a.RenewBefore > 0 {
+		return a.RenewBefore
+	}
+	return DefaultACMERenewBefore
+}
+
+func (a ACME) caPool() (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	caCerts, err := os.ReadFile(a.CACertificates)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca certificates: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(caCerts) {
+		return nil, fmt.Errorf("no certificates found in %s", a.CACertificates)
+	}
+	return pool, nil
+}
+
+// HTTPClient returns the client used to talk to the ACME server.
+func (a ACME) HTTPClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if a.CACertificates != "" {
+		pool, err := a.caPool()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{
+		Timeout:   time.Minute,
+		Transport: transport,
+	}, nil
+}
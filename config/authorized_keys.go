@@ -0,0 +1,190 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Permission extensions set on the connection of clients authenticated
+// using a key with authorized_keys options. They are enforced by the SSH
+// server when handling forwarding and session requests.
+const (
+	// ExtensionPermitListen holds a comma separated list of [host:]port
+	// remote forwards the key is allowed to request.
+	ExtensionPermitListen = "permit-listen"
+	// ExtensionMaxTunnels holds the maximum number of tunnels the key may
+	// register at the same time.
+	ExtensionMaxTunnels = "max-tunnels"
+	// ExtensionNoPortForwarding is set when the key may not request any
+	// remote or local forwards.
+	ExtensionNoPortForwarding = "no-port-forwarding"
+	// ExtensionNoPTY is set when the key may not allocate a PTY.
+	ExtensionNoPTY = "no-pty"
+)
+
+// ignoredKeyOptions are valid OpenSSH options that have no meaning for
+// localshow.
+var ignoredKeyOptions = map[string]bool{
+	"agent-forwarding":    true,
+	"no-agent-forwarding": true,
+	"x11-forwarding":      true,
+	"no-x11-forwarding":   true,
+	"user-rc":             true,
+	"no-user-rc":          true,
+	"no-touch-required":   true,
+	"verify-required":     true,
+	"command":             true,
+	"environment":         true,
+	"permitopen":          true,
+	"principals":          true,
+	"tunnel":              true,
+}
+
+func unquoteOption(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// parseExpiryTime parses an OpenSSH expiry-time value. The time is
+// specified as YYYYMMDD[HHMM[SS]] in local time, or in UTC if it has a
+// Z suffix.
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") || strings.HasSuffix(value, "z") {
+		loc = time.UTC
+		value = value[:len(value)-1]
+	}
+
+	var layout string
+	switch len(value) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+	}
+	return time.ParseInLocation(layout, value, loc)
+}
+
+// matchFrom checks addr against an OpenSSH from= pattern list. Entries
+// may be CIDRs or IP addresses with * and ? wildcards, and are negated
+// by a leading "!". Host names are not resolved.
+func matchFrom(patterns string, addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	if ip == nil {
+		return false
+	}
+
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var ok bool
+		if strings.Contains(pattern, "/") {
+			if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+				ok = ipNet.Contains(ip)
+			}
+		} else {
+			ok, _ = path.Match(pattern, ip.String())
+		}
+
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// keyOptionsExtensions validates the authorized_keys options of a key
+// against the connecting client and returns the permission extensions
+// that enforce them.
+func keyOptionsExtensions(options []string, remoteAddr net.Addr, now time.Time) (map[string]string, error) {
+	extensions := map[string]string{}
+	noPortForwarding := false
+	noPTY := false
+	var permitListen []string
+
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		value = unquoteOption(value)
+		switch strings.ToLower(name) {
+		case "restrict":
+			noPortForwarding = true
+			noPTY = true
+		case "no-port-forwarding":
+			noPortForwarding = true
+		case "port-forwarding":
+			noPortForwarding = false
+		case "no-pty":
+			noPTY = true
+		case "pty":
+			noPTY = false
+		case "expiry-time":
+			expiry, err := parseExpiryTime(value)
+			if err != nil {
+				return nil, err
+			}
+			if now.After(expiry) {
+				return nil, fmt.Errorf("key expired at %s", expiry)
+			}
+		case "from":
+			if !matchFrom(value, remoteAddr) {
+				return nil, fmt.Errorf("connection from %s not allowed", remoteAddr)
+			}
+		case "permitlisten":
+			permitListen = append(permitListen, value)
+		case "localshow-max-tunnels":
+			maxTunnels, err := strconv.Atoi(value)
+			if err != nil || maxTunnels < 1 {
+				return nil, fmt.Errorf("invalid localshow-max-tunnels %q", value)
+			}
+			extensions[ExtensionMaxTunnels] = strconv.Itoa(maxTunnels)
+		default:
+			if !ignoredKeyOptions[strings.ToLower(name)] {
+				return nil, fmt.Errorf("unsupported key option %q", name)
+			}
+		}
+	}
+
+	if noPortForwarding {
+		extensions[ExtensionNoPortForwarding] = "true"
+	}
+	if noPTY {
+		extensions[ExtensionNoPTY] = "true"
+	}
+	if len(permitListen) > 0 {
+		extensions[ExtensionPermitListen] = strings.Join(permitListen, ",")
+	}
+	return extensions, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	// Longer suffixes first, so "KiB" is not parsed as "B".
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"TB", 1000 * 1000 * 1000 * 1000},
+	{"K", 1000},
+	{"M", 1000 * 1000},
+	{"G", 1000 * 1000 * 1000},
+	{"T", 1000 * 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// ByteSize is an amount of bytes. In the config file, it may be set as a
+// number of bytes, or as a string with a unit, like "500MB" or "10GiB".
+type ByteSize int64
+
+// ParseByteSize parses an amount of bytes, optionally followed by a unit.
+// KB, MB, GB and TB are powers of 1000, while KiB, MiB, GiB and TiB are
+// powers of 1024.
+func ParseByteSize(value string) (ByteSize, error) {
+	value = strings.TrimSpace(value)
+	multiplier := int64(1)
+	for _, unit := range byteSizeUnits {
+		if number, found := strings.CutSuffix(value, unit.suffix); found {
+			value = strings.TrimSpace(number)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 || math.IsInf(number, 0) {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	size := number * float64(multiplier)
+	if size > math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return ByteSize(size), nil
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	size, err := ParseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// String formats the size using the largest power of 1000 it reaches.
+func (b ByteSize) String() string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size := float64(b)
+	idx := 0
+	for size >= 1000 && idx < len(units)-1 {
+		size /= 1000
+		idx++
+	}
+	if idx == 0 {
+		return fmt.Sprintf("%d B", int64(b))
+	}
+	return fmt.Sprintf("%.2f %s", size, units[idx])
+}
+
+// Bandwidth configures the shaping of the traffic of tunnels, and the
+// amount of traffic each key may transfer per month.
+type Bandwidth struct {
+	// TunnelRate limits the throughput of each tunnel, in bytes per
+	// second. It applies to each direction separately. Zero means no
+	// limit.
+	TunnelRate ByteSize `toml:"tunnel_rate"`
+	// MonthlyQuota is the traffic, in both directions, the tunnels of a
+	// key may transfer during a calendar month (UTC). Keys may be given
+	// a different quota using the quotas command. Zero means no limit.
+	MonthlyQuota ByteSize `toml:"monthly_quota"`
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import "fmt"
+
+const (
+	// DefaultCaptureMaxRequests is the number of requests kept for each
+	// tunnel, when max_requests is not set.
+	DefaultCaptureMaxRequests = 100
+	// DefaultCaptureMaxBodySize is the number of bytes kept from the body
+	// of each request and response, when max_body_size is not set.
+	DefaultCaptureMaxBodySize ByteSize = 64 * 1024
+	// DefaultCaptureMaxMemory is the number of bytes kept from bodies by
+	// the captures of all tunnels, when max_memory is not set.
+	DefaultCaptureMaxMemory ByteSize = 256 * 1024 * 1024
+)
+
+// Capture limits the requests kept for tunnels whose owners enabled
+// request capture. Captured requests are kept in memory.
+type Capture struct {
+	// MaxRequests is the number of requests kept for each tunnel. Older
+	// requests are dropped. Defaults to DefaultCaptureMaxRequests.
+	MaxRequests int `toml:"max_requests"`
+	// MaxBodySize is the number of bytes kept from the body of each
+	// request and response. Defaults to DefaultCaptureMaxBodySize.
+	MaxBodySize ByteSize `toml:"max_body_size"`
+	// MaxMemory is the number of bytes kept from bodies by the captures
+	// of all tunnels. Once reached, only the size of the bodies of new
+	// requests is kept, until older requests are dropped. Defaults to
+	// DefaultCaptureMaxMemory.
+	MaxMemory ByteSize `toml:"max_memory"`
+}
+
+func (c Capture) Validate() error {
+	if c.MaxRequests < 0 {
+		return fmt.Errorf("max_requests may not be negative")
+	}
+	if c.MaxBodySize < 0 {
+		return fmt.Errorf("max_body_size may not be negative")
+	}
+	if c.MaxMemory < 0 {
+		return fmt.Errorf("max_memory may not be negative")
+	}
+	return nil
+}
+
+// Requests returns the number of requests kept for each tunnel.
+func (c Capture) Requests() int {
+	if c.MaxRequests > 0 {
+		return c.MaxRequests
+	}
+	return DefaultCaptureMaxRequests
+}
+
+// BodySize returns the number of bytes kept from each body.
+func (c Capture) BodySize() int64 {
+	if c.MaxBodySize > 0 {
+		return int64(c.MaxBodySize)
+	}
+	return int64(DefaultCaptureMaxBodySize)
+}
+
+// Memory returns the number of bytes kept from bodies by all captures.
+func (c Capture) Memory() int64 {
+	if c.MaxMemory > 0 {
+		return int64(c.MaxMemory)
+	}
+	return int64(DefaultCaptureMaxMemory)
+}
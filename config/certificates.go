@@ -0,0 +1,121 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Permission extensions set on the connection of clients authenticated
+// using a user certificate.
+const (
+	// ExtensionCertKeyID holds the key ID of the certificate.
+	ExtensionCertKeyID = "cert-key-id"
+	// ExtensionCertPrincipals holds a comma separated list of the
+	// principals of the certificate.
+	ExtensionCertPrincipals = "cert-principals"
+	// ExtensionCertSerial holds the serial number of the certificate.
+	ExtensionCertSerial = "cert-serial"
+)
+
+// certExtensionMaxTunnels is a certificate extension that limits the number
+// of tunnels, just like the localshow-max-tunnels authorized_keys option.
+// It can be set using: ssh-keygen -O extension:localshow-max-tunnels=N
+const certExtensionMaxTunnels = "localshow-max-tunnels"
+
+// loadTrustedUserCAKeys reads the CA keys from path, which holds one key
+// per line in the authorized_keys format.
+func loadTrustedUserCAKeys(path string) ([]ssh.PublicKey, error) {
+	caKeysBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted user CA keys: %w", err)
+	}
+
+	var caKeys []ssh.PublicKey
+	for idx, line := range bytes.Split(caKeysBytes, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse line %d of %s: %w", idx+1, path, err)
+		}
+		caKeys = append(caKeys, pubKey)
+	}
+	if len(caKeys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", path)
+	}
+	return caKeys, nil
+}
+
+func (c SSHServer) isTrustedUserCA(auth ssh.PublicKey) bool {
+	authBytes := auth.Marshal()
+	for _, caKey := range c.caKeys {
+		if bytes.Equal(caKey.Marshal(), authBytes) {
+			return true
+		}
+	}
+	return false
+}
+
+// certificateExtensions validates a user certificate against the trusted
+// CAs and returns the permission extensions for the connection. The
+// validity window, the principals and the source-address critical option
+// are checked by ssh.CertChecker.
+func (c SSHServer) certificateExtensions(meta ssh.ConnMetadata, cert *ssh.Certificate) (map[string]string, error) {
+	if len(cert.ValidPrincipals) == 0 {
+		// Same as OpenSSH, we do not accept certificates valid for any
+		// principal.
+		return nil, fmt.Errorf("certificate %q has no principals", cert.KeyId)
+	}
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: c.isTrustedUserCA,
+	}
+	perms, err := checker.Authenticate(meta, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	// Translate the permissions granted by the certificate into the
+	// options we already enforce for authorized keys.
+	var options []string
+	if _, ok := perms.Extensions["permit-port-forwarding"]; !ok {
+		options = append(options, "no-port-forwarding")
+	}
+	if _, ok := perms.Extensions["permit-pty"]; !ok {
+		options = append(options, "no-pty")
+	}
+	if val, ok := perms.Extensions[certExtensionMaxTunnels]; ok {
+		options = append(options, fmt.Sprintf("localshow-max-tunnels=%s", val))
+	}
+
+	extensions, err := keyOptionsExtensions(options, meta.RemoteAddr(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	extensions[ExtensionCertKeyID] = cert.KeyId
+	extensions[ExtensionCertPrincipals] = strings.Join(cert.ValidPrincipals, ",")
+	extensions[ExtensionCertSerial] = strconv.FormatUint(cert.Serial, 10)
+	return extensions, nil
+}
@@ -17,11 +17,50 @@ package config
 import (
 	"crypto/tls"
 	"fmt"
+	"log"
 	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"golang.org/x/crypto/ssh"
+
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+const (
+	// PoolStrategyRoundRobin sends each request to the next member
+	// of a load balanced tunnel.
+	PoolStrategyRoundRobin = "round-robin"
+	// PoolStrategyLeastConnections sends each request to the member
+	// of a load balanced tunnel with the fewest requests in flight.
+	PoolStrategyLeastConnections = "least-connections"
+
+	// SubdomainStrategyRandom generates a new random subdomain for
+	// every tunnel that does not request one.
+	SubdomainStrategyRandom = "random"
+	// SubdomainStrategyFingerprint derives the generated subdomain from
+	// the fingerprint of the key used by the client.
+	SubdomainStrategyFingerprint = "fingerprint"
+	// SubdomainStrategyUsername derives the generated subdomain from the
+	// SSH username of the client.
+	SubdomainStrategyUsername = "username"
+
+	// DefaultMaxTunnelsPerClient is the number of tunnels a single SSH
+	// connection may register when max_tunnels_per_client is not set.
+	DefaultMaxTunnelsPerClient = 10
+
+	// DefaultMaxHeldRequests is the number of requests held for a tunnel
+	// while its owner reconnects, when max_held_requests is not set.
+	DefaultMaxHeldRequests = 100
+
+	// DefaultCertificateExpiryWarning is how long before they expire a
+	// warning is logged about certificates, when expiry_warning is not
+	// set.
+	DefaultCertificateExpiryWarning = 14 * 24 * time.Hour
 )
 
 type PasswordAuthCallback func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error)
@@ -72,16 +111,55 @@ type SSHServer struct {
 
 	HostKeyPath        string `toml:"host_key_path"`
 	AuthorizedKeysPath string `toml:"authorized_keys_path"`
-	DisableAuth        bool   `toml:"disable_auth"`
+	// TrustedUserCAKeys is the path to a file holding the public keys
+	// of the certificate authorities trusted to sign user certificates,
+	// one per line.
+	TrustedUserCAKeys string `toml:"trusted_user_ca_keys"`
+	// caKeys are the keys read from TrustedUserCAKeys by Validate. A
+	// reloaded config holds the keys read at reload time.
+	caKeys      []ssh.PublicKey
+	DisableAuth bool `toml:"disable_auth"`
+	// MaxTunnelsPerClient limits how many tunnels a single SSH
+	// connection may register. Defaults to DefaultMaxTunnelsPerClient.
+	MaxTunnelsPerClient int `toml:"max_tunnels_per_client"`
+	// ProxyProtocol reads the address of clients from the PROXY protocol
+	// header sent by a load balancer in front of the SSH listener.
+	ProxyProtocol ProxyProtocol `toml:"proxy_protocol"`
+}
+
+// MaxTunnels returns the number of tunnels a single SSH connection
+// may register.
+func (c SSHServer) MaxTunnels() int {
+	if c.MaxTunnelsPerClient > 0 {
+		return c.MaxTunnelsPerClient
+	}
+	return DefaultMaxTunnelsPerClient
 }
 
-func (c SSHServer) Validate() error {
+func (c *SSHServer) Validate() error {
 	if c.HostKeyPath == "" {
 		return fmt.Errorf("host key path is required")
 	}
 
-	if !c.DisableAuth && c.AuthorizedKeysPath == "" {
-		return fmt.Errorf("authorized keys path is required when auth is enabled")
+	if !c.DisableAuth && c.AuthorizedKeysPath == "" && c.TrustedUserCAKeys == "" {
+		return fmt.Errorf("authorized keys path or trusted user CA keys are required when auth is enabled")
+	}
+
+	c.caKeys = nil
+	if c.TrustedUserCAKeys != "" {
+		caKeys, err := loadTrustedUserCAKeys(c.TrustedUserCAKeys)
+		if err != nil {
+			return err
+		}
+		c.caKeys = caKeys
+	}
+
+	if c.MaxTunnelsPerClient < 0 {
+		return fmt.Errorf("invalid max tunnels per client %d", c.MaxTunnelsPerClient)
+	}
+
+	if err := c.ProxyProtocol.Validate(); err != nil {
+		return fmt.Errorf("failed to validate proxy protocol config: %w", err)
 	}
 	return nil
 }
@@ -98,25 +176,101 @@ type HTTPServer struct {
 	// When zero, the corresponding bind port is used.
 	ExternalPort    int `toml:"external_port"`
 	ExternalTLSPort int `toml:"external_tls_port"`
+	// TrustedProxies are the networks of the reverse proxies in front of
+	// localshow, in CIDR notation or as single IP addresses. The address
+	// of visitors is taken from the X-Forwarded-For or Forwarded header
+	// of requests coming from them. Those headers are dropped from
+	// requests coming from anywhere else.
+	TrustedProxies []string `toml:"trusted_proxies"`
 
 	ExcludedSubdomains []string `toml:"excluded_subdomains"`
 	DomainName         string   `toml:"domain_name"`
+	// SubdomainStrategy is how subdomains are generated for tunnels that
+	// do not request one. Defaults to random. The fingerprint and
+	// username strategies give clients the same subdomain every time
+	// they connect.
+	SubdomainStrategy string `toml:"subdomain_strategy"`
+
+	// PoolStrategy is the strategy used to balance visitors between
+	// the members of a load balanced tunnel. Defaults to round-robin.
+	PoolStrategy string `toml:"pool_strategy"`
+	// PoolStickySessions pins visitors of a load balanced tunnel to
+	// the same member using a cookie.
+	PoolStickySessions bool `toml:"pool_sticky_sessions"`
+
+	// VisitorAuth holds the credentials visitors may use to reach any
+	// tunnel.
+	VisitorAuth VisitorAuth `toml:"visitor_auth"`
+	// RateLimit holds the default limits of HTTP tunnels.
+	RateLimit RateLimit `toml:"rate_limit"`
+	// Capture limits the requests kept for tunnels with request capture
+	// enabled.
+	Capture Capture `toml:"capture"`
 
 	UseTLS      bool      `toml:"use_tls" json:"use-tls"`
 	TLSBindPort int       `toml:"tls_bind_port" json:"tls-bind-port"`
 	TLSConfig   TLSConfig `toml:"tls" json:"tls"`
+	// ACME obtains the certificates of the TLS listener from an ACME CA.
+	// The certificates in TLSConfig are optional when it is enabled, and
+	// are served for hostnames ACME has no certificate for.
+	ACME ACME `toml:"acme" json:"acme"`
+
+	// ProxyProtocol and TLSProxyProtocol read the address of visitors
+	// from the PROXY protocol header sent by a load balancer in front of
+	// the HTTP and the TLS listener.
+	ProxyProtocol    ProxyProtocol `toml:"proxy_protocol" json:"proxy-protocol"`
+	TLSProxyProtocol ProxyProtocol `toml:"tls_proxy_protocol" json:"tls-proxy-protocol"`
 }
 
 func (a *HTTPServer) Validate() error {
-	if a.UseTLS {
+	if a.UseTLS && (!a.ACME.Enabled || a.TLSConfig.HasCertificates()) {
 		if err := a.TLSConfig.Validate(); err != nil {
 			return fmt.Errorf("failed to validate tls config: %w", err)
 		}
 	}
+	if a.ACME.Enabled && !a.UseTLS {
+		return fmt.Errorf("acme requires use_tls to be enabled")
+	}
+	if err := a.ACME.Validate(); err != nil {
+		return fmt.Errorf("failed to validate acme config: %w", err)
+	}
+	if _, err := a.TrustedProxyNetworks(); err != nil {
+		return err
+	}
+	if err := a.ProxyProtocol.Validate(); err != nil {
+		return fmt.Errorf("failed to validate proxy protocol config: %w", err)
+	}
+	if err := a.TLSProxyProtocol.Validate(); err != nil {
+		return fmt.Errorf("failed to validate tls proxy protocol config: %w", err)
+	}
 	if a.BindPort > 65535 || a.BindPort < 1 {
 		return fmt.Errorf("invalid port nr %d", a.BindPort)
 	}
 
+	switch a.PoolStrategy {
+	case "", PoolStrategyRoundRobin, PoolStrategyLeastConnections:
+	default:
+		return fmt.Errorf("invalid pool strategy %q", a.PoolStrategy)
+	}
+
+	switch a.SubdomainStrategy {
+	case "", SubdomainStrategyRandom, SubdomainStrategyFingerprint, SubdomainStrategyUsername:
+	default:
+		return fmt.Errorf("invalid subdomain strategy %q", a.SubdomainStrategy)
+	}
+
+	if err := a.VisitorAuth.Validate(); err != nil {
+		return fmt.Errorf("failed to validate visitor auth config: %w", err)
+	}
+
+	if err := a.RateLimit.Validate(); err != nil {
+		return fmt.Errorf("failed to validate rate limit config: %w", err)
+	}
+
+	if err := a.Capture.Validate(); err != nil {
+		return fmt.Errorf("failed to validate capture config: %w", err)
+	}
+
 	if a.UseTLS && (a.TLSBindPort > 65535 || a.TLSBindPort < 1) {
 		return fmt.Errorf("invalid tls port nr %d", a.TLSBindPort)
 	}
@@ -141,6 +295,19 @@ func (a *HTTPServer) TLSBindAddress() string {
 	return fmt.Sprintf("%s:%d", a.BindAddr, a.TLSBindPort)
 }
 
+// TrustedProxyNetworks returns the parsed trusted proxies.
+func (a *HTTPServer) TrustedProxyNetworks() ([]netip.Prefix, error) {
+	networks := make([]netip.Prefix, 0, len(a.TrustedProxies))
+	for _, val := range a.TrustedProxies {
+		prefix, err := ParseNetwork(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q in trusted_proxies", val)
+		}
+		networks = append(networks, prefix)
+	}
+	return networks, nil
+}
+
 // EffectivePort returns the public-facing HTTP port. It returns
 // ExternalPort when configured, otherwise it falls back to BindPort.
 func (a *HTTPServer) EffectivePort() int {
@@ -159,24 +326,264 @@ func (a *HTTPServer) EffectiveTLSPort() int {
 	return a.TLSBindPort
 }
 
+// VisitorAuth is the server wide policy for authenticating the visitors of
+// tunnels. When users or tokens are set, every public HTTP tunnel requires
+// visitors to authenticate, using either these credentials or the ones set
+// by the owner of the tunnel.
+type VisitorAuth struct {
+	// Users are basic auth credentials, in the form user:password.
+	Users []string `toml:"users"`
+	// Tokens are accepted as bearer tokens, or through the
+	// localshow_token query parameter.
+	Tokens []string `toml:"tokens"`
+	// RequireTunnelCredentials rejects tunnels whose owner did not set
+	// the auth or token options.
+	RequireTunnelCredentials bool `toml:"require_tunnel_credentials"`
+}
+
+func (v VisitorAuth) Validate() error {
+	for _, user := range v.Users {
+		name, password, ok := strings.Cut(user, ":")
+		if !ok || name == "" || password == "" {
+			return fmt.Errorf("users must be in the form user:password")
+		}
+	}
+
+	for _, token := range v.Tokens {
+		if token == "" {
+			return fmt.Errorf("tokens may not be empty")
+		}
+	}
+	return nil
+}
+
+// Enabled returns true if server wide credentials are configured.
+func (v VisitorAuth) Enabled() bool {
+	return len(v.Users) > 0 || len(v.Tokens) > 0
+}
+
+// RateLimit holds the default limits of HTTP tunnels. Tunnel owners may
+// set stricter limits using the tunnel options. Zero values disable a
+// limit.
+type RateLimit struct {
+	// RequestsPerSecond and Burst limit the requests accepted by a
+	// tunnel from all visitors. Burst defaults to RequestsPerSecond.
+	RequestsPerSecond float64 `toml:"requests_per_second"`
+	Burst             int     `toml:"burst"`
+	// VisitorRequestsPerSecond and VisitorBurst limit the requests
+	// accepted from a single visitor IP address.
+	VisitorRequestsPerSecond float64 `toml:"visitor_requests_per_second"`
+	VisitorBurst             int     `toml:"visitor_burst"`
+	// MaxConcurrentRequests is the number of requests each member of a
+	// tunnel handles at the same time.
+	MaxConcurrentRequests int `toml:"max_concurrent_requests"`
+}
+
+func (r RateLimit) Validate() error {
+	if r.RequestsPerSecond < 0 || r.VisitorRequestsPerSecond < 0 {
+		return fmt.Errorf("requests per second may not be negative")
+	}
+	if r.Burst < 0 || r.VisitorBurst < 0 {
+		return fmt.Errorf("burst may not be negative")
+	}
+	if r.MaxConcurrentRequests < 0 {
+		return fmt.Errorf("max_concurrent_requests may not be negative")
+	}
+	return nil
+}
+
+// Apply returns opts with the limits of the server applied. Limits set by
+// the owner of a tunnel are only kept if they are stricter.
+func (r RateLimit) Apply(opts params.TunnelOptions) params.TunnelOptions {
+	opts.RateLimit = opts.RateLimit.Tighten(params.RateLimit{
+		Rate:  r.RequestsPerSecond,
+		Burst: r.Burst,
+	})
+	opts.VisitorRateLimit = opts.VisitorRateLimit.Tighten(params.RateLimit{
+		Rate:  r.VisitorRequestsPerSecond,
+		Burst: r.VisitorBurst,
+	})
+	if r.MaxConcurrentRequests > 0 && (opts.MaxConcurrent == 0 || r.MaxConcurrentRequests < opts.MaxConcurrent) {
+		opts.MaxConcurrent = r.MaxConcurrentRequests
+	}
+	return opts
+}
+
+// TCPTunnels configures raw TCP tunnels. When enabled, a remote
+// forward for any port other than 80 or 443 gets a public port
+// allocated from the configured range.
+type TCPTunnels struct {
+	Enabled        bool   `toml:"enabled"`
+	BindAddress    string `toml:"bind_address"`
+	PortRangeStart int    `toml:"port_range_start"`
+	PortRangeEnd   int    `toml:"port_range_end"`
+}
+
+func (t TCPTunnels) Validate() error {
+	if !t.Enabled {
+		return nil
+	}
+
+	if t.PortRangeStart > 65535 || t.PortRangeStart < 1 {
+		return fmt.Errorf("invalid port range start %d", t.PortRangeStart)
+	}
+
+	if t.PortRangeEnd > 65535 || t.PortRangeEnd < 1 {
+		return fmt.Errorf("invalid port range end %d", t.PortRangeEnd)
+	}
+
+	if t.PortRangeEnd < t.PortRangeStart {
+		return fmt.Errorf("port range end %d is lower than port range start %d", t.PortRangeEnd, t.PortRangeStart)
+	}
+
+	ip := net.ParseIP(t.BindAddress)
+	if ip == nil {
+		return fmt.Errorf("invalid IP address")
+	}
+	return nil
+}
+
+// InRange returns true if port is part of the configured port range.
+func (t TCPTunnels) InRange(port uint32) bool {
+	return port >= uint32(t.PortRangeStart) && port <= uint32(t.PortRangeEnd)
+}
+
+// Reconnect configures how HTTP tunnels survive a lost SSH connection.
+// During the grace period, the subdomain stays reserved for the key that
+// registered it, and visitors are held until the owner reconnects.
+type Reconnect struct {
+	// GracePeriod is how long the subdomain of a tunnel whose connection
+	// was lost is kept for its owner. Zero disables it.
+	GracePeriod time.Duration `toml:"grace_period"`
+	// MaxHeldRequests is the number of requests held for each tunnel
+	// while its owner reconnects. Defaults to DefaultMaxHeldRequests.
+	MaxHeldRequests int `toml:"max_held_requests"`
+	// HoldTimeout is how long a request is held before it fails.
+	// Defaults to GracePeriod.
+	HoldTimeout time.Duration `toml:"hold_timeout"`
+}
+
+func (r Reconnect) Validate() error {
+	if r.GracePeriod < 0 || r.HoldTimeout < 0 {
+		return fmt.Errorf("durations may not be negative")
+	}
+	if r.MaxHeldRequests < 0 {
+		return fmt.Errorf("max_held_requests may not be negative")
+	}
+	return nil
+}
+
+// MaxHeld returns the number of requests held for each tunnel.
+func (r Reconnect) MaxHeld() int {
+	if r.MaxHeldRequests > 0 {
+		return r.MaxHeldRequests
+	}
+	return DefaultMaxHeldRequests
+}
+
+// RequestTimeout returns how long a request is held.
+func (r Reconnect) RequestTimeout() time.Duration {
+	if r.HoldTimeout > 0 {
+		return r.HoldTimeout
+	}
+	return r.GracePeriod
+}
+
+// CertificateFiles is the path of a certificate and its key.
+type CertificateFiles struct {
+	CRT string `toml:"certificate" json:"certificate"`
+	Key string `toml:"key" json:"key"`
+}
+
 type TLSConfig struct {
+	// CRT and Key are the default certificate, served to clients that
+	// no other certificate is valid for.
 	CRT string `toml:"certificate" json:"certificate"`
 	Key string `toml:"key" json:"key"`
+	// Certificates are additional certificates, chosen by the server
+	// name the client asks for.
+	Certificates []CertificateFiles `toml:"certificates" json:"certificates"`
+	// CertificatesDir is scanned for additional certificates, stored as
+	// <name>.crt and <name>.key.
+	CertificatesDir string `toml:"certificates_dir" json:"certificates-dir"`
+	// ExpiryWarning is how long before they expire a warning is logged
+	// about certificates. Defaults to DefaultCertificateExpiryWarning.
+	ExpiryWarning time.Duration `toml:"expiry_warning" json:"expiry-warning"`
+}
+
+// HasCertificates returns true if any certificate is configured.
+func (t *TLSConfig) HasCertificates() bool {
+	return t.CRT != "" || t.Key != "" || len(t.Certificates) > 0 || t.CertificatesDir != ""
 }
 
 // Validate validates the TLS config
 func (t *TLSConfig) Validate() error {
-	if t.CRT == "" || t.Key == "" {
+	// Without a default certificate, the first of the other
+	// certificates is the default one.
+	if !t.HasCertificates() || (t.CRT == "") != (t.Key == "") {
 		return fmt.Errorf("missing crt or key")
 	}
 
-	_, err := tls.LoadX509KeyPair(t.CRT, t.Key)
+	if t.ExpiryWarning < 0 {
+		return fmt.Errorf("expiry_warning may not be negative")
+	}
+
+	certs, err := t.LoadCertificates()
 	if err != nil {
 		return err
 	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificates found in %s", t.CertificatesDir)
+	}
 	return nil
 }
 
+// ExpiryWarningWindow returns how long before they expire a warning is
+// logged about certificates.
+func (t *TLSConfig) ExpiryWarningWindow() time.Duration {
+	if t.ExpiryWarning > 0 {
+		return t.ExpiryWarning
+	}
+	return DefaultCertificateExpiryWarning
+}
+
+// LoadCertificates loads the default certificate, followed by the other
+// certificates and the ones found in CertificatesDir, sorted by name.
+func (t *TLSConfig) LoadCertificates() ([]tls.Certificate, error) {
+	files := []CertificateFiles{}
+	if t.CRT != "" || t.Key != "" {
+		files = append(files, CertificateFiles{CRT: t.CRT, Key: t.Key})
+	}
+	files = append(files, t.Certificates...)
+
+	if t.CertificatesDir != "" {
+		crtFiles, err := filepath.Glob(filepath.Join(t.CertificatesDir, "*.crt"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan certificates dir: %w", err)
+		}
+		// Glob returns the files sorted by name.
+		for _, crtFile := range crtFiles {
+			files = append(files, CertificateFiles{
+				CRT: crtFile,
+				Key: strings.TrimSuffix(crtFile, ".crt") + ".key",
+			})
+		}
+	}
+
+	certs := make([]tls.Certificate, 0, len(files))
+	for _, file := range files {
+		if file.CRT == "" || file.Key == "" {
+			return nil, fmt.Errorf("missing crt or key")
+		}
+		cert, err := tls.LoadX509KeyPair(file.CRT, file.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", file.CRT, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
 type Database struct {
 	DBFile      string `toml:"db_file"`
 	Debug       bool   `toml:"debug"`
@@ -196,8 +603,20 @@ func (d *Database) GormParams() (string, error) {
 }
 
 type Config struct {
-	SSHServer   SSHServer   `toml:"ssh_server"`
-	HTTPServer  HTTPServer  `toml:"http_server"`
+	SSHServer  SSHServer  `toml:"ssh_server"`
+	HTTPServer HTTPServer `toml:"http_server"`
+	TCPTunnels TCPTunnels `toml:"tcp_tunnels"`
+	// VisitorFilter restricts the visitors of all tunnels.
+	VisitorFilter VisitorFilter `toml:"visitor_filter"`
+	// Bandwidth shapes and limits the traffic of tunnels.
+	Bandwidth Bandwidth `toml:"bandwidth"`
+	// Reconnect keeps HTTP tunnels around while their owner reconnects.
+	Reconnect Reconnect `toml:"reconnect"`
+	// CustomDomains allows tunnels to use hostnames outside of
+	// domain_name.
+	CustomDomains CustomDomains `toml:"custom_domains"`
+	// AccessLog writes the requests proxied to tunnels to log files.
+	AccessLog   AccessLog   `toml:"access_log"`
 	DebugServer DebugServer `toml:"debug_server"`
 	Database    Database    `toml:"database"`
 }
@@ -211,14 +630,90 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("failed to validate http server config: %w", err)
 	}
 
+	if err := c.TCPTunnels.Validate(); err != nil {
+		return fmt.Errorf("failed to validate tcp tunnels config: %w", err)
+	}
+
 	if err := c.DebugServer.Validate(); err != nil {
 		return fmt.Errorf("failed to validate debug server config: %w", err)
 	}
+
+	if err := c.VisitorFilter.Validate(); err != nil {
+		return fmt.Errorf("failed to validate visitor filter config: %w", err)
+	}
+
+	if err := c.Reconnect.Validate(); err != nil {
+		return fmt.Errorf("failed to validate reconnect config: %w", err)
+	}
+
+	if err := c.CustomDomains.Validate(); err != nil {
+		return fmt.Errorf("failed to validate custom domains config: %w", err)
+	}
+
+	if err := c.AccessLog.Validate(); err != nil {
+		return fmt.Errorf("failed to validate access log config: %w", err)
+	}
+
+	if (len(c.VisitorFilter.AllowCountries) > 0 || len(c.VisitorFilter.DenyCountries) > 0) && c.Database.GeoIPDBFile == "" {
+		return fmt.Errorf("filtering visitors by country requires geoip_db_file to be set")
+	}
 	return nil
 }
 
-func (c SSHServer) authorizedKeysMap() map[string]bool {
-	authorizedKeysMap := map[string]bool{}
+// Reloadable returns a copy of newCfg in which the settings that can not
+// be changed without a restart are kept from c, along with the names of
+// the settings that differ and were not applied.
+func (c *Config) Reloadable(newCfg *Config) (*Config, []string) {
+	ret := *newCfg
+	var needRestart []string
+
+	if ret.SSHServer.BindAddress != c.SSHServer.BindAddress || ret.SSHServer.BindPort != c.SSHServer.BindPort {
+		needRestart = append(needRestart, "ssh_server.bind_address", "ssh_server.bind_port")
+		ret.SSHServer.BindAddress = c.SSHServer.BindAddress
+		ret.SSHServer.BindPort = c.SSHServer.BindPort
+	}
+
+	if ret.HTTPServer.BindAddr != c.HTTPServer.BindAddr || ret.HTTPServer.BindPort != c.HTTPServer.BindPort {
+		needRestart = append(needRestart, "http_server.bind_address", "http_server.bind_port")
+		ret.HTTPServer.BindAddr = c.HTTPServer.BindAddr
+		ret.HTTPServer.BindPort = c.HTTPServer.BindPort
+	}
+
+	if ret.HTTPServer.UseTLS != c.HTTPServer.UseTLS || ret.HTTPServer.TLSBindPort != c.HTTPServer.TLSBindPort {
+		needRestart = append(needRestart, "http_server.use_tls", "http_server.tls_bind_port")
+		ret.HTTPServer.UseTLS = c.HTTPServer.UseTLS
+		ret.HTTPServer.TLSBindPort = c.HTTPServer.TLSBindPort
+		ret.HTTPServer.TLSConfig = c.HTTPServer.TLSConfig
+	}
+
+	if ret.HTTPServer.ACME != c.HTTPServer.ACME {
+		needRestart = append(needRestart, "http_server.acme")
+		ret.HTTPServer.ACME = c.HTTPServer.ACME
+	}
+
+	if ret.HTTPServer.DomainName != c.HTTPServer.DomainName {
+		// Tunnels that are already registered use the old domain name.
+		needRestart = append(needRestart, "http_server.domain_name")
+		ret.HTTPServer.DomainName = c.HTTPServer.DomainName
+	}
+
+	if ret.DebugServer != c.DebugServer {
+		needRestart = append(needRestart, "debug_server")
+		ret.DebugServer = c.DebugServer
+	}
+
+	if ret.Database != c.Database {
+		needRestart = append(needRestart, "database")
+		ret.Database = c.Database
+	}
+
+	return &ret, needRestart
+}
+
+// authorizedKeysMap returns the authorized keys, mapped to the options
+// set for each of them.
+func (c SSHServer) authorizedKeysMap() map[string][]string {
+	authorizedKeysMap := map[string][]string{}
 	if c.AuthorizedKeysPath == "" {
 		return authorizedKeysMap
 	}
@@ -229,12 +724,12 @@ func (c SSHServer) authorizedKeysMap() map[string]bool {
 	}
 
 	for len(authorizedKeysBytes) > 0 {
-		pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(authorizedKeysBytes)
+		pubKey, _, options, rest, err := ssh.ParseAuthorizedKey(authorizedKeysBytes)
 		if err != nil {
 			return authorizedKeysMap
 		}
 
-		authorizedKeysMap[string(pubKey.Marshal())] = true
+		authorizedKeysMap[string(pubKey.Marshal())] = options
 		authorizedKeysBytes = rest
 	}
 	return authorizedKeysMap
@@ -253,18 +748,42 @@ func (c SSHServer) SSHServerConfig(passwdCallback PasswordAuthCallback) (*ssh.Se
 
 	if !c.DisableAuth {
 		cfg.PublicKeyCallback = func(meta ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-			authorizedKeysMap := c.authorizedKeysMap()
-			if authorizedKeysMap[string(pubKey.Marshal())] {
+			if cert, ok := pubKey.(*ssh.Certificate); ok {
+				extensions, err := c.certificateExtensions(meta, cert)
+				if err != nil {
+					log.Printf("rejecting certificate %q for %q: %s", cert.KeyId, meta.User(), err)
+					return nil, fmt.Errorf("certificate not allowed for %q", meta.User())
+				}
+				log.Printf("accepted certificate %q (serial %d) for %q, signed by CA %s",
+					cert.KeyId, cert.Serial, meta.User(), ssh.FingerprintSHA256(cert.SignatureKey))
+				// Record the key the certificate was issued for, so the
+				// fingerprint stays the same when the certificate is renewed.
+				extensions["pubkey-fp"] = ssh.FingerprintSHA256(cert.Key)
+				extensions["username"] = meta.User()
+				extensions["ip"] = meta.RemoteAddr().String()
 				return &ssh.Permissions{
-					// Record the public key used for authentication.
-					Extensions: map[string]string{
-						"pubkey-fp": ssh.FingerprintSHA256(pubKey),
-						"username":  meta.User(),
-						"ip":        meta.RemoteAddr().String(),
-					},
+					Extensions: extensions,
 				}, nil
 			}
-			return nil, fmt.Errorf("unknown public key for %q", meta.User())
+
+			authorizedKeysMap := c.authorizedKeysMap()
+			options, ok := authorizedKeysMap[string(pubKey.Marshal())]
+			if !ok {
+				return nil, fmt.Errorf("unknown public key for %q", meta.User())
+			}
+
+			extensions, err := keyOptionsExtensions(options, meta.RemoteAddr(), time.Now())
+			if err != nil {
+				log.Printf("rejecting key %s for %q: %s", ssh.FingerprintSHA256(pubKey), meta.User(), err)
+				return nil, fmt.Errorf("key not allowed for %q", meta.User())
+			}
+			// Record the public key used for authentication.
+			extensions["pubkey-fp"] = ssh.FingerprintSHA256(pubKey)
+			extensions["username"] = meta.User()
+			extensions["ip"] = meta.RemoteAddr().String()
+			return &ssh.Permissions{
+				Extensions: extensions,
+			}, nil
 		}
 	}
 
@@ -0,0 +1,114 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CustomDomains allows tunnels to be served on hostnames outside of the
+// domain of the server, once their owner proves they control them.
+type CustomDomains struct {
+	Enabled bool `toml:"enabled"`
+	// CertificatesDir holds the certificates of custom domains, as
+	// <hostname>.crt and <hostname>.key. Visitors of custom domains
+	// without a certificate get the certificate of the server.
+	CertificatesDir string `toml:"certificates_dir"`
+	// DNSResolver is the address (host:port) of the DNS server used to
+	// verify custom domains. Defaults to the resolver of the system.
+	DNSResolver string `toml:"dns_resolver"`
+}
+
+func (c CustomDomains) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if c.CertificatesDir != "" {
+		info, err := os.Stat(c.CertificatesDir)
+		if err != nil {
+			return fmt.Errorf("failed to access certificates dir: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("certificates dir %s is not a directory", c.CertificatesDir)
+		}
+	}
+
+	if c.DNSResolver != "" {
+		if _, _, err := net.SplitHostPort(c.DNSResolver); err != nil {
+			return fmt.Errorf("invalid dns resolver %q, expected host:port", c.DNSResolver)
+		}
+	}
+	return nil
+}
+
+// Resolver returns the resolver used to verify custom domains.
+func (c CustomDomains) Resolver() *net.Resolver {
+	if c.DNSResolver == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, c.DNSResolver)
+		},
+	}
+}
+
+// CertificatePaths returns the paths of the certificate and key of
+// hostname. It returns false if no certificates dir is configured.
+func (c CustomDomains) CertificatePaths(hostname string) (string, string, bool) {
+	if c.CertificatesDir == "" {
+		return "", "", false
+	}
+	return filepath.Join(c.CertificatesDir, hostname+".crt"), filepath.Join(c.CertificatesDir, hostname+".key"), true
+}
+
+// IsOwnDomain returns true if hostname is the domain of the server, or one
+// of its subdomains. These can not be registered as custom domains.
+func (a *HTTPServer) IsOwnDomain(hostname string) bool {
+	return hostname == a.DomainName || strings.HasSuffix(hostname, "."+a.DomainName)
+}
+
+// ParseHostname validates a fully qualified hostname and returns it in
+// lower case, without a trailing dot.
+func ParseHostname(val string) (string, error) {
+	hostname := strings.TrimSuffix(strings.ToLower(val), ".")
+	if len(hostname) == 0 || len(hostname) > 253 {
+		return "", fmt.Errorf("invalid hostname %q", val)
+	}
+
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 2 {
+		return "", fmt.Errorf("hostname %q is not fully qualified", val)
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", fmt.Errorf("invalid hostname %q", val)
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return "", fmt.Errorf("invalid hostname %q", val)
+			}
+		}
+	}
+	return hostname, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// ProxyProtocol configures the parsing of the PROXY protocol header sent by
+// load balancers in front of a listener.
+type ProxyProtocol struct {
+	Enabled bool `toml:"enabled" json:"enabled"`
+	// TrustedSources are the networks of the load balancers, in CIDR
+	// notation or as single IP addresses. Connections from them must
+	// start with a PROXY protocol header. Connections from anywhere else
+	// are used as they are.
+	TrustedSources []string `toml:"trusted_sources" json:"trusted-sources"`
+}
+
+func (p ProxyProtocol) Validate() error {
+	if !p.Enabled {
+		return nil
+	}
+	if len(p.TrustedSources) == 0 {
+		return fmt.Errorf("trusted_sources is required")
+	}
+	for _, val := range p.TrustedSources {
+		if _, err := ParseNetwork(val); err != nil {
+			return fmt.Errorf("invalid network %q in trusted_sources", val)
+		}
+	}
+	return nil
+}
+
+// Trusted returns true if the PROXY protocol header must be read from
+// connections coming from addr.
+func (p ProxyProtocol) Trusted(addr net.Addr) bool {
+	if !p.Enabled {
+		return false
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, val := range p.TrustedSources {
+		prefix, err := ParseNetwork(val)
+		if err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
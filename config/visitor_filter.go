@@ -0,0 +1,101 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+// ParseNetwork parses a network in CIDR notation, or a single IP address.
+func ParseNetwork(val string) (netip.Prefix, error) {
+	if strings.Contains(val, "/") {
+		prefix, err := netip.ParsePrefix(val)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(val)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ParseCountryCode validates an ISO 3166-1 alpha-2 country code and
+// returns it in upper case.
+func ParseCountryCode(val string) (string, error) {
+	code := strings.ToUpper(strings.TrimSpace(val))
+	if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+		return "", fmt.Errorf("invalid country code %q", val)
+	}
+	return code, nil
+}
+
+// VisitorFilter is the server wide policy restricting the visitors of all
+// tunnels by IP address and by country. It applies in addition to the
+// filters set by the owners of tunnels.
+type VisitorFilter struct {
+	AllowCIDRs []string `toml:"allow_cidrs"`
+	DenyCIDRs  []string `toml:"deny_cidrs"`
+	// AllowCountries and DenyCountries hold ISO 3166-1 alpha-2 country
+	// codes. They require a GeoIP database to be configured.
+	AllowCountries []string `toml:"allow_countries"`
+	DenyCountries  []string `toml:"deny_countries"`
+}
+
+func (v VisitorFilter) Validate() error {
+	_, err := v.Filter()
+	return err
+}
+
+// Filter returns the parsed filter.
+func (v VisitorFilter) Filter() (params.VisitorFilter, error) {
+	var filter params.VisitorFilter
+	for _, val := range v.AllowCIDRs {
+		prefix, err := ParseNetwork(val)
+		if err != nil {
+			return filter, fmt.Errorf("invalid network %q in allow_cidrs", val)
+		}
+		filter.AllowedCIDRs = append(filter.AllowedCIDRs, prefix)
+	}
+	for _, val := range v.DenyCIDRs {
+		prefix, err := ParseNetwork(val)
+		if err != nil {
+			return filter, fmt.Errorf("invalid network %q in deny_cidrs", val)
+		}
+		filter.DeniedCIDRs = append(filter.DeniedCIDRs, prefix)
+	}
+	for _, val := range v.AllowCountries {
+		code, err := ParseCountryCode(val)
+		if err != nil {
+			return filter, err
+		}
+		filter.AllowedCountries = append(filter.AllowedCountries, code)
+	}
+	for _, val := range v.DenyCountries {
+		code, err := ParseCountryCode(val)
+		if err != nil {
+			return filter, err
+		}
+		filter.DeniedCountries = append(filter.DeniedCountries, code)
+	}
+	return filter, nil
+}
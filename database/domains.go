@@ -0,0 +1,143 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/gabriel-samfira/localshow/config"
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+// ErrCustomDomainNotFound is returned when a hostname is not registered as
+// a custom domain.
+var ErrCustomDomainNotFound = errors.New("custom domain not found")
+
+// CustomDomainClaimExpiry is how long a custom domain registered by a key,
+// but not verified, is kept from other keys.
+const CustomDomainClaimExpiry = 72 * time.Hour
+
+func customDomainToParams(row CustomDomain) params.CustomDomain {
+	return params.CustomDomain{
+		Hostname:    row.Hostname,
+		Fingerprint: row.Fingerprint,
+		Token:       row.Token,
+		VerifiedAt:  row.VerifiedAt,
+	}
+}
+
+// AddCustomDomain registers hostname for the key identified by fingerprint
+// and returns it, along with the token used to verify it. If verified is
+// set, the hostname can be used right away. A hostname that another key
+// registered, but did not verify within CustomDomainClaimExpiry, is taken
+// over.
+func (s *SQLDatabase) AddCustomDomain(hostname, fingerprint string, verified bool) (params.CustomDomain, error) {
+	hostname, err := config.ParseHostname(hostname)
+	if err != nil {
+		return params.CustomDomain{}, err
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return params.CustomDomain{}, fmt.Errorf("failed to generate token: %w", err)
+	}
+	row := CustomDomain{
+		Hostname:    hostname,
+		Fingerprint: fingerprint,
+		Token:       hex.EncodeToString(token),
+	}
+	if verified {
+		now := time.Now().UTC()
+		row.VerifiedAt = &now
+	}
+
+	err = s.conn.Transaction(func(tx *gorm.DB) error {
+		var existing CustomDomain
+		err := tx.Where("hostname = ?", hostname).First(&existing).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+		case err != nil:
+			return err
+		case existing.VerifiedAt != nil || existing.Fingerprint == fingerprint:
+			return fmt.Errorf("custom domain %q is already registered", hostname)
+		case time.Since(existing.CreatedAt) < CustomDomainClaimExpiry:
+			return fmt.Errorf("custom domain %q is pending verification by another key", hostname)
+		default:
+			// Expired claims of other keys do not keep the owner of
+			// the hostname from registering it.
+			if err := tx.Unscoped().Delete(&existing).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(&row).Error
+	})
+	if err != nil {
+		return params.CustomDomain{}, err
+	}
+	return customDomainToParams(row), nil
+}
+
+// GetCustomDomain returns the custom domain registered for hostname.
+func (s *SQLDatabase) GetCustomDomain(hostname string) (params.CustomDomain, error) {
+	var row CustomDomain
+	if err := s.conn.Where("hostname = ?", hostname).First(&row).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return params.CustomDomain{}, ErrCustomDomainNotFound
+		}
+		return params.CustomDomain{}, err
+	}
+	return customDomainToParams(row), nil
+}
+
+// ListCustomDomains returns the custom domains owned by the key identified
+// by fingerprint, or all custom domains if fingerprint is empty.
+func (s *SQLDatabase) ListCustomDomains(fingerprint string) ([]params.CustomDomain, error) {
+	q := s.conn.Order("hostname")
+	if fingerprint != "" {
+		q = q.Where("fingerprint = ?", fingerprint)
+	}
+	var rows []CustomDomain
+	if err := q.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	ret := make([]params.CustomDomain, 0, len(rows))
+	for _, row := range rows {
+		ret = append(ret, customDomainToParams(row))
+	}
+	return ret, nil
+}
+
+// MarkCustomDomainVerified records that the ownership of hostname was
+// verified.
+func (s *SQLDatabase) MarkCustomDomainVerified(hostname string) error {
+	res := s.conn.Model(&CustomDomain{}).Where("hostname = ?", hostname).Update("verified_at", time.Now().UTC())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrCustomDomainNotFound
+	}
+	return nil
+}
+
+// RemoveCustomDomain removes hostname. If fingerprint is not empty, only
+// the key it identifies may remove it.
+func (s *SQLDatabase) RemoveCustomDomain(hostname, fingerprint string) error {
+	q := s.conn.Unscoped().Where("hostname = ?", hostname)
+	if fingerprint != "" {
+		q = q.Where("fingerprint = ?", fingerprint)
+	}
+	res := q.Delete(&CustomDomain{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrCustomDomainNotFound
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"fmt"
 	"net"
+	"net/netip"
 
 	"github.com/oschwald/geoip2-golang"
 )
@@ -30,3 +31,13 @@ func (g *geoIP) GetRecord(ip string) (*geoip2.City, error) {
 	}
 	return g.conn.City(net.ParseIP(ip))
 }
+
+// CountryCode returns the ISO 3166-1 alpha-2 code of the country ip is
+// located in.
+func (g *geoIP) CountryCode(ip netip.Addr) (string, error) {
+	record, err := g.conn.Country(net.IP(ip.Unmap().AsSlice()))
+	if err != nil {
+		return "", fmt.Errorf("looking up %s: %w", ip, err)
+	}
+	return record.Country.IsoCode, nil
+}
@@ -28,3 +28,46 @@ type RemoteAddress struct {
 	Country  string `gorm:"index:remote_country"`
 	City     string `gorm:"index:remote_city"`
 }
+
+// Reservation ties a subdomain, or a wildcard pattern matching subdomains,
+// to the fingerprint of a public key. A pattern may have multiple rows, one
+// for each key allowed to use it.
+type Reservation struct {
+	Base
+
+	Pattern     string `gorm:"uniqueIndex:reservation_pattern_fingerprint"`
+	Fingerprint string `gorm:"uniqueIndex:reservation_pattern_fingerprint"`
+}
+
+// TransferUsage is the traffic of the tunnels of a key during a calendar
+// month (UTC), in the form 2006-01. BytesIn is the traffic sent by
+// visitors, and BytesOut the traffic sent back to them.
+type TransferUsage struct {
+	Base
+
+	Fingerprint string `gorm:"uniqueIndex:transfer_usage_fingerprint_month"`
+	Month       string `gorm:"uniqueIndex:transfer_usage_fingerprint_month"`
+	BytesIn     int64
+	BytesOut    int64
+}
+
+// TransferQuota overrides the default monthly transfer quota of a key. A
+// zero quota means the traffic of the key is not limited.
+type TransferQuota struct {
+	Base
+
+	Fingerprint  string `gorm:"uniqueIndex:transfer_quota_fingerprint"`
+	MonthlyBytes int64
+}
+
+// CustomDomain is a hostname outside of the domain of the server, owned by
+// the key identified by Fingerprint. VerifiedAt is set once the owner
+// proved they control the hostname by publishing Token.
+type CustomDomain struct {
+	Base
+
+	Hostname    string `gorm:"uniqueIndex:custom_domain_hostname"`
+	Fingerprint string `gorm:"index:custom_domain_fingerprint"`
+	Token       string
+	VerifiedAt  *time.Time
+}
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+// ValidateReservationPattern checks that pattern is a subdomain, optionally
+// containing the wildcards supported by path.Match (* and ?).
+func ValidateReservationPattern(pattern string) error {
+	if len(pattern) == 0 || len(pattern) > 63 {
+		return fmt.Errorf("invalid pattern length")
+	}
+	for _, c := range pattern {
+		switch {
+		case c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9':
+		case c == '-', c == '*', c == '?':
+		default:
+			return fmt.Errorf("invalid character %q in pattern", c)
+		}
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern: %w", err)
+	}
+	return nil
+}
+
+func reservationsToParams(rows []Reservation) []params.Reservation {
+	byPattern := map[string]*params.Reservation{}
+	var patterns []string
+	for _, row := range rows {
+		res, ok := byPattern[row.Pattern]
+		if !ok {
+			res = &params.Reservation{Pattern: row.Pattern}
+			byPattern[row.Pattern] = res
+			patterns = append(patterns, row.Pattern)
+		}
+		res.Fingerprints = append(res.Fingerprints, row.Fingerprint)
+	}
+	sort.Strings(patterns)
+
+	ret := make([]params.Reservation, 0, len(patterns))
+	for _, pattern := range patterns {
+		ret = append(ret, *byPattern[pattern])
+	}
+	return ret
+}
+
+// AddReservation allows the keys identified by fingerprints to use the
+// subdomains matching pattern. Keys already allowed are ignored.
+func (s *SQLDatabase) AddReservation(pattern string, fingerprints []string) error {
+	pattern = strings.ToLower(pattern)
+	if err := ValidateReservationPattern(pattern); err != nil {
+		return err
+	}
+	if len(fingerprints) == 0 {
+		return fmt.Errorf("at least one fingerprint is required")
+	}
+
+	err := s.conn.Transaction(func(tx *gorm.DB) error {
+		for _, fp := range fingerprints {
+			if !strings.HasPrefix(fp, "SHA256:") {
+				return fmt.Errorf("invalid fingerprint %q", fp)
+			}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Reservation{
+				Pattern:     pattern,
+				Fingerprint: fp,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// RemoveReservation removes the keys identified by fingerprints from the
+// reservation for pattern. If no fingerprints are given, the whole
+// reservation is removed.
+func (s *SQLDatabase) RemoveReservation(pattern string, fingerprints []string) error {
+	q := s.conn.Unscoped().Where("pattern = ?", strings.ToLower(pattern))
+	if len(fingerprints) > 0 {
+		q = q.Where("fingerprint IN ?", fingerprints)
+	}
+	res := q.Delete(&Reservation{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("reservation for %q not found", pattern)
+	}
+	return nil
+}
+
+func (s *SQLDatabase) ListReservations() ([]params.Reservation, error) {
+	var rows []Reservation
+	if err := s.conn.Order("pattern, fingerprint").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return reservationsToParams(rows), nil
+}
+
+// GetReservationsForSubdomain returns the reservations that apply to
+// subdomain. A reservation for the exact subdomain takes precedence over
+// wildcard patterns. If none exists, all matching wildcard patterns are
+// returned.
+func (s *SQLDatabase) GetReservationsForSubdomain(subdomain string) ([]params.Reservation, error) {
+	// Patterns only hold the * and ? wildcards, which GLOB matches the
+	// same way as path.Match. Patterns without wildcards only match the
+	// exact subdomain.
+	var rows []Reservation
+	if err := s.conn.Where("? GLOB pattern", subdomain).Order("pattern, fingerprint").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	var exact, wildcard []Reservation
+	for _, row := range rows {
+		if row.Pattern == subdomain {
+			exact = append(exact, row)
+		} else {
+			wildcard = append(wildcard, row)
+		}
+	}
+	if len(exact) > 0 {
+		return reservationsToParams(exact), nil
+	}
+	return reservationsToParams(wildcard), nil
+}
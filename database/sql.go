@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"os"
 	"time"
 
@@ -84,6 +85,10 @@ func (s *SQLDatabase) migrateDB() error {
 	if err := s.conn.AutoMigrate(
 		&AuthAttempt{},
 		&RemoteAddress{},
+		&Reservation{},
+		&TransferUsage{},
+		&TransferQuota{},
+		&CustomDomain{},
 	); err != nil {
 		return fmt.Errorf("running auto migrate: %w", err)
 	}
@@ -276,3 +281,17 @@ func (s *SQLDatabase) ImportFromCSV(csvFile string) error {
 	})
 	return err
 }
+
+// CountryCode returns the ISO 3166-1 alpha-2 code of the country ip is
+// located in. It returns an error if no GeoIP database is configured.
+func (s *SQLDatabase) CountryCode(ip netip.Addr) (string, error) {
+	if s.geoIP == nil {
+		return "", fmt.Errorf("no geoip database configured")
+	}
+	return s.geoIP.CountryCode(ip)
+}
+
+// HasGeoIP returns true if a GeoIP database is configured.
+func (s *SQLDatabase) HasGeoIP() bool {
+	return s.geoIP != nil
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+func transferUsageToParams(row TransferUsage) params.TransferUsage {
+	return params.TransferUsage{
+		Fingerprint: row.Fingerprint,
+		Month:       row.Month,
+		BytesIn:     row.BytesIn,
+		BytesOut:    row.BytesOut,
+	}
+}
+
+// AddTransferUsage adds traffic to the usage of the key identified by
+// fingerprint during month.
+func (s *SQLDatabase) AddTransferUsage(fingerprint, month string, bytesIn, bytesOut int64) error {
+	return s.conn.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "fingerprint"}, {Name: "month"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"bytes_in":   gorm.Expr("bytes_in + ?", bytesIn),
+			"bytes_out":  gorm.Expr("bytes_out + ?", bytesOut),
+			"updated_at": time.Now(),
+		}),
+	}).Create(&TransferUsage{
+		Fingerprint: fingerprint,
+		Month:       month,
+		BytesIn:     bytesIn,
+		BytesOut:    bytesOut,
+	}).Error
+}
+
+// GetTransferUsage returns the traffic of the key identified by fingerprint
+// during month.
+func (s *SQLDatabase) GetTransferUsage(fingerprint, month string) (params.TransferUsage, error) {
+	var row TransferUsage
+	if err := s.conn.Where("fingerprint = ? AND month = ?", fingerprint, month).First(&row).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return params.TransferUsage{Fingerprint: fingerprint, Month: month}, nil
+		}
+		return params.TransferUsage{}, err
+	}
+	return transferUsageToParams(row), nil
+}
+
+// ListTransferUsage returns the traffic of all keys during month.
+func (s *SQLDatabase) ListTransferUsage(month string) ([]params.TransferUsage, error) {
+	var rows []TransferUsage
+	if err := s.conn.Where("month = ?", month).Order("fingerprint").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	ret := make([]params.TransferUsage, len(rows))
+	for idx, row := range rows {
+		ret[idx] = transferUsageToParams(row)
+	}
+	return ret, nil
+}
+
+// SetTransferQuota sets the monthly transfer quota of the key identified
+// by fingerprint, overriding the default quota. A zero quota means the
+// traffic of the key is not limited.
+func (s *SQLDatabase) SetTransferQuota(fingerprint string, monthlyBytes int64) error {
+	if !strings.HasPrefix(fingerprint, "SHA256:") {
+		return fmt.Errorf("invalid fingerprint %q", fingerprint)
+	}
+	if monthlyBytes < 0 {
+		return fmt.Errorf("quota may not be negative")
+	}
+
+	return s.conn.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "fingerprint"}},
+		DoUpdates: clause.AssignmentColumns([]string{"monthly_bytes", "updated_at"}),
+	}).Create(&TransferQuota{
+		Fingerprint:  fingerprint,
+		MonthlyBytes: monthlyBytes,
+	}).Error
+}
+
+// RemoveTransferQuota removes the quota set for the key identified by
+// fingerprint. The key falls back to the default quota.
+func (s *SQLDatabase) RemoveTransferQuota(fingerprint string) error {
+	res := s.conn.Unscoped().Where("fingerprint = ?", fingerprint).Delete(&TransferQuota{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("quota for %q not found", fingerprint)
+	}
+	return nil
+}
+
+// GetTransferQuota returns the quota set for the key identified by
+// fingerprint. It returns false if the key uses the default quota.
+func (s *SQLDatabase) GetTransferQuota(fingerprint string) (int64, bool, error) {
+	var row TransferQuota
+	if err := s.conn.Where("fingerprint = ?", fingerprint).First(&row).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return row.MonthlyBytes, true, nil
+}
+
+func (s *SQLDatabase) ListTransferQuotas() ([]params.TransferQuota, error) {
+	var rows []TransferQuota
+	if err := s.conn.Order("fingerprint").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	ret := make([]params.TransferQuota, len(rows))
+	for idx, row := range rows {
+		ret[idx] = params.TransferQuota{
+			Fingerprint:  row.Fingerprint,
+			MonthlyBytes: row.MonthlyBytes,
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,354 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package httpsrv
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gabriel-samfira/localshow/config"
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+// recordingWriter records the response sent to a visitor, for the access
+// log, the log stream of inspected tunnels and the request capture.
+type recordingWriter struct {
+	http.ResponseWriter
+	start  time.Time
+	status int
+	bytes  int64
+	// upstream is the time the tunnel took to send the response headers.
+	upstream time.Duration
+	// header and body are only kept for captured requests, when body is
+	// set.
+	header http.Header
+	body   *limitedBuffer
+	// onHeader is called with the final status, before the headers are
+	// sent.
+	onHeader func(code int)
+}
+
+func newRecordingWriter(w http.ResponseWriter) *recordingWriter {
+	return &recordingWriter{
+		ResponseWriter: w,
+		start:          time.Now(),
+	}
+}
+
+func (r *recordingWriter) WriteHeader(code int) {
+	// Informational responses are followed by the final one, except
+	// for protocol upgrades.
+	if r.status == 0 && (code >= http.StatusOK || code == http.StatusSwitchingProtocols) {
+		r.status = code
+		r.upstream = time.Since(r.start)
+		if r.body != nil {
+			r.header = r.Header().Clone()
+		}
+		if r.onHeader != nil {
+			r.onHeader(code)
+		}
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *recordingWriter) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.body != nil {
+		r.body.Write(b)
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer,
+// which is needed for flushing and protocol upgrades.
+func (r *recordingWriter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// countingBody counts the bytes of the request body read by the proxy.
+type countingBody struct {
+	io.ReadCloser
+	bytes atomic.Int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.bytes.Add(int64(n))
+	return n, err
+}
+
+// newAccessLogEntry describes the request r, once the response recorded
+// by rec was sent.
+func newAccessLogEntry(r *http.Request, rec *recordingWriter, body *countingBody) params.AccessLogEntry {
+	entry := params.AccessLogEntry{
+		Time:      rec.start.UTC(),
+		Host:      extractHostname(r.Host),
+		RemoteIP:  r.RemoteAddr,
+		Method:    r.Method,
+		URI:       r.URL.RequestURI(),
+		Proto:     r.Proto,
+		Status:    rec.status,
+		BytesOut:  rec.bytes,
+		Upstream:  rec.upstream,
+		Duration:  time.Since(rec.start),
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+	if ip := remoteIP(r.RemoteAddr); ip.IsValid() {
+		entry.RemoteIP = ip.String()
+	}
+	if r.TLS != nil {
+		entry.TLSVersion = tls.VersionName(r.TLS.Version)
+	}
+	if body != nil {
+		entry.BytesIn = body.bytes.Load()
+	}
+	if entry.Status == 0 {
+		// The proxy gave up before sending a response, because the
+		// visitor went away.
+		entry.Status = 499
+	}
+	return entry
+}
+
+const (
+	// accessLogQueueSize is the number of log lines waiting to be
+	// written. Lines are dropped while the queue is full, rather than
+	// holding up requests.
+	accessLogQueueSize = 4096
+	// maxOpenAccessLogs is the number of log files kept open. The least
+	// recently used file is closed to open another one.
+	maxOpenAccessLogs = 64
+	// accessLogIdleTimeout is how long a log file is kept open without
+	// being written to.
+	accessLogIdleTimeout = 5 * time.Minute
+)
+
+// accessLogLine is a formatted line of the log file of hostname.
+type accessLogLine struct {
+	hostname string
+	line     []byte
+}
+
+// accessLog writes the requests proxied to tunnels to a log file per
+// hostname, rotated once it grows over the configured size. Lines are
+// written by a single goroutine, off the path of the requests.
+type accessLog struct {
+	cfg *atomic.Pointer[config.Config]
+
+	lines   chan accessLogLine
+	dropped atomic.Int64
+	quit    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+
+	mux   sync.Mutex
+	files map[string]*logFile
+}
+
+func newAccessLog(cfg *atomic.Pointer[config.Config]) *accessLog {
+	a := &accessLog{
+		cfg:   cfg,
+		lines: make(chan accessLogLine, accessLogQueueSize),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+		files: map[string]*logFile{},
+	}
+	go a.loop()
+	return a
+}
+
+// write queues entry to be appended to the log file of hostname.
+func (a *accessLog) write(hostname string, entry params.AccessLogEntry) {
+	cfg := a.cfg.Load().AccessLog
+	if !cfg.Enabled {
+		return
+	}
+	if hostname == "" || filepath.Base(hostname) != hostname || hostname[0] == '.' {
+		return
+	}
+
+	select {
+	case a.lines <- accessLogLine{hostname: hostname, line: append(entry.Format(cfg.LogFormat()), '\n')}:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+func (a *accessLog) loop() {
+	defer close(a.done)
+	ticker := time.NewTicker(accessLogIdleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case line := <-a.lines:
+			a.writeLine(line)
+		case <-ticker.C:
+			a.closeIdle()
+			if dropped := a.dropped.Swap(0); dropped > 0 {
+				log.Printf("dropped %d access log lines, as the queue was full", dropped)
+			}
+		case <-a.quit:
+			// Write the lines queued before the server stopped.
+			for {
+				select {
+				case line := <-a.lines:
+					a.writeLine(line)
+				default:
+					a.close()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *accessLog) writeLine(line accessLogLine) {
+	cfg := a.cfg.Load().AccessLog
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	file, ok := a.files[line.hostname]
+	if !ok {
+		if len(a.files) >= maxOpenAccessLogs {
+			a.closeOldest()
+		}
+		file = &logFile{path: filepath.Join(cfg.Dir, line.hostname+".log")}
+		a.files[line.hostname] = file
+	}
+	file.lastWrite = time.Now()
+	if err := file.write(line.line, cfg.RotateSize(), cfg.Backups()); err != nil {
+		log.Printf("failed to write access log of %s: %s", line.hostname, err)
+	}
+}
+
+// closeOldest closes the least recently written log file. The caller must
+// hold a.mux.
+func (a *accessLog) closeOldest() {
+	var oldest string
+	for hostname, file := range a.files {
+		if oldest == "" || file.lastWrite.Before(a.files[oldest].lastWrite) {
+			oldest = hostname
+		}
+	}
+	if file, ok := a.files[oldest]; ok {
+		file.close()
+		delete(a.files, oldest)
+	}
+}
+
+// closeIdle closes the log files that were not written to recently.
+func (a *accessLog) closeIdle() {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for hostname, file := range a.files {
+		if time.Since(file.lastWrite) >= accessLogIdleTimeout {
+			file.close()
+			delete(a.files, hostname)
+		}
+	}
+}
+
+// close closes the log files. They are opened again by the next write,
+// using the current config.
+func (a *accessLog) close() {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for hostname, file := range a.files {
+		file.close()
+		delete(a.files, hostname)
+	}
+}
+
+// stop writes the queued lines and closes the log files. Lines written
+// after stop are discarded.
+func (a *accessLog) stop() {
+	a.once.Do(func() {
+		close(a.quit)
+	})
+	<-a.done
+}
+
+type logFile struct {
+	path      string
+	file      *os.File
+	size      int64
+	lastWrite time.Time
+}
+
+func (l *logFile) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+func (l *logFile) write(line []byte, maxSize int64, backups int) error {
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.size > 0 && l.size+int64(len(line)) > maxSize {
+		if err := l.rotate(backups); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotate renames the log file to <path>.1, shifting older files up to
+// <path>.<backups>, and opens a new one.
+func (l *logFile) rotate(backups int) error {
+	l.close()
+	os.Remove(fmt.Sprintf("%s.%d", l.path, backups))
+	for idx := backups - 1; idx > 0; idx-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, idx), fmt.Sprintf("%s.%d", l.path, idx+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	return l.open()
+}
+
+func (l *logFile) close() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
@@ -0,0 +1,565 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package httpsrv
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/gabriel-samfira/localshow/config"
+)
+
+const (
+	// acmeAccountKeyFile is the name of the file holding the key of the
+	// ACME account, in the cache dir.
+	acmeAccountKeyFile = "account.key"
+	// acmeRenewInterval is how often certificates are checked for
+	// renewal.
+	acmeRenewInterval = 12 * time.Hour
+	// acmeObtainTimeout is how long we wait for the CA to issue a
+	// certificate.
+	acmeObtainTimeout = 5 * time.Minute
+	// acmeChallengePathPrefix is the path of http-01 challenges.
+	acmeChallengePathPrefix = "/.well-known/acme-challenge/"
+	// acmeRetryBackoff is how long we wait before ordering a certificate
+	// again after an order failed. It doubles with each failure, up to
+	// acmeMaxRetryBackoff.
+	acmeRetryBackoff    = 5 * time.Minute
+	acmeMaxRetryBackoff = 12 * time.Hour
+)
+
+// errNoACMECertificate is returned for hostnames we do not obtain
+// certificates for.
+var errNoACMECertificate = errors.New("no acme certificate for hostname")
+
+// acmeManager obtains the certificates of the TLS listener from an ACME CA,
+// stores them in the cache dir and renews them before they expire. With the
+// dns-01 challenge, a single wildcard certificate covers the domain of the
+// server. Otherwise, a certificate is obtained for each hostname the first
+// time a visitor connects to it.
+type acmeManager struct {
+	cfg        config.ACME
+	domainName string
+	client     *acme.Client
+	ctx        context.Context
+	// allowed returns true if a certificate may be obtained for a
+	// hostname. It keeps visitors from making us request certificates
+	// for arbitrary names.
+	allowed func(hostname string) bool
+
+	regMux     sync.Mutex
+	registered bool
+
+	mux   sync.Mutex
+	certs map[string]*tls.Certificate
+	// pending is closed once the certificate being obtained for a name
+	// is available, or failed.
+	pending map[string]chan struct{}
+	// failures holds the names for which the last order failed. No new
+	// order is placed for them until the backoff has passed.
+	failures map[string]acmeFailure
+	// tokens holds the responses of http-01 challenges by path, and
+	// alpnCerts the certificates of tls-alpn-01 challenges by hostname.
+	tokens    map[string]string
+	alpnCerts map[string]*tls.Certificate
+}
+
+func newACMEManager(ctx context.Context, cfg config.HTTPServer, allowed func(hostname string) bool) (*acmeManager, error) {
+	key, err := loadOrCreateKey(filepath.Join(cfg.ACME.CacheDir, acmeAccountKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load acme account key: %w", err)
+	}
+	httpClient, err := cfg.ACME.HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &acmeManager{
+		cfg:        cfg.ACME,
+		domainName: cfg.DomainName,
+		client: &acme.Client{
+			Key:          key,
+			DirectoryURL: cfg.ACME.Directory(),
+			HTTPClient:   httpClient,
+			UserAgent:    "localshow",
+		},
+		ctx:       ctx,
+		allowed:   allowed,
+		certs:     map[string]*tls.Certificate{},
+		pending:   map[string]chan struct{}{},
+		failures:  map[string]acmeFailure{},
+		tokens:    map[string]string{},
+		alpnCerts: map[string]*tls.Certificate{},
+	}, nil
+}
+
+// loadOrCreateKey reads the PEM encoded EC key at pth, or generates one and
+// writes it to pth if it does not exist.
+func loadOrCreateKey(pth string) (crypto.Signer, error) {
+	data, err := os.ReadFile(pth)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data found in %s", pth)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(pth, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// certName returns the name of the certificate that covers hostname, or an
+// empty string if we do not obtain certificates for it.
+func (m *acmeManager) certName(hostname string) string {
+	if m.cfg.ChallengeType() != config.ACMEChallengeDNS01 {
+		return hostname
+	}
+	// The wildcard certificate covers the domain and its direct
+	// subdomains.
+	if hostname == m.domainName {
+		return m.domainName
+	}
+	if sub, ok := strings.CutSuffix(hostname, "."+m.domainName); ok && !strings.Contains(sub, ".") {
+		return m.domainName
+	}
+	return ""
+}
+
+func (m *acmeManager) certPaths(name string) (string, string) {
+	return filepath.Join(m.cfg.CacheDir, name+".crt"), filepath.Join(m.cfg.CacheDir, name+".key")
+}
+
+// acmeFailure records the failed orders of a name.
+type acmeFailure struct {
+	count      int
+	retryAfter time.Time
+}
+
+// certificate returns the certificate for hostname. Certificates are loaded
+// from the cache dir, or obtained from the CA if there is no valid one.
+// Neither is attempted for hostnames that are not allowed.
+func (m *acmeManager) certificate(ctx context.Context, hostname string) (*tls.Certificate, error) {
+	// The name of the certificate is used to build the paths of its
+	// files, so it must be a valid hostname.
+	hostname, err := config.ParseHostname(hostname)
+	if err != nil {
+		return nil, errNoACMECertificate
+	}
+	name := m.certName(hostname)
+	if name == "" {
+		return nil, errNoACMECertificate
+	}
+
+	for {
+		m.mux.Lock()
+		if cert, ok := m.certs[name]; ok {
+			m.mux.Unlock()
+			return cert, nil
+		}
+		wait, ok := m.pending[name]
+		if !ok {
+			break
+		}
+		m.mux.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		m.mux.Lock()
+		_, ok = m.certs[name]
+		m.mux.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("failed to obtain certificate for %s", hostname)
+		}
+	}
+	defer m.mux.Unlock()
+
+	if !m.allowed(name) {
+		return nil, errNoACMECertificate
+	}
+	if cert, err := m.loadCertificate(name); err == nil {
+		m.certs[name] = cert
+		return cert, nil
+	}
+	if failure, ok := m.failures[name]; ok && time.Now().Before(failure.retryAfter) {
+		return nil, fmt.Errorf("not ordering a certificate for %s until %s", name, failure.retryAfter.Format(time.RFC3339))
+	}
+
+	done := make(chan struct{})
+	m.pending[name] = done
+	m.mux.Unlock()
+	// The certificate is obtained on behalf of all visitors waiting for
+	// it, so it is not tied to the handshake of the first one.
+	cert, err := m.obtain(name)
+	m.mux.Lock()
+	delete(m.pending, name)
+	close(done)
+	if err != nil {
+		log.Printf("failed to obtain certificate for %s: %s", name, err)
+		m.recordFailure(name)
+		return nil, err
+	}
+	delete(m.failures, name)
+	return cert, nil
+}
+
+// recordFailure backs off ordering certificates for name after an order
+// failed. The caller must hold m.mux.
+func (m *acmeManager) recordFailure(name string) {
+	failure := m.failures[name]
+	backoff := acmeRetryBackoff << min(failure.count, 16)
+	failure.count++
+	failure.retryAfter = time.Now().Add(min(backoff, acmeMaxRetryBackoff))
+	m.failures[name] = failure
+}
+
+// loadCertificate reads the certificate of name from the cache dir. Expired
+// certificates are ignored.
+func (m *acmeManager) loadCertificate(name string) (*tls.Certificate, error) {
+	crtFile, keyFile := m.certPaths(name)
+	cert, err := tls.LoadX509KeyPair(crtFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate of %s expired", name)
+	}
+	return &cert, nil
+}
+
+// storeCertificate writes cert to the cache dir.
+func (m *acmeManager) storeCertificate(name string, cert *tls.Certificate) error {
+	var chain []byte
+	for _, der := range cert.Certificate {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return err
+	}
+
+	crtFile, keyFile := m.certPaths(name)
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(crtFile, chain, 0o644)
+}
+
+func (m *acmeManager) register(ctx context.Context) error {
+	m.regMux.Lock()
+	defer m.regMux.Unlock()
+	if m.registered {
+		return nil
+	}
+
+	account := &acme.Account{}
+	if m.cfg.Email != "" {
+		account.Contact = []string{"mailto:" + m.cfg.Email}
+	}
+	if _, err := m.client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("failed to register acme account: %w", err)
+	}
+	m.registered = true
+	return nil
+}
+
+// obtain requests a certificate for name from the CA, and stores it in
+// the cache dir and in memory.
+func (m *acmeManager) obtain(name string) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(m.ctx, acmeObtainTimeout)
+	defer cancel()
+
+	if err := m.register(ctx); err != nil {
+		return nil, err
+	}
+
+	names := []string{name}
+	if m.cfg.ChallengeType() == config.ACMEChallengeDNS01 {
+		names = append(names, "*."+name)
+	}
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create order: %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := m.authorize(ctx, authzURL); err != nil {
+			return nil, err
+		}
+	}
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wait for order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: names}, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create csr: %w", err)
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize order: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	cert := &tls.Certificate{
+		Certificate: der,
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	if err := m.storeCertificate(name, cert); err != nil {
+		log.Printf("failed to store certificate of %s: %s", name, err)
+	}
+	m.mux.Lock()
+	m.certs[name] = cert
+	m.mux.Unlock()
+	log.Printf("obtained certificate for %s, valid until %s", strings.Join(names, ", "), leaf.NotAfter.Format(time.RFC3339))
+	return cert, nil
+}
+
+// authorize solves the challenge of an authorization of an order.
+func (m *acmeManager) authorize(ctx context.Context, authzURL string) error {
+	authz, err := m.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("failed to get authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == m.cfg.ChallengeType() {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("the CA does not offer the %s challenge for %s", m.cfg.ChallengeType(), authz.Identifier.Value)
+	}
+
+	cleanup, err := m.prepareChallenge(ctx, authz.Identifier.Value, challenge)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if _, err := m.client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("failed to accept challenge: %w", err)
+	}
+	if _, err := m.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("failed to authorize %s: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// prepareChallenge sets up the response to challenge, and returns a
+// function that removes it.
+func (m *acmeManager) prepareChallenge(ctx context.Context, domain string, challenge *acme.Challenge) (func(), error) {
+	switch challenge.Type {
+	case config.ACMEChallengeHTTP01:
+		response, err := m.client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return nil, err
+		}
+		pth := m.client.HTTP01ChallengePath(challenge.Token)
+		m.mux.Lock()
+		m.tokens[pth] = response
+		m.mux.Unlock()
+		return func() {
+			m.mux.Lock()
+			delete(m.tokens, pth)
+			m.mux.Unlock()
+		}, nil
+	case config.ACMEChallengeTLSALPN01:
+		cert, err := m.client.TLSALPN01ChallengeCert(challenge.Token, domain)
+		if err != nil {
+			return nil, err
+		}
+		m.mux.Lock()
+		m.alpnCerts[domain] = &cert
+		m.mux.Unlock()
+		return func() {
+			m.mux.Lock()
+			delete(m.alpnCerts, domain)
+			m.mux.Unlock()
+		}, nil
+	case config.ACMEChallengeDNS01:
+		value, err := m.client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return nil, err
+		}
+		record := "_acme-challenge." + domain
+		if err := m.runDNSHook(ctx, "present", record, value); err != nil {
+			return nil, err
+		}
+		return func() {
+			// The order context may be done by now.
+			ctx, cancel := context.WithTimeout(m.ctx, time.Minute)
+			defer cancel()
+			if err := m.runDNSHook(ctx, "cleanup", record, value); err != nil {
+				log.Printf("failed to clean up %s: %s", record, err)
+			}
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported challenge %q", challenge.Type)
+	}
+}
+
+// runDNSHook calls the DNS hook to publish or remove a TXT record. The hook
+// should only return once the record is visible to the CA.
+func (m *acmeManager) runDNSHook(ctx context.Context, action, record, value string) error {
+	out, err := exec.CommandContext(ctx, m.cfg.DNSHook, action, record, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("dns hook failed to %s %s: %w: %s", action, record, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// challengeCertificate returns the certificate of the tls-alpn-01 challenge
+// for hostname.
+func (m *acmeManager) challengeCertificate(hostname string) (*tls.Certificate, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	cert, ok := m.alpnCerts[strings.ToLower(hostname)]
+	if !ok {
+		return nil, fmt.Errorf("no tls-alpn-01 challenge for %s", hostname)
+	}
+	return cert, nil
+}
+
+// serveChallenge answers http-01 challenges. It returns false if r is not
+// a challenge request.
+func (m *acmeManager) serveChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, acmeChallengePathPrefix) {
+		return false
+	}
+	m.mux.Lock()
+	response, ok := m.tokens[r.URL.Path]
+	m.mux.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, response)
+	return true
+}
+
+// loop renews the certificates that expire within the renewal window.
+// With the dns-01 challenge, the wildcard certificate is loaded or
+// obtained right away.
+func (m *acmeManager) loop() {
+	if m.cfg.ChallengeType() == config.ACMEChallengeDNS01 {
+		if _, err := m.certificate(m.ctx, m.domainName); err != nil {
+			log.Printf("failed to get wildcard certificate: %s", err)
+		}
+	}
+	m.renew()
+
+	ticker := time.NewTicker(acmeRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			m.renew()
+		}
+	}
+}
+
+// renew renews the certificates that expire within the renewal window.
+// Certificates of names that are no longer allowed, like the ones of
+// closed tunnels, are dropped instead.
+func (m *acmeManager) renew() {
+	m.mux.Lock()
+	var names []string
+	for name, cert := range m.certs {
+		if time.Until(cert.Leaf.NotAfter) < m.cfg.RenewalWindow() {
+			names = append(names, name)
+		}
+	}
+	m.mux.Unlock()
+
+	for _, name := range names {
+		if !m.allowed(name) {
+			log.Printf("dropping certificate of %s", name)
+			m.mux.Lock()
+			delete(m.certs, name)
+			m.mux.Unlock()
+			continue
+		}
+		log.Printf("renewing certificate of %s", name)
+		// Visitors keep getting the current certificate until the
+		// new one is issued.
+		if _, err := m.obtain(name); err != nil {
+			log.Printf("failed to renew certificate of %s: %s", name, err)
+		}
+	}
+}
+
+// loadedCertificates returns the certificates currently served.
+func (m *acmeManager) loadedCertificates() []*tls.Certificate {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	ret := make([]*tls.Certificate, 0, len(m.certs))
+	for _, cert := range m.certs {
+		ret = append(ret, cert)
+	}
+	return ret
+}
@@ -0,0 +1,169 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build pebble
+
+// These tests obtain certificates from Pebble, the test CA of Let's Encrypt.
+// Start pebble-challtestsrv, which resolves every name to 127.0.0.1, and
+// Pebble using it as its DNS server:
+//
+//	pebble-challtestsrv -defaultIPv4 127.0.0.1 -defaultIPv6 ""
+//	pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053
+//
+// Then run the tests, pointing them at the CA certificate of Pebble:
+//
+//	PEBBLE_CA_CERTIFICATES=/path/to/pebble/test/certs/pebble.minica.pem \
+//	    go test -tags pebble -run Pebble ./httpsrv/
+//
+// PEBBLE_DIRECTORY_URL and PEBBLE_HTTP_PORT override the directory of the
+// CA and the port it validates http-01 challenges on.
+
+package httpsrv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gabriel-samfira/localshow/config"
+)
+
+func newPebbleManager(t *testing.T, allowed func(string) bool) *acmeManager {
+	t.Helper()
+
+	caCerts := os.Getenv("PEBBLE_CA_CERTIFICATES")
+	if caCerts == "" {
+		t.Skip("PEBBLE_CA_CERTIFICATES is not set")
+	}
+	directoryURL := os.Getenv("PEBBLE_DIRECTORY_URL")
+	if directoryURL == "" {
+		directoryURL = "https://localhost:14000/dir"
+	}
+	httpPort := os.Getenv("PEBBLE_HTTP_PORT")
+	if httpPort == "" {
+		httpPort = "5002"
+	}
+
+	cfg := config.HTTPServer{
+		DomainName: "localshow.test",
+		ACME: config.ACME{
+			Enabled:        true,
+			DirectoryURL:   directoryURL,
+			CacheDir:       t.TempDir(),
+			Challenge:      config.ACMEChallengeHTTP01,
+			CACertificates: caCerts,
+		},
+	}
+	if err := cfg.ACME.Validate(); err != nil {
+		t.Fatalf("invalid acme config: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	m, err := newACMEManager(ctx, cfg, allowed)
+	if err != nil {
+		t.Fatalf("failed to create acme manager: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("", httpPort))
+	if err != nil {
+		t.Fatalf("failed to listen for challenges: %s", err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !m.serveChallenge(w, r) {
+				http.NotFound(w, r)
+			}
+		}),
+	}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+	return m
+}
+
+func TestPebbleObtainAndRenew(t *testing.T) {
+	var allowed atomic.Bool
+	allowed.Store(true)
+	m := newPebbleManager(t, func(string) bool { return allowed.Load() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), acmeObtainTimeout)
+	defer cancel()
+	cert, err := m.certificate(ctx, "Tunnel.Localshow.Test")
+	if err != nil {
+		t.Fatalf("failed to obtain certificate: %s", err)
+	}
+	if !slices.Equal(cert.Leaf.DNSNames, []string{"tunnel.localshow.test"}) {
+		t.Fatalf("unexpected names in certificate: %v", cert.Leaf.DNSNames)
+	}
+
+	// The certificate is served from memory, and from the cache dir
+	// once the manager is restarted.
+	if again, err := m.certificate(ctx, "tunnel.localshow.test"); err != nil || again != cert {
+		t.Fatalf("expected the cached certificate, got %v, %v", again, err)
+	}
+	if _, err := m.loadCertificate("tunnel.localshow.test"); err != nil {
+		t.Fatalf("certificate was not stored: %s", err)
+	}
+
+	// Every certificate is due for renewal with this window. Renewing
+	// replaces the certificate with a new one.
+	m.cfg.RenewBefore = 10 * 365 * 24 * time.Hour
+	m.renew()
+	renewed, err := m.certificate(ctx, "tunnel.localshow.test")
+	if err != nil {
+		t.Fatalf("failed to get renewed certificate: %s", err)
+	}
+	if renewed == cert {
+		t.Fatalf("certificate was not renewed")
+	}
+
+	// Names that are no longer allowed are dropped rather than renewed.
+	allowed.Store(false)
+	m.renew()
+	if certs := m.loadedCertificates(); len(certs) != 0 {
+		t.Fatalf("expected no certificates after renewal, got %d", len(certs))
+	}
+}
+
+func TestPebbleRefusedNames(t *testing.T) {
+	m := newPebbleManager(t, func(name string) bool { return name == "allowed.localshow.test" })
+
+	ctx, cancel := context.WithTimeout(context.Background(), acmeObtainTimeout)
+	defer cancel()
+	for _, name := range []string{"other.localshow.test", "../../etc/passwd", "localshow.test/x", ""} {
+		if _, err := m.certificate(ctx, name); !errors.Is(err, errNoACMECertificate) {
+			t.Errorf("expected %q to be refused, got %v", name, err)
+		}
+	}
+
+	// No order is placed for a name while it backs off after a failure.
+	m.mux.Lock()
+	m.recordFailure("allowed.localshow.test")
+	m.mux.Unlock()
+	if _, err := m.certificate(ctx, "allowed.localshow.test"); err == nil {
+		t.Fatalf("expected the order to be skipped during the backoff")
+	}
+	m.mux.Lock()
+	pending := len(m.pending)
+	m.mux.Unlock()
+	if pending != 0 {
+		t.Fatalf("expected no pending orders, got %d", pending)
+	}
+}
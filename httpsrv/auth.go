@@ -0,0 +1,163 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package httpsrv
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gabriel-samfira/localshow/config"
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+const (
+	// visitorTokenParam is the query parameter visitors may use to pass
+	// a token. Browsers get the token back in visitorTokenCookie, so
+	// the parameter only needs to be set on the first request.
+	visitorTokenParam  = "localshow_token"
+	visitorTokenCookie = "localshow_token"
+)
+
+// secretEqual compares two secrets in constant time. Hashing them first
+// keeps the comparison from leaking their length.
+func secretEqual(a, b string) bool {
+	hashA := sha256.Sum256([]byte(a))
+	hashB := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(hashA[:], hashB[:]) == 1
+}
+
+// visitorCredentials are the credentials accepted from the visitors of a
+// tunnel. They are made up of the credentials set by the owner of the
+// tunnel and the ones set by the server policy.
+type visitorCredentials struct {
+	users  [][2]string
+	tokens []string
+}
+
+func newVisitorCredentials(opts params.TunnelOptions, policy config.VisitorAuth) visitorCredentials {
+	var creds visitorCredentials
+	if opts.BasicAuthUser != "" {
+		creds.users = append(creds.users, [2]string{opts.BasicAuthUser, opts.BasicAuthPassword})
+	}
+	if opts.Token != "" {
+		creds.tokens = append(creds.tokens, opts.Token)
+	}
+	for _, user := range policy.Users {
+		name, password, _ := strings.Cut(user, ":")
+		creds.users = append(creds.users, [2]string{name, password})
+	}
+	creds.tokens = append(creds.tokens, policy.Tokens...)
+	return creds
+}
+
+func (c visitorCredentials) empty() bool {
+	return len(c.users) == 0 && len(c.tokens) == 0
+}
+
+// checkUser returns true if user and password match any of the accepted
+// basic auth credentials. All credentials are checked, so the time taken
+// does not depend on which of them matched.
+func (c visitorCredentials) checkUser(user, password string) bool {
+	matched := false
+	for _, creds := range c.users {
+		userMatch := secretEqual(user, creds[0])
+		passwordMatch := secretEqual(password, creds[1])
+		if userMatch && passwordMatch {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// checkToken returns true if token matches any of the accepted tokens.
+func (c visitorCredentials) checkToken(token string) bool {
+	matched := false
+	for _, accepted := range c.tokens {
+		if secretEqual(token, accepted) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// authenticate returns true if the visitor that sent r may reach the tunnel.
+// The credentials are removed from r, so they do not reach the backend.
+// When a token is passed in the query string, it is moved to a cookie.
+func (c visitorCredentials) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	if c.empty() {
+		return true
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if user, password, ok := r.BasicAuth(); ok && len(c.users) > 0 {
+		if c.checkUser(user, password) {
+			r.Header.Del("Authorization")
+			return true
+		}
+	}
+	if token, ok := strings.CutPrefix(authHeader, "Bearer "); ok && len(c.tokens) > 0 {
+		if c.checkToken(token) {
+			r.Header.Del("Authorization")
+			return true
+		}
+	}
+
+	query := r.URL.Query()
+	if token := query.Get(visitorTokenParam); token != "" && c.checkToken(token) {
+		query.Del(visitorTokenParam)
+		r.URL.RawQuery = query.Encode()
+		http.SetCookie(w, &http.Cookie{
+			Name:     visitorTokenCookie,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		stripCookie(r, visitorTokenCookie)
+		return true
+	}
+
+	if cookie, err := r.Cookie(visitorTokenCookie); err == nil && c.checkToken(cookie.Value) {
+		stripCookie(r, visitorTokenCookie)
+		return true
+	}
+	return false
+}
+
+// challenge replies to a visitor that failed to authenticate.
+func (c visitorCredentials) challenge(w http.ResponseWriter, hostname string) {
+	if len(c.users) > 0 {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", hostname))
+	}
+	if len(c.tokens) > 0 {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", hostname))
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// stripCookie removes the cookie called name from r.
+func stripCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package httpsrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gabriel-samfira/localshow/config"
+)
+
+// capturedBody holds the first bytes of a request or response body.
+type capturedBody struct {
+	Data []byte
+	// Size is the full size of the body.
+	Size int64
+}
+
+// Truncated returns true if only part of the body was kept.
+func (b capturedBody) Truncated() bool {
+	return int64(len(b.Data)) < b.Size
+}
+
+// capturedRequest is a request proxied to a tunnel with request capture
+// enabled, along with the response sent back to the visitor. It is not
+// modified once added to a capture.
+type capturedRequest struct {
+	ID string
+	// ReplayOf is the ID of the request this one replays.
+	ReplayOf string
+	Time     time.Time
+	Duration time.Duration
+	// Send is the time it took to read the body of the request, Wait
+	// the time the tunnel took to send the response headers after that,
+	// and Receive the time it took to send the rest of the response.
+	Send    time.Duration
+	Wait    time.Duration
+	Receive time.Duration
+
+	RemoteAddr    string
+	Scheme        string
+	Host          string
+	Method        string
+	URI           string
+	Proto         string
+	RequestHeader http.Header
+	RequestBody   capturedBody
+
+	// tls is the connection state of the visitor. Replays of the
+	// request reuse it.
+	tls *tls.ConnectionState
+
+	// Status is zero if no response was sent.
+	Status         int
+	ResponseHeader http.Header
+	ResponseBody   capturedBody
+}
+
+// kept returns the number of bytes kept from the bodies of the request.
+func (c *capturedRequest) kept() int64 {
+	return int64(len(c.RequestBody.Data) + len(c.ResponseBody.Data))
+}
+
+// URL returns the URL the request was sent to.
+func (c *capturedRequest) URL() string {
+	return c.Scheme + "://" + c.Host + c.URI
+}
+
+// limitedBuffer keeps the first max bytes written to it, and counts the
+// rest. The body of a request may still be read by the transport after
+// the response was received, so writes are serialized.
+//
+// The bytes kept are reserved from memory as the buffer grows. Once a
+// reserve fails, the bytes kept so far are dropped and only the size of
+// the body is counted.
+type limitedBuffer struct {
+	buf    bytes.Buffer
+	max    int64
+	size   int64
+	memory *captureMemory
+	// dropped is set once the reserve failed, and taken once the kept
+	// bytes were handed to a captured request by body.
+	dropped bool
+	taken   bool
+	mux     sync.Mutex
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.size += int64(len(p))
+	if l.dropped || l.taken {
+		return len(p), nil
+	}
+	if room := l.max - int64(l.buf.Len()); room > 0 {
+		n := min(int64(len(p)), room)
+		if !l.memory.reserve(n) {
+			// The captures of all tunnels hold as much as they
+			// may, so only the size of the body is kept.
+			l.memory.release(int64(l.buf.Len()))
+			l.buf = bytes.Buffer{}
+			l.dropped = true
+			return len(p), nil
+		}
+		l.buf.Write(p[:n])
+	}
+	return len(p), nil
+}
+
+// body returns the bytes kept so far, along with the memory reserved for
+// them. Later writes are only counted.
+func (l *limitedBuffer) body() capturedBody {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.taken = true
+	ret := capturedBody{
+		Data: bytes.Clone(l.buf.Bytes()),
+		Size: l.size,
+	}
+	l.buf = bytes.Buffer{}
+	return ret
+}
+
+// drop releases the memory reserved for the bytes kept, unless they were
+// handed to a captured request by body.
+func (l *limitedBuffer) drop() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if !l.taken {
+		l.memory.release(int64(l.buf.Len()))
+		l.buf = bytes.Buffer{}
+		l.dropped = true
+	}
+}
+
+// teeBody copies the body of a request to a limitedBuffer as it is read.
+type teeBody struct {
+	io.ReadCloser
+	buf   *limitedBuffer
+	start time.Time
+	// read is the time it took to read the whole body, in nanoseconds.
+	// It is zero until the body was read.
+	read atomic.Int64
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.buf.Write(p[:n])
+	}
+	if err == io.EOF {
+		t.read.CompareAndSwap(0, int64(time.Since(t.start)))
+	}
+	return n, err
+}
+
+// replayKey is the context key of the replay a request was sent for.
+type replayKey struct{}
+
+// replayInfo identifies a replayed request. The ID is picked by the
+// inspector, so it can show the new request once it was handled.
+type replayInfo struct {
+	id       string
+	replayOf string
+}
+
+func withReplay(ctx context.Context, info replayInfo) context.Context {
+	return context.WithValue(ctx, replayKey{}, info)
+}
+
+// captureMemory counts the bytes kept from bodies by the captures of all
+// tunnels, which may not exceed the max_memory setting.
+type captureMemory struct {
+	cfg  *atomic.Pointer[config.Config]
+	used atomic.Int64
+}
+
+// reserve counts n more bytes, unless that exceeds the limit. It returns
+// true if the bytes may be kept.
+func (m *captureMemory) reserve(n int64) bool {
+	limit := m.cfg.Load().HTTPServer.Capture.Memory()
+	for {
+		used := m.used.Load()
+		if used+n > limit {
+			return false
+		}
+		if m.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+func (m *captureMemory) release(n int64) {
+	m.used.Add(-n)
+}
+
+func newCapture(hostname string, cfg config.Capture, memory *captureMemory) *capture {
+	return &capture{
+		secret:   rand.Text(),
+		hostname: hostname,
+		maxBody:  cfg.BodySize(),
+		memory:   memory,
+		requests: make([]*capturedRequest, 0, cfg.Requests()),
+	}
+}
+
+// capture keeps the recent requests of a tunnel in a ring buffer. The
+// requests are shown to the owner of the tunnel by the request inspector,
+// which is reached using the secret.
+type capture struct {
+	secret   string
+	hostname string
+	maxBody  int64
+	memory   *captureMemory
+
+	// seq numbers the captured requests.
+	seq      atomic.Int64
+	requests []*capturedRequest
+	// next is the index of the oldest request, once the buffer is full.
+	next int
+	// closed is set once the tunnel went away.
+	closed bool
+	mux    sync.Mutex
+}
+
+func (c *capture) nextID() string {
+	return strconv.FormatInt(c.seq.Add(1), 10)
+}
+
+// record sends r to p and keeps the request along with the response
+// recorded by rec.
+func (c *capture) record(rec *recordingWriter, r *http.Request, p *proxyTarget) {
+	start := rec.start
+	req := &capturedRequest{
+		Time:       start.UTC(),
+		RemoteAddr: r.RemoteAddr,
+		Scheme:     "http",
+		Host:       r.Host,
+		Method:     r.Method,
+		// The URL of the request is used rather than RequestURI, as
+		// visitor tokens are removed from it.
+		URI:           r.URL.RequestURI(),
+		Proto:         r.Proto,
+		RequestHeader: r.Header.Clone(),
+		tls:           r.TLS,
+	}
+	if r.TLS != nil {
+		req.Scheme = "https"
+	}
+	if info, ok := r.Context().Value(replayKey{}).(replayInfo); ok {
+		req.ID = info.id
+		req.ReplayOf = info.replayOf
+	} else {
+		req.ID = c.nextID()
+	}
+
+	// The buffers release their memory if the request is not captured,
+	// which happens when the proxy aborts the handler.
+	reqBody := &limitedBuffer{max: c.maxBody, memory: c.memory}
+	respBody := &limitedBuffer{max: c.maxBody, memory: c.memory}
+	defer reqBody.drop()
+	defer respBody.drop()
+	var tee *teeBody
+	if r.Body != nil && r.Body != http.NoBody {
+		tee = &teeBody{ReadCloser: r.Body, buf: reqBody, start: start}
+		r.Body = tee
+	}
+	rec.body = respBody
+	p.serve(rec, r)
+
+	req.Duration = time.Since(start)
+	// The tunnel may respond before reading the whole request, or
+	// without responding at all.
+	headerAt := req.Duration
+	if rec.status != 0 {
+		headerAt = rec.upstream
+	}
+	if tee != nil {
+		if read := time.Duration(tee.read.Load()); read > 0 {
+			req.Send = min(read, headerAt)
+		} else {
+			req.Send = headerAt
+		}
+	}
+	req.Wait = headerAt - req.Send
+	req.Receive = req.Duration - headerAt
+	req.RequestBody = reqBody.body()
+	req.Status = rec.status
+	req.ResponseHeader = rec.header
+	req.ResponseBody = respBody.body()
+	c.add(req)
+}
+
+// add keeps req, which holds the memory reserved for its bodies.
+func (c *capture) add(req *capturedRequest) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.closed {
+		c.memory.release(req.kept())
+		return
+	}
+	if len(c.requests) < cap(c.requests) {
+		c.requests = append(c.requests, req)
+		return
+	}
+	c.memory.release(c.requests[c.next].kept())
+	c.requests[c.next] = req
+	c.next = (c.next + 1) % len(c.requests)
+}
+
+// close drops the captured requests, once the tunnel went away.
+func (c *capture) close() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for _, req := range c.requests {
+		c.memory.release(req.kept())
+	}
+	c.requests = c.requests[:0]
+	c.next = 0
+	c.closed = true
+}
+
+// list returns the captured requests, newest first.
+func (c *capture) list() []*capturedRequest {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	ret := make([]*capturedRequest, 0, len(c.requests))
+	for idx := range c.requests {
+		pos := (c.next - 1 - idx + 2*len(c.requests)) % len(c.requests)
+		ret = append(ret, c.requests[pos])
+	}
+	return ret
+}
+
+// get returns the captured request with the given ID.
+func (c *capture) get(id string) (*capturedRequest, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for _, req := range c.requests {
+		if req.ID == id {
+			return req, true
+		}
+	}
+	return nil, false
+}
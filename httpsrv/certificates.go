@@ -0,0 +1,153 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package httpsrv
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+// certificateCheckInterval is how often certificates are checked for
+// expiry.
+const certificateCheckInterval = 12 * time.Hour
+
+// certificateSet holds the certificates loaded from the tls section of the
+// config. The first one is served to clients no other certificate is valid
+// for.
+type certificateSet struct {
+	certs []*tls.Certificate
+}
+
+func newCertificateSet(certs []tls.Certificate) *certificateSet {
+	set := &certificateSet{}
+	for idx := range certs {
+		set.certs = append(set.certs, &certs[idx])
+	}
+	return set
+}
+
+// pick returns the first certificate that is valid for the server name the
+// client asked for, and that the client supports.
+func (c *certificateSet) pick(hello *tls.ClientHelloInfo) *tls.Certificate {
+	if len(c.certs) == 0 {
+		return nil
+	}
+	if hello.ServerName != "" {
+		for _, cert := range c.certs {
+			if hello.SupportsCertificate(cert) == nil {
+				return cert
+			}
+		}
+	}
+	return c.certs[0]
+}
+
+// certificateStatus describes cert, which expires soon if it is within
+// warnBefore of its expiry.
+func certificateStatus(source string, cert *tls.Certificate, warnBefore time.Duration) (params.CertificateStatus, bool) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		return params.CertificateStatus{}, false
+	}
+	names := slices.Clone(leaf.DNSNames)
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = append(names, leaf.Subject.CommonName)
+	}
+	now := time.Now()
+	return params.CertificateStatus{
+		Source:      source,
+		Names:       names,
+		Issuer:      leaf.Issuer.String(),
+		NotBefore:   leaf.NotBefore,
+		NotAfter:    leaf.NotAfter,
+		ExpiresSoon: now.Add(warnBefore).After(leaf.NotAfter),
+		Expired:     now.After(leaf.NotAfter),
+	}, true
+}
+
+// Certificates returns the status of the certificates served on the TLS
+// listener, sorted by expiry.
+func (h *HTTPServer) Certificates() []params.CertificateStatus {
+	warnBefore := h.cfg.Load().HTTPServer.TLSConfig.ExpiryWarningWindow()
+	ret := []params.CertificateStatus{}
+	add := func(source string, cert *tls.Certificate) {
+		if status, ok := certificateStatus(source, cert, warnBefore); ok {
+			ret = append(ret, status)
+		}
+	}
+
+	if set := h.certificates.Load(); set != nil {
+		for _, cert := range set.certs {
+			add(params.CertificateSourceFile, cert)
+		}
+	}
+	h.domainCerts.Range(func(_, val any) bool {
+		add(params.CertificateSourceCustomDomain, val.(*tls.Certificate))
+		return true
+	})
+	if h.acme != nil {
+		for _, cert := range h.acme.loadedCertificates() {
+			add(params.CertificateSourceACME, cert)
+		}
+	}
+	slices.SortStableFunc(ret, func(a, b params.CertificateStatus) int {
+		return a.NotAfter.Compare(b.NotAfter)
+	})
+	return ret
+}
+
+// checkCertificates logs a warning about certificates that expire soon.
+func (h *HTTPServer) checkCertificates() {
+	for _, cert := range h.Certificates() {
+		switch {
+		case cert.Expired:
+			log.Printf("WARNING: %s certificate for %s expired on %s", cert.Source,
+				strings.Join(cert.Names, ", "), cert.NotAfter.Format(time.RFC3339))
+		case cert.ExpiresSoon:
+			log.Printf("WARNING: %s certificate for %s expires on %s", cert.Source,
+				strings.Join(cert.Names, ", "), cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+}
+
+func (h *HTTPServer) certificateLoop() {
+	h.checkCertificates()
+	ticker := time.NewTicker(certificateCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+			h.checkCertificates()
+		}
+	}
+}
+
+// handleCertificates serves the status of the certificates on the debug
+// server.
+func (h *HTTPServer) handleCertificates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.Certificates()); err != nil {
+		log.Printf("failed to write certificates: %s", err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package httpsrv
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+// vhostName returns the hostname the tunnel announced by event is served on.
+func (h *HTTPServer) vhostName(event params.TunnelEvent) string {
+	if event.CustomDomain {
+		return event.RequestedSubdomain
+	}
+	return event.RequestedSubdomain + "." + h.cfg.Load().HTTPServer.DomainName
+}
+
+// customDomainCertificate returns the certificate of the custom domain
+// serverName, if one is found in the certificates dir. Certificates are
+// only loaded for custom domains that have a tunnel, and are cached until
+// the configuration is reloaded.
+func (h *HTTPServer) customDomainCertificate(serverName string) (*tls.Certificate, bool) {
+	cfg := h.cfg.Load().CustomDomains
+	if !cfg.Enabled {
+		return nil, false
+	}
+	serverName = strings.ToLower(serverName)
+	if cert, ok := h.domainCerts.Load(serverName); ok {
+		return cert.(*tls.Certificate), true
+	}
+
+	val, ok := h.vhosts.Load(serverName)
+	if !ok || !val.(*vhost).customDomain {
+		return nil, false
+	}
+	crtFile, keyFile, ok := cfg.CertificatePaths(serverName)
+	if !ok {
+		return nil, false
+	}
+	if _, err := os.Stat(crtFile); err != nil {
+		// Custom domains without a certificate get the certificate
+		// of the server.
+		return nil, false
+	}
+	cert, err := tls.LoadX509KeyPair(crtFile, keyFile)
+	if err != nil {
+		log.Printf("failed to load certificate of %s: %s", serverName, err)
+		return nil, false
+	}
+	h.domainCerts.Store(serverName, &cert)
+	return &cert, true
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package httpsrv
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+// CountryResolver returns the ISO 3166-1 alpha-2 code of the country an IP
+// address is located in.
+type CountryResolver interface {
+	CountryCode(ip netip.Addr) (string, error)
+	HasGeoIP() bool
+}
+
+// checkVisitor returns an error if the visitor connecting from remoteAddr
+// may not reach v. Both the server wide visitor filter and the one set by
+// the owner of the tunnel apply. Blocked visitors are counted and reported
+// in the log stream of the tunnel.
+func (h *HTTPServer) checkVisitor(v *vhost, remoteAddr string) error {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return fmt.Errorf("invalid remote address %s", remoteAddr)
+	}
+	ip := addrPort.Addr().Unmap()
+
+	serverFilter := h.visitorFilter.Load()
+	var country string
+	if serverFilter.UsesCountries() || v.options.UsesCountries() {
+		country, err = h.countries.CountryCode(ip)
+		if err != nil {
+			log.Printf("failed to get country of %s: %s", ip, err)
+		}
+	}
+
+	err = serverFilter.Check(ip, country)
+	if err == nil {
+		err = v.options.Check(ip, country)
+	}
+	if err == nil {
+		return nil
+	}
+
+	blocked := v.blocked.Add(1)
+	logMsg := fmt.Sprintf("%s - - %s \"blocked: %s\" (%d blocked)", ip,
+		time.Now().UTC().Format("02/Jan/2006:15:04:05 -0700"), err, blocked)
+	v.notify(params.NotifyMessage{
+		MessageType: params.NotifyMessageLog,
+		Payload:     []byte(logMsg),
+	})
+	return err
+}
+
+// writeBlocked replies to a visitor refused by the visitor filters.
+func writeBlocked(w http.ResponseWriter, hostname string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(blockedHTML(hostname))
+}
+
+// splicePassthrough hands a connection to a passthrough tunnel, if the
+// visitor filters allow it.
+func (h *HTTPServer) splicePassthrough(v *vhost, conn net.Conn) {
+	if err := h.checkVisitor(v, conn.RemoteAddr().String()); err != nil {
+		conn.Close()
+		return
+	}
+	v.splice(conn)
+}
@@ -0,0 +1,164 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package httpsrv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type peerAddrKey struct{}
+
+type visitorAddrKey struct{}
+
+// forwardingHeaders are set by reverse proxies. They are dropped from
+// requests that do not come from a trusted proxy.
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Port",
+	"X-Real-IP",
+}
+
+// isTrustedProxy returns true if addr is one of the trusted proxies.
+func (h *HTTPServer) isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range *h.trustedProxies.Load() {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveVisitor sets the RemoteAddr of r to the address of the visitor.
+// For requests coming from a trusted proxy, it is the rightmost address of
+// the X-Forwarded-For or Forwarded header that is not a trusted proxy. The
+// address the request came from is kept in the context, see peerAddr.
+func (h *HTTPServer) resolveVisitor(r *http.Request) *http.Request {
+	peer := remoteIP(r.RemoteAddr)
+	r = r.WithContext(context.WithValue(r.Context(), peerAddrKey{}, peer))
+	if !peer.IsValid() || !h.isTrustedProxy(peer) {
+		for _, header := range forwardingHeaders {
+			r.Header.Del(header)
+		}
+		return r
+	}
+
+	visitor := peer
+	chain := forwardedFor(r.Header)
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseForwardedAddr(chain[i])
+		if !ok {
+			// Obfuscated or unknown addresses end the chain. The hop
+			// that reported them is the best we know.
+			break
+		}
+		visitor = addr
+		if !h.isTrustedProxy(addr) {
+			break
+		}
+	}
+	r.RemoteAddr = netip.AddrPortFrom(visitor, 0).String()
+	return r
+}
+
+// peerAddr returns the address the request came from, which is the address
+// of the proxy for requests forwarded by a trusted proxy.
+func peerAddr(r *http.Request) netip.Addr {
+	if addr, ok := r.Context().Value(peerAddrKey{}).(netip.Addr); ok {
+		return addr
+	}
+	return remoteIP(r.RemoteAddr)
+}
+
+// forwardedFor returns the addresses a request was forwarded for, from the
+// X-Forwarded-For header or, if it is missing, from the Forwarded header.
+// The address of the client comes first.
+func forwardedFor(header http.Header) []string {
+	var chain []string
+	for _, val := range header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(val, ",") {
+			chain = append(chain, strings.TrimSpace(addr))
+		}
+	}
+	if len(chain) > 0 {
+		return chain
+	}
+
+	for _, val := range header.Values("Forwarded") {
+		for _, element := range strings.Split(val, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					chain = append(chain, strings.Trim(value, `"`))
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// parseForwardedAddr parses an address from a forwarding header. The
+// address may have a port, and IPv6 addresses may be in brackets.
+func parseForwardedAddr(val string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(val); err == nil {
+		val = host
+	}
+	val = strings.TrimSuffix(strings.TrimPrefix(val, "["), "]")
+	addr, err := netip.ParseAddr(val)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// setForwardedFor sets the X-Forwarded-For header of the request sent to
+// the tunnel. The addresses forwarded by trusted proxies are kept, and the
+// address the request came from is appended.
+func setForwardedFor(out *http.Request, in *http.Request) {
+	chain := forwardedFor(in.Header)
+	if peer := peerAddr(in); peer.IsValid() {
+		chain = append(chain, peer.String())
+	}
+	if len(chain) == 0 {
+		out.Header.Del("X-Forwarded-For")
+		return
+	}
+	out.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+}
+
+// withVisitorAddr records the address of the visitor a request is proxied
+// for, which is sent to the client of the tunnel when a connection is
+// opened for the request.
+func withVisitorAddr(ctx context.Context, remoteAddr string) context.Context {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, visitorAddrKey{}, net.TCPAddrFromAddrPort(addrPort))
+}
+
+// visitorAddr returns the address recorded by withVisitorAddr, or nil.
+func visitorAddr(ctx context.Context) net.Addr {
+	if addr, ok := ctx.Value(visitorAddrKey{}).(*net.TCPAddr); ok {
+		return addr
+	}
+	return nil
+}
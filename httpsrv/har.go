@@ -0,0 +1,339 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package httpsrv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The types below are the parts of the HAR 1.2 format we write. See
+// http://www.softwareishard.com/blog/har-12-spec/
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+	Comment string     `json:"comment,omitempty"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	Comment     string         `json:"comment,omitempty"`
+}
+
+// harPostData holds the body of a request. HAR 1.2 has no encoding for
+// request bodies, so binary bodies are base64 encoded and flagged with the
+// custom _encoding field.
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+// harTimings only holds the phases we measure. The optional phases are
+// left out, as the connection to the tunnel is opened by the server.
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harMillis converts d to the milliseconds used by HAR.
+func harMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// WriteHAR writes the requests captured for the tunnel served on hostname
+// to w, as a HAR 1.2 file.
+func (h *HTTPServer) WriteHAR(w io.Writer, hostname string) error {
+	val, ok := h.vhosts.Load(hostname)
+	if !ok {
+		return fmt.Errorf("no tunnel is served on %s", hostname)
+	}
+	v := val.(*vhost)
+	if v.capture == nil {
+		return fmt.Errorf("request capture is not enabled for %s", hostname)
+	}
+	return writeHAR(w, v.capture, h.version)
+}
+
+// writeHAR writes the requests kept by c to w, oldest first.
+func writeHAR(w io.Writer, c *capture, version string) error {
+	requests := c.list()
+	slices.Reverse(requests)
+
+	har := harFile{
+		Log: harLog{
+			Version: "1.2",
+			Creator: harCreator{Name: "localshow", Version: version},
+			Entries: make([]harEntry, 0, len(requests)),
+			Comment: fmt.Sprintf("Requests captured for %s", c.hostname),
+		},
+	}
+	for _, req := range requests {
+		har.Log.Entries = append(har.Log.Entries, newHAREntry(req, c.maxBody))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(har); err != nil {
+		return fmt.Errorf("failed to write HAR: %w", err)
+	}
+	return nil
+}
+
+func newHAREntry(req *capturedRequest, maxBody int64) harEntry {
+	entry := harEntry{
+		StartedDateTime: req.Time.Format(time.RFC3339Nano),
+		// The total time is the sum of the timings.
+		Time: harMillis(req.Send + req.Wait + req.Receive),
+		Timings: harTimings{
+			Send:    harMillis(req.Send),
+			Wait:    harMillis(req.Wait),
+			Receive: harMillis(req.Receive),
+		},
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL(),
+			HTTPVersion: req.Proto,
+			Cookies:     harRequestCookies(req.RequestHeader),
+			Headers:     harHeaders(req.RequestHeader, req.Host),
+			QueryString: harQueryString(req.URI),
+			HeadersSize: -1,
+			BodySize:    req.RequestBody.Size,
+		},
+		Response: harResponse{
+			Status:      req.Status,
+			StatusText:  http.StatusText(req.Status),
+			HTTPVersion: req.Proto,
+			Cookies:     harResponseCookies(req.ResponseHeader),
+			Headers:     harHeaders(req.ResponseHeader, ""),
+			Content:     harResponseContent(req.ResponseHeader, req.ResponseBody, maxBody),
+			RedirectURL: req.ResponseHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    req.ResponseBody.Size,
+		},
+	}
+	if req.ReplayOf != "" {
+		entry.Comment = fmt.Sprintf("Replay of request %s", req.ReplayOf)
+	}
+	if req.Status == 0 {
+		entry.Response.BodySize = -1
+		entry.Response.Content.Comment = "No response was sent."
+	}
+	if req.RequestBody.Size > 0 {
+		data := harPostData{
+			MimeType: req.RequestHeader.Get("Content-Type"),
+		}
+		data.Text, data.Encoding = harBodyText(req.RequestBody.Data)
+		if req.RequestBody.Truncated() {
+			data.Comment = truncatedComment(req.RequestBody)
+		}
+		entry.Request.PostData = &data
+	}
+	return entry
+}
+
+// harBodyText returns body as text, or base64 encoded if it is binary.
+func harBodyText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func truncatedComment(body capturedBody) string {
+	return fmt.Sprintf("Only the first %d of %d bytes were captured.", len(body.Data), body.Size)
+}
+
+// harResponseContent describes the body of a response. Bodies compressed
+// using gzip are decompressed, if they were captured in full.
+func harResponseContent(header http.Header, body capturedBody, maxBody int64) harContent {
+	content := harContent{
+		Size:     body.Size,
+		MimeType: header.Get("Content-Type"),
+	}
+	data := body.Data
+	if !body.Truncated() && strings.EqualFold(header.Get("Content-Encoding"), "gzip") {
+		if decoded, err := gunzip(data, 10*maxBody); err == nil {
+			content.Size = int64(len(decoded))
+			content.Compression = content.Size - body.Size
+			data = decoded
+		}
+	}
+	content.Text, content.Encoding = harBodyText(data)
+	if body.Truncated() {
+		content.Comment = truncatedComment(body)
+	}
+	return content
+}
+
+// gunzip decompresses data, refusing to produce more than limit bytes.
+func gunzip(data []byte, limit int64) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	decoded, err := io.ReadAll(io.LimitReader(zr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > limit {
+		return nil, fmt.Errorf("decompressed body is too large")
+	}
+	return decoded, nil
+}
+
+// harHeaders returns the headers sorted by name. Server side requests
+// keep the Host header apart, so it is added back when host is set.
+func harHeaders(header http.Header, host string) []harNameValue {
+	ret := []harNameValue{}
+	if host != "" {
+		ret = append(ret, harNameValue{Name: "Host", Value: host})
+	}
+	for _, line := range headerLines(header) {
+		ret = append(ret, harNameValue{Name: line.Name, Value: line.Value})
+	}
+	return ret
+}
+
+func harQueryString(uri string) []harNameValue {
+	ret := []harNameValue{}
+	parsed, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return ret
+	}
+	query := parsed.Query()
+	for _, name := range slices.Sorted(maps.Keys(query)) {
+		for _, val := range query[name] {
+			ret = append(ret, harNameValue{Name: name, Value: val})
+		}
+	}
+	return ret
+}
+
+func harRequestCookies(header http.Header) []harCookie {
+	ret := []harCookie{}
+	for _, line := range header.Values("Cookie") {
+		cookies, err := http.ParseCookie(line)
+		if err != nil {
+			continue
+		}
+		for _, cookie := range cookies {
+			ret = append(ret, harCookie{Name: cookie.Name, Value: cookie.Value})
+		}
+	}
+	return ret
+}
+
+func harResponseCookies(header http.Header) []harCookie {
+	ret := []harCookie{}
+	for _, line := range header.Values("Set-Cookie") {
+		cookie, err := http.ParseSetCookie(line)
+		if err != nil {
+			continue
+		}
+		entry := harCookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Domain:   cookie.Domain,
+			HTTPOnly: cookie.HttpOnly,
+			Secure:   cookie.Secure,
+		}
+		if !cookie.Expires.IsZero() {
+			entry.Expires = cookie.Expires.UTC().Format(time.RFC3339)
+		}
+		ret = append(ret, entry)
+	}
+	return ret
+}
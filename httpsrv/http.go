@@ -19,13 +19,19 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"os"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "expvar"         // Register the expvar handlers
@@ -35,17 +41,22 @@ import (
 	"github.com/gabriel-samfira/localshow/apiserver/router"
 	"github.com/gabriel-samfira/localshow/config"
 	"github.com/gabriel-samfira/localshow/params"
+	"github.com/gabriel-samfira/localshow/proxyproto"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/acme"
 )
 
-// newProxyTransport returns an http.Transport with sensible defaults.
+// newProxyTransport returns an http.Transport with sensible defaults, that
+// opens connections to the client of a tunnel with dial.
 // When tlsSkipVerify is true, the transport accepts any backend certificate.
 // This is safe because the backend connection goes over an SSH tunnel.
-func newProxyTransport(tlsSkipVerify bool) *http.Transport {
+func newProxyTransport(dial params.TunnelDialer, tlsSkipVerify bool) *http.Transport {
 	transport := &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+			return dial(ctx, visitorAddr(ctx))
+		},
 		MaxIdleConns:          100,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
@@ -57,7 +68,7 @@ func newProxyTransport(tlsSkipVerify bool) *http.Transport {
 	return transport
 }
 
-func NewHTTPServer(ctx context.Context, cfg *config.Config, tunnelEvents chan params.TunnelEvent, controller *controllers.APIController) (*HTTPServer, error) {
+func NewHTTPServer(ctx context.Context, cfg *config.Config, tunnelEvents chan params.TunnelEvent, controller *controllers.APIController, countries CountryResolver, version string) (*HTTPServer, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid config: %w", err)
 	}
@@ -82,78 +93,234 @@ func NewHTTPServer(ctx context.Context, cfg *config.Config, tunnelEvents chan pa
 		}
 	}
 
-	router := router.NewAPIRouter(controller)
-
-	return &HTTPServer{
-		listener:         listener,
-		tlsListener:      tlsListener,
-		debugListener:    debugListener,
-		cfg:              cfg,
-		tunEvents:        tunnelEvents,
-		ctx:              ctx,
-		rootServerRouter: router,
-	}, nil
+	srv := &HTTPServer{
+		listener:      listener,
+		tlsListener:   tlsListener,
+		debugListener: debugListener,
+		tunEvents:     tunnelEvents,
+		ctx:           ctx,
+		countries:     countries,
+		version:       version,
+	}
+	srv.rootServerRouter = srv.rootRouter(router.NewAPIRouter(controller))
+	srv.accessLog = newAccessLog(&srv.cfg)
+	srv.captureMemory = &captureMemory{cfg: &srv.cfg}
+	if err := srv.Reload(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.HTTPServer.ACME.Enabled {
+		srv.acme, err = newACMEManager(ctx, cfg.HTTPServer, srv.acmeAllowed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create acme client: %w", err)
+		}
+	}
+	return srv, nil
 }
 
 type proxyTarget struct {
+	id        string
 	remote    *httputil.ReverseProxy
 	subdomain string
-	bindAddr  string
-	bindPort  uint32
-	msgChan   chan params.NotifyMessage
-	errChan   chan error
+	// hostname is the name of the vhost the target is a member of.
+	hostname string
+	// tunnelID identifies the tunnel, and dial opens connections to
+	// its client.
+	tunnelID string
+	dial     params.TunnelDialer
+	// admit returns an error if new visitors are refused.
+	admit    func() error
+	bindPort uint32
+	msgChan  chan params.NotifyMessage
+	errChan  chan error
+	// inspect sends the headers of requests and responses to msgChan.
+	inspect bool
+	// logFormat is the format of the request logs sent to msgChan.
+	logFormat string
+	accessLog *accessLog
+	// maxConcurrent is the number of requests the target handles at
+	// the same time. Zero means no limit.
+	maxConcurrent int64
+
+	// active is the number of requests and connections currently
+	// handled by this target.
+	active atomic.Int64
+}
+
+// acquire counts a request handled by the target. It returns false if the
+// target already handles maxConcurrent requests.
+func (p *proxyTarget) acquire() bool {
+	if p.maxConcurrent <= 0 {
+		p.active.Add(1)
+		return true
+	}
+	for {
+		active := p.active.Load()
+		if active >= p.maxConcurrent {
+			return false
+		}
+		if p.active.CompareAndSwap(active, active+1) {
+			return true
+		}
+	}
+}
+
+// serve proxies r to the tunnel, recording the response using rec. The
+// caller must have acquired the target.
+func (p *proxyTarget) serve(rec *recordingWriter, r *http.Request) {
+	defer p.active.Add(-1)
+
+	var body *countingBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingBody{ReadCloser: r.Body}
+		r.Body = body
+	}
+	// The request is logged once the response was sent, or the proxy
+	// gave up on it.
+	defer func() {
+		p.logRequest(newAccessLogEntry(r, rec, body))
+	}()
+
+	r = r.WithContext(withVisitorAddr(r.Context(), r.RemoteAddr))
+	if p.inspect {
+		p.logHeaders("request", r.Header)
+		rec.onHeader = func(code int) {
+			p.logHeaders(fmt.Sprintf("response %d", code), rec.Header())
+		}
+	}
+	// All header manipulation (X-Forwarded-*, X-Real-IP, Origin
+	// rewriting) is handled inside the ReverseProxy Rewrite function.
+	p.remote.ServeHTTP(rec, r)
 }
 
-func (p *proxyTarget) logRequest(r *http.Request) {
+// logHeaders sends headers to the log stream of the tunnel, one per line.
+func (p *proxyTarget) logHeaders(kind string, headers http.Header) {
 	if p.msgChan == nil {
 		return
 	}
-	clientIP := r.RemoteAddr
-	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+	var buf strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(headers)) {
+		for _, val := range headers[name] {
+			fmt.Fprintf(&buf, "  %s %s: %s\n", kind, name, val)
+		}
+	}
+	p.msgChan <- params.NotifyMessage{
+		MessageType: params.NotifyMessageLog,
+		Payload:     []byte(strings.TrimSuffix(buf.String(), "\n")),
+	}
+}
+
+// splice copies the raw stream of a visitor to the tunnel and back. It is
+// used for passthrough tunnels, where TLS is terminated by the client.
+func (p *proxyTarget) splice(conn net.Conn) {
+	defer conn.Close()
+	p.active.Add(1)
+	defer p.active.Add(-1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	backend, err := p.dial(ctx, conn.RemoteAddr())
+	cancel()
+	if err != nil {
+		log.Printf("failed to dial passthrough tunnel %s: %s", p.subdomain, err)
+		return
+	}
+	defer backend.Close()
+	p.logConnection(conn)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, backend)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (p *proxyTarget) logConnection(conn net.Conn) {
+	if p.msgChan == nil {
+		return
+	}
+	clientIP := conn.RemoteAddr().String()
+	if ip, _, err := net.SplitHostPort(clientIP); err == nil {
 		clientIP = ip
 	}
-	tm := time.Now().UTC()
-	logMsg := fmt.Sprintf("%s - - %s \"%s %s %s\" %s %dus", clientIP,
-		tm.Format("02/Jan/2006:15:04:05 -0700"),
-		r.Method,
-		r.URL.Path,
-		r.Proto,
-		r.UserAgent(),
-		time.Since(tm))
+	logMsg := fmt.Sprintf("%s - - %s \"TLS passthrough\"", clientIP,
+		time.Now().UTC().Format("02/Jan/2006:15:04:05 -0700"))
 	p.msgChan <- params.NotifyMessage{
 		MessageType: params.NotifyMessageLog,
 		Payload:     []byte(logMsg),
 	}
 }
 
+// logRequest sends entry to the log stream of the tunnel, and writes it to
+// the access log of the server.
+func (p *proxyTarget) logRequest(entry params.AccessLogEntry) {
+	p.accessLog.write(p.hostname, entry)
+	if p.msgChan == nil {
+		return
+	}
+	p.msgChan <- params.NotifyMessage{
+		MessageType: params.NotifyMessageLog,
+		Payload:     entry.Format(p.logFormat),
+	}
+}
+
 type HTTPServer struct {
-	listener         net.Listener
-	tlsListener      net.Listener
-	debugListener    net.Listener
-	cfg              *config.Config
+	listener      net.Listener
+	tlsListener   net.Listener
+	debugListener net.Listener
+	// cfg and certificates are swapped when the configuration is
+	// reloaded.
+	cfg          atomic.Pointer[config.Config]
+	certificates atomic.Pointer[certificateSet]
+	// acme is nil unless certificates are obtained using ACME.
+	acme             *acmeManager
+	visitorFilter    atomic.Pointer[params.VisitorFilter]
+	trustedProxies   atomic.Pointer[[]netip.Prefix]
+	countries        CountryResolver
 	tunEvents        chan params.TunnelEvent
 	ctx              context.Context
 	rootServerRouter http.Handler
 
-	vhosts sync.Map // map[string]*proxyTarget
+	vhosts sync.Map // map[string]*vhost
+	// domainCerts caches the certificates of custom domains. It is
+	// cleared when the configuration is reloaded.
+	domainCerts sync.Map // map[string]*tls.Certificate
+	// accessLog writes the requests proxied to tunnels to log files.
+	accessLog *accessLog
+	// captureMemory counts the bytes kept by the captures of all tunnels.
+	captureMemory *captureMemory
+	version       string
 
 	srv      *http.Server
 	debugSrv *http.Server
 }
 
-func (h *HTTPServer) tunnelSuccessURLs(subdomain string) ([]byte, error) {
-	urls := params.URLs{}
-	dom := fmt.Sprintf("%s.%s", subdomain, h.cfg.HTTPServer.DomainName)
+func (h *HTTPServer) tunnelSuccessURLs(event params.TunnelEvent, capture *capture) ([]byte, error) {
+	urls := params.URLs{
+		Options: event.Options.Summary(),
+	}
+	if event.Private {
+		urls.SSH = fmt.Sprintf("ssh -N -L 8080:%s:%d %s -p %d", event.RequestedSubdomain, event.RequestedPort, h.cfg.Load().HTTPServer.DomainName, h.cfg.Load().SSHServer.BindPort)
+		return json.Marshal(urls)
+	}
+
+	dom := h.vhostName(event)
 
-	httpPort := h.cfg.HTTPServer.EffectivePort()
+	httpPort := h.cfg.Load().HTTPServer.EffectivePort()
 	httpTunnel := fmt.Sprintf("http://%s", dom)
 	if httpPort != 80 {
 		httpTunnel = fmt.Sprintf("%s:%d", httpTunnel, httpPort)
 	}
 	urls.HTTP = httpTunnel
+	if capture != nil {
+		urls.Inspector = h.inspectorURL(capture)
+	}
 
-	if h.cfg.HTTPServer.UseTLS {
-		tlsPort := h.cfg.HTTPServer.EffectiveTLSPort()
+	if h.cfg.Load().HTTPServer.UseTLS {
+		tlsPort := h.cfg.Load().HTTPServer.EffectiveTLSPort()
 		httpsTunnel := fmt.Sprintf("https://%s", dom)
 		if tlsPort != 443 {
 			httpsTunnel = fmt.Sprintf("%s:%d", httpsTunnel, tlsPort)
@@ -179,18 +346,50 @@ func (h *HTTPServer) registerTunnel(event params.TunnelEvent) (err error) {
 		}
 	}()
 
-	if strings.Contains(event.RequestedSubdomain, ".") {
+	if strings.Contains(event.RequestedSubdomain, ".") && !event.CustomDomain {
 		return fmt.Errorf("invalid subdomain %s", event.RequestedSubdomain)
 	}
 
-	dom := fmt.Sprintf("%s.%s", event.RequestedSubdomain, h.cfg.HTTPServer.DomainName)
-	if _, loaded := h.vhosts.Load(dom); loaded {
-		return fmt.Errorf("subdomain %s already registered", event.RequestedSubdomain)
+	if err := h.checkVisitorAuth(event); err != nil {
+		return err
+	}
+	if event.Options.Capture && (event.Private || event.Passthrough) {
+		return fmt.Errorf("request capture is only supported for public HTTP tunnels")
+	}
+	event.Options = h.cfg.Load().HTTPServer.RateLimit.Apply(event.Options)
+
+	dom := h.vhostName(event)
+	var existing, held *vhost
+	if val, loaded := h.vhosts.Load(dom); loaded {
+		existing = val.(*vhost)
+		if existing.heldChan() != nil {
+			// The owner reconnected. The SSH server only lets the
+			// same key take over a held subdomain.
+			held, existing = existing, nil
+		} else if !existing.pool || !event.Pool {
+			// Only members of a load balanced tunnel may share a subdomain.
+			return fmt.Errorf("subdomain %s already registered", event.RequestedSubdomain)
+		}
 	}
 
-	remote, err := url.Parse(fmt.Sprintf("%s://%s", portMap[event.RequestedPort], event.BindAddr))
+	// Members of a pool share the capture of the pool. An owner that
+	// reconnects keeps the requests captured so far, and the address of
+	// the inspector.
+	var capture *capture
+	switch {
+	case existing != nil:
+		capture = existing.capture
+	case held != nil && held.capture != nil && event.Options.Capture:
+		capture = held.capture
+	case event.Options.Capture:
+		capture = newCapture(dom, h.cfg.Load().HTTPServer.Capture, h.captureMemory)
+	}
+
+	// Connections to the client are opened over SSH by the transport, so
+	// the host of the URL is only used as the Host header.
+	remote, err := url.Parse(fmt.Sprintf("%s://localhost", portMap[event.RequestedPort]))
 	if err != nil {
-		return fmt.Errorf("failed to parse bind address %s: %w", event.BindAddr, err)
+		return fmt.Errorf("failed to parse tunnel url: %w", err)
 	}
 
 	// Use Rewrite (not the legacy Director) so hop-by-hop headers such as
@@ -199,10 +398,20 @@ func (h *HTTPServer) registerTunnel(event params.TunnelEvent) (err error) {
 	reverseProxy := &httputil.ReverseProxy{
 		Rewrite: func(pr *httputil.ProxyRequest) {
 			pr.SetURL(remote)
-			// SetXForwarded appends to X-Forwarded-For (IP only),
-			// and sets X-Forwarded-Host and X-Forwarded-Proto from
-			// the inbound request.
+			if event.Options.HostHeader != "" {
+				pr.Out.Host = event.Options.HostHeader
+			}
+			// SetXForwarded sets X-Forwarded-Host and
+			// X-Forwarded-Proto from the inbound request. The
+			// RemoteAddr of the inbound request is the one of the
+			// visitor, so X-Forwarded-For is set separately.
 			pr.SetXForwarded()
+			setForwardedFor(pr.Out, pr.In)
+			// Forwarding headers are only left on requests from
+			// trusted proxies, which may have terminated TLS.
+			if proto := pr.In.Header.Get("X-Forwarded-Proto"); proto != "" {
+				pr.Out.Header.Set("X-Forwarded-Proto", proto)
+			}
 
 			clientIP, _, splitErr := net.SplitHostPort(pr.In.RemoteAddr)
 			if splitErr == nil {
@@ -210,9 +419,9 @@ func (h *HTTPServer) registerTunnel(event params.TunnelEvent) (err error) {
 			}
 
 			if pr.In.TLS != nil {
-				pr.Out.Header.Set("X-Forwarded-Port", fmt.Sprintf("%d", h.cfg.HTTPServer.EffectiveTLSPort()))
+				pr.Out.Header.Set("X-Forwarded-Port", fmt.Sprintf("%d", h.cfg.Load().HTTPServer.EffectiveTLSPort()))
 			} else {
-				pr.Out.Header.Set("X-Forwarded-Port", fmt.Sprintf("%d", h.cfg.HTTPServer.EffectivePort()))
+				pr.Out.Header.Set("X-Forwarded-Port", fmt.Sprintf("%d", h.cfg.Load().HTTPServer.EffectivePort()))
 			}
 
 			// Rewrite Origin so CORS checks pass on the backend.
@@ -231,36 +440,102 @@ func (h *HTTPServer) registerTunnel(event params.TunnelEvent) (err error) {
 		// Flush immediately so Server-Sent Events and streamed
 		// responses are not buffered.
 		FlushInterval: -1,
-		Transport:     newProxyTransport(event.RequestedPort == 443),
+		Transport:     newProxyTransport(event.Dial, event.RequestedPort == 443),
 	}
 	log.Printf("registering tunnel for %s", dom)
 
-	urls, err := h.tunnelSuccessURLs(event.RequestedSubdomain)
+	urls, err := h.tunnelSuccessURLs(event, capture)
 	if err != nil {
 		return fmt.Errorf("failed to get urls: %w", err)
 	}
 	event.NotifyChan <- params.NotifyMessage{
 		MessageType: params.NotifyMessageURL,
+		TunnelID:    event.TunnelID,
 		Payload:     urls,
 	}
 	// Register the vhost after the notify message is sent to the client. This ensures
 	// that the first message that is sent through the channel is the URL message.
-	h.vhosts.Store(dom, &proxyTarget{
+	member := &proxyTarget{
+		id:        uuid.New().String(),
 		remote:    reverseProxy,
 		subdomain: event.RequestedSubdomain,
-		bindAddr:  event.BindAddr,
+		hostname:  dom,
+		tunnelID:  event.TunnelID,
+		dial:      event.Dial,
+		admit:     event.Admit,
 		bindPort:  event.RequestedPort,
 		msgChan:   event.NotifyChan,
 		errChan:   event.ErrorChan,
-	})
+		inspect:   event.Options.Inspect,
+		logFormat: event.Options.LogFormat,
+		accessLog: h.accessLog,
+
+		maxConcurrent: int64(event.Options.MaxConcurrent),
+	}
+	if existing != nil {
+		// Members of a pool use the limits of the pool.
+		member.maxConcurrent = int64(existing.options.MaxConcurrent)
+		existing.addMember(member)
+		return nil
+	}
+	h.vhosts.Store(dom, newVhost(event, h.cfg.Load().HTTPServer, member, capture))
+	if held != nil {
+		if held.capture != nil && held.capture != capture {
+			held.capture.close()
+		}
+		// Requests held for the old vhost are sent to the new one.
+		held.release()
+	}
+	return nil
+}
+
+// checkVisitorAuth returns an error if the tunnel announced by event does
+// not comply with the visitor auth policy of the server. TLS is terminated
+// by the client for passthrough tunnels, so we can not authenticate their
+// visitors. Private tunnels are only reachable by authenticated SSH users.
+func (h *HTTPServer) checkVisitorAuth(event params.TunnelEvent) error {
+	if event.Private {
+		return nil
+	}
+
+	policy := h.cfg.Load().HTTPServer.VisitorAuth
+	if event.Passthrough {
+		if event.Options.HasCredentials() || policy.Enabled() {
+			return fmt.Errorf("visitor authentication is not supported for passthrough tunnels")
+		}
+		return nil
+	}
+
+	if policy.RequireTunnelCredentials && !event.Options.HasCredentials() {
+		return fmt.Errorf("this server requires tunnels to set the auth or token options")
+	}
 	return nil
 }
 
 func (h *HTTPServer) unregisterTunnel(event params.TunnelEvent) error {
-	dom := fmt.Sprintf("%s.%s", event.RequestedSubdomain, h.cfg.HTTPServer.DomainName)
+	dom := h.vhostName(event)
 	log.Printf("unregistering tunnel for %s", dom)
-	if _, loaded := h.vhosts.LoadAndDelete(dom); !loaded {
+	val, loaded := h.vhosts.Load(dom)
+	if !loaded {
 		log.Printf("subdomain %s (%s) not registered", event.RequestedSubdomain, dom)
+		return nil
+	}
+	// Members of a load balanced tunnel are ejected one at a time. The
+	// vhost goes away with its last member, unless it is held for the
+	// owner to reconnect.
+	v := val.(*vhost)
+	if !v.removeMember(event.TunnelID) {
+		return nil
+	}
+	if event.Held {
+		log.Printf("holding %s until its owner reconnects", dom)
+		v.hold()
+		return nil
+	}
+	h.vhosts.CompareAndDelete(dom, v)
+	v.release()
+	if v.capture != nil {
+		v.capture.close()
 	}
 	return nil
 }
@@ -275,26 +550,169 @@ func extractHostname(hostport string) string {
 	return host
 }
 
+// passthroughTarget returns the public vhost registered for serverName.
+func (h *HTTPServer) passthroughTarget(serverName string) (*vhost, bool) {
+	val, ok := h.vhosts.Load(serverName)
+	if !ok {
+		return nil, false
+	}
+	v := val.(*vhost)
+	if v.private {
+		return nil, false
+	}
+	return v, true
+}
+
+func (h *HTTPServer) redirectToHTTPS(w http.ResponseWriter, r *http.Request, hostname string) {
+	target := url.URL{
+		Scheme:   "https",
+		Host:     hostname,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+	if tlsPort := h.cfg.Load().HTTPServer.EffectiveTLSPort(); tlsPort != 443 {
+		target.Host = fmt.Sprintf("%s:%d", hostname, tlsPort)
+	}
+	http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+}
+
 func (h *HTTPServer) handlerFunc() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if h.acme != nil && h.acme.serveChallenge(w, r) {
+			return
+		}
+		r = h.resolveVisitor(r)
 		hostname := extractHostname(r.Host)
-		if hostname == h.cfg.HTTPServer.DomainName {
+		if hostname == h.cfg.Load().HTTPServer.DomainName {
 			h.rootServerRouter.ServeHTTP(w, r)
 			return
 		}
-
-		val, ok := h.vhosts.Load(hostname)
-		if !ok {
+		v, ok := h.lookupVhost(r, hostname)
+		// Private tunnels are only reachable over SSH and must look
+		// exactly like unregistered ones.
+		if !ok || v.private {
 			w.WriteHeader(http.StatusBadGateway)
 			w.Write(badRequestHTML(hostname))
 			return
 		}
-		p := val.(*proxyTarget)
-		p.logRequest(r)
-		// All header manipulation (X-Forwarded-*, X-Real-IP, Origin
-		// rewriting) is handled inside the ReverseProxy Rewrite function.
-		p.remote.ServeHTTP(w, r)
+		if err := h.checkVisitor(v, r.RemoteAddr); err != nil {
+			writeBlocked(w, hostname)
+			return
+		}
+		if v.passthrough {
+			// TLS for passthrough tunnels is terminated by the client. Plain
+			// HTTP visitors are sent to the HTTPS endpoint, while requests that
+			// ended up here over TLS used a mismatched SNI and Host header.
+			if r.TLS == nil {
+				h.redirectToHTTPS(w, r, hostname)
+				return
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write(badRequestHTML(hostname))
+			return
+		}
+		if ok, retryAfter := v.limiter.allow(remoteIP(r.RemoteAddr)); !ok {
+			v.logLimited(r, "rate limited")
+			writeTooManyRequests(w, hostname, retryAfter)
+			return
+		}
+		creds := newVisitorCredentials(v.options, h.cfg.Load().HTTPServer.VisitorAuth)
+		if !creds.authenticate(w, r) {
+			creds.challenge(w, hostname)
+			return
+		}
+		h.proxy(w, r, v, hostname)
+	}
+}
+
+// proxy sends r to one of the members of v. The request is captured if the
+// owner of the tunnel enabled request capture.
+func (h *HTTPServer) proxy(w http.ResponseWriter, r *http.Request, v *vhost, hostname string) {
+	p := v.pick(w, r)
+	if p == nil {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write(badRequestHTML(hostname))
+		return
+	}
+	// Requests may reuse idle connections to the tunnel, which were
+	// dialed before the tunnel stopped admitting visitors.
+	if err := p.admit(); err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write(badRequestHTML(hostname))
+		return
+	}
+	if !p.acquire() {
+		v.logLimited(r, "too many concurrent requests")
+		writeTooManyRequests(w, hostname, time.Second)
+		return
+	}
+	rec := newRecordingWriter(w)
+	if v.capture != nil {
+		v.capture.record(rec, r, p)
+		return
+	}
+	p.serve(rec, r)
+}
+
+// DialTunnel opens a connection to the tunnel served on hostname and port,
+// for SSH clients that reach it using local forwarding. Members of load
+// balanced tunnels are picked the way visitors are balanced between them.
+func (h *HTTPServer) DialTunnel(ctx context.Context, hostname string, port uint32, origin net.Addr) (net.Conn, error) {
+	val, ok := h.vhosts.Load(hostname)
+	if !ok {
+		return nil, fmt.Errorf("no tunnel registered for %s", hostname)
+	}
+	v := val.(*vhost)
+	v.mux.Lock()
+	member := v.pickLocked()
+	v.mux.Unlock()
+	if member == nil || member.bindPort != port {
+		return nil, fmt.Errorf("no tunnel registered for %s on port %d", hostname, port)
+	}
+
+	conn, err := member.dial(ctx, origin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to tunnel: %w", err)
+	}
+	// The connection counts towards the least connections strategy,
+	// like the requests of visitors.
+	member.active.Add(1)
+	return &activeConn{Conn: conn, target: member}, nil
+}
+
+// activeConn is a connection to a member of a vhost, counted as active
+// until it is closed.
+type activeConn struct {
+	net.Conn
+	target *proxyTarget
+	once   sync.Once
+}
+
+func (a *activeConn) Close() error {
+	a.once.Do(func() {
+		a.target.active.Add(-1)
+	})
+	return a.Conn.Close()
+}
+
+// acmeAllowed returns true if ACME may obtain a certificate for hostname.
+// Certificates are only obtained for the domain of the server and the
+// public tunnels we terminate TLS for. Unless all_subdomains is set, the
+// tunnels must be served on a reserved subdomain or a custom domain.
+func (h *HTTPServer) acmeAllowed(hostname string) bool {
+	cfg := h.cfg.Load().HTTPServer
+	if hostname == cfg.DomainName {
+		return true
 	}
+	val, ok := h.vhosts.Load(hostname)
+	if !ok {
+		return false
+	}
+	v := val.(*vhost)
+	if v.private || v.passthrough {
+		return false
+	}
+	return v.customDomain || v.reserved || cfg.ACME.AllSubdomains
 }
 
 func (h *HTTPServer) loop() {
@@ -342,18 +760,46 @@ func (h *HTTPServer) startReverseProxy() error {
 		Handler:           h.handlerFunc(),
 		ReadHeaderTimeout: 10 * time.Second,
 		IdleTimeout:       120 * time.Second,
+		TLSConfig: &tls.Config{
+			GetCertificate: h.getCertificate,
+			// The HTTP listener is served first, and only sets up HTTP/2
+			// if the TLS config already advertises it.
+			NextProtos: []string{"h2", "http/1.1"},
+		},
+	}
+	if h.acme != nil {
+		if h.acme.cfg.ChallengeType() == config.ACMEChallengeTLSALPN01 {
+			srv.TLSConfig.NextProtos = append(srv.TLSConfig.NextProtos, acme.ALPNProto)
+		}
+		go h.acme.loop()
+	}
+	if h.cfg.Load().HTTPServer.UseTLS {
+		go h.certificateLoop()
 	}
 	h.srv = srv
 
+	// The PROXY protocol settings are read for every connection, so they
+	// can be changed without a restart.
+	listener := proxyproto.NewListener(h.listener, func(addr net.Addr) bool {
+		return h.cfg.Load().HTTPServer.ProxyProtocol.Trusted(addr)
+	})
 	go func() {
-		if err := srv.Serve(h.listener); err != http.ErrServerClosed {
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
 			log.Printf("failed to serve on http: %s", err)
 		}
 	}()
 
 	go func() {
-		if h.cfg.HTTPServer.UseTLS && h.tlsListener != nil {
-			if err := srv.ServeTLS(h.tlsListener, h.cfg.HTTPServer.TLSConfig.CRT, h.cfg.HTTPServer.TLSConfig.Key); err != http.ErrServerClosed {
+		if h.cfg.Load().HTTPServer.UseTLS && h.tlsListener != nil {
+			// Connections for passthrough tunnels are spliced by the SNI
+			// listener and never reach the HTTP server.
+			tlsListener := proxyproto.NewListener(h.tlsListener, func(addr net.Addr) bool {
+				return h.cfg.Load().HTTPServer.TLSProxyProtocol.Trusted(addr)
+			})
+			sniListener := newSNIListener(tlsListener, h.passthroughTarget, h.splicePassthrough)
+			// The certificate is served by GetCertificate, so it can be
+			// rotated without a restart.
+			if err := srv.ServeTLS(sniListener, "", ""); err != http.ErrServerClosed {
 				log.Printf("failed to serve on HTTPS: %s", err)
 			}
 		}
@@ -364,8 +810,11 @@ func (h *HTTPServer) startReverseProxy() error {
 }
 
 func (h *HTTPServer) startDebugServer() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/certificates", h.handleCertificates)
+	mux.Handle("/", http.DefaultServeMux)
 	srv := &http.Server{
-		Handler: http.DefaultServeMux,
+		Handler: mux,
 	}
 	h.debugSrv = srv
 
@@ -382,7 +831,7 @@ func (h *HTTPServer) Start() error {
 		return fmt.Errorf("failed to start reverse proxy: %w", err)
 	}
 
-	if h.cfg.DebugServer.Enabled {
+	if h.cfg.Load().DebugServer.Enabled {
 		if err := h.startDebugServer(); err != nil {
 			return fmt.Errorf("failed to start debug server: %w", err)
 		}
@@ -391,6 +840,87 @@ func (h *HTTPServer) Start() error {
 	return nil
 }
 
+func (h *HTTPServer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert, ok := h.customDomainCertificate(hello.ServerName); ok {
+		return cert, nil
+	}
+	if h.acme != nil {
+		if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			return h.acme.challengeCertificate(hello.ServerName)
+		}
+		cert, err := h.acme.certificate(hello.Context(), hello.ServerName)
+		if err == nil {
+			return cert, nil
+		}
+		if h.certificates.Load() == nil {
+			return nil, err
+		}
+	}
+	set := h.certificates.Load()
+	if set == nil {
+		return nil, fmt.Errorf("no certificate loaded")
+	}
+	if cert := set.pick(hello); cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no certificate loaded")
+}
+
+// Reload applies cfg to the running server. The TLS certificates, and the
+// certificates of custom domains, are loaded from disk again. Tunnels that
+// are already registered are not affected.
+func (h *HTTPServer) Reload(cfg *config.Config) error {
+	apply, err := h.PrepareReload(cfg)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// PrepareReload loads and parses everything cfg needs, without changing
+// the running server. The returned function applies cfg, and can not fail.
+func (h *HTTPServer) PrepareReload(cfg *config.Config) (func(), error) {
+	var certs *certificateSet
+	if cfg.HTTPServer.UseTLS && cfg.HTTPServer.TLSConfig.HasCertificates() {
+		loaded, err := cfg.HTTPServer.TLSConfig.LoadCertificates()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificates: %w", err)
+		}
+		certs = newCertificateSet(loaded)
+	}
+	filter, err := cfg.VisitorFilter.Filter()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse visitor filter: %w", err)
+	}
+	trustedProxies, err := cfg.HTTPServer.TrustedProxyNetworks()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse trusted proxies: %w", err)
+	}
+	if cfg.AccessLog.Enabled {
+		if err := os.MkdirAll(cfg.AccessLog.Dir, 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create access log dir: %w", err)
+		}
+	}
+
+	return func() {
+		if certs != nil {
+			h.certificates.Store(certs)
+		}
+		h.visitorFilter.Store(&filter)
+		h.trustedProxies.Store(&trustedProxies)
+		h.cfg.Store(cfg)
+		h.domainCerts.Clear()
+		if h.accessLog != nil {
+			// The log files are opened again using the new config.
+			h.accessLog.close()
+		}
+		if h.srv != nil && cfg.HTTPServer.UseTLS {
+			h.checkCertificates()
+		}
+	}, nil
+}
+
 func (h *HTTPServer) Stop() error {
 	if h.srv == nil {
 		return nil
@@ -408,5 +938,6 @@ func (h *HTTPServer) Stop() error {
 		}
 	}
 
+	h.accessLog.stop()
 	return nil
 }
@@ -0,0 +1,466 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package httpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"maps"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// inspectorPath is the path of the request inspector on the domain of the
+// server. It is followed by the secret of a capture.
+const inspectorPath = "/inspect/"
+
+// rootRouter serves the request inspector on the domain of the server,
+// and everything else using api.
+func (h *HTTPServer) rootRouter(api http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+inspectorPath+"{secret}/{$}", h.handleInspector)
+	mux.HandleFunc("GET "+inspectorPath+"{secret}/har", h.handleInspectorHAR)
+	mux.HandleFunc("GET "+inspectorPath+"{secret}/requests/{id}", h.handleInspectorRequest)
+	mux.HandleFunc("POST "+inspectorPath+"{secret}/requests/{id}/replay", h.handleInspectorReplay)
+	mux.Handle("/", api)
+	return mux
+}
+
+// inspectorURL returns the address of the request inspector of c.
+func (h *HTTPServer) inspectorURL(c *capture) string {
+	cfg := h.cfg.Load().HTTPServer
+	scheme, port, defaultPort := "http", cfg.EffectivePort(), 80
+	if cfg.UseTLS {
+		scheme, port, defaultPort = "https", cfg.EffectiveTLSPort(), 443
+	}
+	host := cfg.DomainName
+	if port != defaultPort {
+		host = fmt.Sprintf("%s:%d", host, port)
+	}
+	return fmt.Sprintf("%s://%s%s%s/", scheme, host, inspectorPath, c.secret)
+}
+
+// inspectedVhost returns the vhost whose capture is reached using secret.
+func (h *HTTPServer) inspectedVhost(secret string) (*vhost, bool) {
+	var found *vhost
+	h.vhosts.Range(func(_, val any) bool {
+		v := val.(*vhost)
+		if v.capture != nil && secretEqual(v.capture.secret, secret) {
+			found = v
+			return false
+		}
+		return true
+	})
+	return found, found != nil
+}
+
+// inspectorRequest returns the vhost and the captured request addressed by
+// the path of r. It replies with an error if either of them is gone.
+func (h *HTTPServer) inspectorRequest(w http.ResponseWriter, r *http.Request) (*vhost, *capturedRequest, bool) {
+	v, ok := h.inspectedVhost(r.PathValue("secret"))
+	if !ok {
+		http.NotFound(w, r)
+		return nil, nil, false
+	}
+	req, ok := v.capture.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "This request is no longer captured.", http.StatusNotFound)
+		return nil, nil, false
+	}
+	return v, req, true
+}
+
+func (h *HTTPServer) handleInspector(w http.ResponseWriter, r *http.Request) {
+	v, ok := h.inspectedVhost(r.PathValue("secret"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeInspectorPage(w, "index", inspectorIndex{
+		Hostname: v.capture.hostname,
+		Requests: v.capture.list(),
+	})
+}
+
+// handleInspectorHAR sends the captured requests as a HAR file.
+func (h *HTTPServer) handleInspectorHAR(w http.ResponseWriter, r *http.Request) {
+	v, ok := h.inspectedVhost(r.PathValue("secret"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeHAR(&buf, v.capture, h.version); err != nil {
+		log.Printf("failed to export requests of %s: %s", v.capture.hostname, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", v.capture.hostname+".har"))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+func (h *HTTPServer) handleInspectorRequest(w http.ResponseWriter, r *http.Request) {
+	v, req, ok := h.inspectorRequest(w, r)
+	if !ok {
+		return
+	}
+	writeInspectorPage(w, "request", inspectorDetail{
+		Hostname:       v.capture.hostname,
+		Request:        req,
+		RequestHeader:  headerLines(req.RequestHeader),
+		RequestBody:    newInspectorBody(req.RequestBody),
+		ResponseHeader: headerLines(req.ResponseHeader),
+		ResponseBody:   newInspectorBody(req.ResponseBody),
+	})
+}
+
+// handleInspectorReplay sends a captured request, with the changes made by
+// the owner of the tunnel, to the tunnel again. Replays are sent by the
+// owner, so the visitor filters, rate limits and credentials of the tunnel
+// do not apply to them.
+func (h *HTTPServer) handleInspectorReplay(w http.ResponseWriter, r *http.Request) {
+	v, orig, ok := h.inspectorRequest(w, r)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 2*v.capture.maxBody+64*1024)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form.", http.StatusBadRequest)
+		return
+	}
+	replay, err := newReplayRequest(r.Context(), orig, r.PostForm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := v.capture.nextID()
+	replay = replay.WithContext(withReplay(replay.Context(), replayInfo{id: id, replayOf: orig.ID}))
+	replay.RemoteAddr = r.RemoteAddr
+	log.Printf("replaying request %s of %s", orig.ID, v.capture.hostname)
+	h.proxy(newDiscardWriter(), replay, v, v.capture.hostname)
+
+	if _, ok := v.capture.get(id); !ok {
+		http.Error(w, "The tunnel did not accept the request. Please try again later.", http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s%s/requests/%s", inspectorPath, r.PathValue("secret"), id), http.StatusSeeOther)
+}
+
+// newReplayRequest builds a request out of orig, changed according to the
+// replay form. The body is only replaced if it was edited, as browsers
+// send the line breaks of text areas as CRLF.
+func newReplayRequest(ctx context.Context, orig *capturedRequest, form url.Values) (*http.Request, error) {
+	method := orig.Method
+	if form.Has("method") {
+		method = strings.ToUpper(strings.TrimSpace(form.Get("method")))
+	}
+	uri := orig.URI
+	if form.Has("uri") {
+		uri = strings.TrimSpace(form.Get("uri"))
+	}
+	if !strings.HasPrefix(uri, "/") {
+		return nil, fmt.Errorf("the path must start with /")
+	}
+
+	header := orig.RequestHeader.Clone()
+	if form.Has("headers") {
+		var err error
+		header, err = parseHeaderLines(form.Get("headers"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	host := orig.Host
+	if val := header.Get("Host"); val != "" {
+		host = val
+	}
+	header.Del("Host")
+	// The length of the body is set by the proxy.
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+
+	body := orig.RequestBody.Data
+	edited := form.Has("body") && normalizeNewlines(form.Get("body")) != normalizeNewlines(string(body))
+	if edited {
+		body = []byte(form.Get("body"))
+	} else if orig.RequestBody.Truncated() {
+		return nil, fmt.Errorf("the body of this request was too large to be kept, so it can not be replayed")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	req.Host = host
+	req.RequestURI = uri
+	req.Header = header
+	req.TLS = orig.tls
+	return req, nil
+}
+
+func normalizeNewlines(s string) string {
+	return strings.ReplaceAll(s, "\r\n", "\n")
+}
+
+// parseHeaderLines parses headers written one per line, as "Name: value".
+func parseHeaderLines(text string) (http.Header, error) {
+	header := http.Header{}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header line %q", line)
+		}
+		header.Add(textproto.CanonicalMIMEHeaderKey(name), strings.TrimSpace(value))
+	}
+	return header, nil
+}
+
+// discardWriter is the response writer of replayed requests. The response
+// is kept by the capture.
+type discardWriter struct {
+	header http.Header
+}
+
+func newDiscardWriter() *discardWriter {
+	return &discardWriter{header: http.Header{}}
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d *discardWriter) WriteHeader(int) {}
+
+type headerLine struct {
+	Name  string
+	Value string
+}
+
+// headerLines returns the headers sorted by name, one value per line.
+func headerLines(header http.Header) []headerLine {
+	var ret []headerLine
+	for _, name := range slices.Sorted(maps.Keys(header)) {
+		for _, val := range header[name] {
+			ret = append(ret, headerLine{Name: name, Value: val})
+		}
+	}
+	return ret
+}
+
+// inspectorBody describes a captured body. Only text is shown.
+type inspectorBody struct {
+	Text      string
+	Binary    bool
+	Size      int64
+	Truncated bool
+}
+
+func newInspectorBody(body capturedBody) inspectorBody {
+	ret := inspectorBody{
+		Size:      body.Size,
+		Truncated: body.Truncated(),
+	}
+	if utf8.Valid(body.Data) {
+		ret.Text = string(body.Data)
+	} else {
+		ret.Binary = true
+	}
+	return ret
+}
+
+// Editable returns true if the body may be changed before a replay. Browsers
+// drop the first line break of text areas, so the template starts the text
+// area of the body with one.
+func (b inspectorBody) Editable() bool {
+	return !b.Binary && !b.Truncated
+}
+
+type inspectorIndex struct {
+	Hostname string
+	Requests []*capturedRequest
+}
+
+type inspectorDetail struct {
+	Hostname       string
+	Request        *capturedRequest
+	RequestHeader  []headerLine
+	RequestBody    inspectorBody
+	ResponseHeader []headerLine
+	ResponseBody   inspectorBody
+}
+
+// writeInspectorPage renders the inspector template called name. The
+// address of the inspector holds its secret, so it is not leaked through
+// the Referer header.
+func writeInspectorPage(w http.ResponseWriter, name string, data any) {
+	var buf bytes.Buffer
+	if err := inspectorTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+		log.Printf("failed to render inspector page: %s", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'")
+	w.Write(buf.Bytes())
+}
+
+var inspectorTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04:05")
+	},
+	"duration": func(d time.Duration) string {
+		return d.Round(time.Millisecond).String()
+	},
+	"status": func(code int) string {
+		if code == 0 {
+			return "no response"
+		}
+		return fmt.Sprintf("%d %s", code, http.StatusText(code))
+	},
+	"headerText": func(lines []headerLine) string {
+		var buf strings.Builder
+		for _, line := range lines {
+			fmt.Fprintf(&buf, "%s: %s\n", line.Name, line.Value)
+		}
+		return buf.String()
+	},
+}).Parse(inspectorTemplate))
+
+var inspectorTemplate = `
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+	<title>Requests - {{.Hostname}}</title>
+	<style>
+		body { font-family: sans-serif; margin: 2em; }
+		table { border-collapse: collapse; width: 100%; }
+		th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #ddd; }
+		pre, textarea { background: #f6f6f6; padding: 8px; white-space: pre-wrap; word-break: break-all; }
+		textarea { width: 100%; font-family: monospace; }
+		.muted { color: #777; }
+	</style>
+{{end}}
+
+{{define "index"}}{{template "header" .}}
+	<meta http-equiv="refresh" content="5">
+</head>
+<body>
+<h1>Requests to {{.Hostname}}</h1>
+<p><a href="har">Download as HAR</a></p>
+{{- if .Requests}}
+<table>
+	<tr><th>Time (UTC)</th><th>Method</th><th>Path</th><th>Status</th><th>Duration</th><th>Size</th><th></th></tr>
+	{{- range .Requests}}
+	<tr>
+		<td>{{time .Time}}</td>
+		<td>{{.Method}}</td>
+		<td><a href="requests/{{.ID}}">{{.URI}}</a></td>
+		<td>{{status .Status}}</td>
+		<td>{{duration .Duration}}</td>
+		<td>{{.ResponseBody.Size}}</td>
+		<td class="muted">{{if .ReplayOf}}replay of #{{.ReplayOf}}{{end}}</td>
+	</tr>
+	{{- end}}
+</table>
+{{- else}}
+<p class="muted">No requests were captured yet. This page is refreshed every few seconds.</p>
+{{- end}}
+</body>
+</html>
+{{end}}
+
+{{define "body"}}
+{{- if .Binary}}
+<p class="muted">{{.Size}} bytes of binary data.</p>
+{{- else if .Text}}
+<pre>{{.Text}}</pre>
+{{- if .Truncated}}<p class="muted">Only the first {{len .Text}} of {{.Size}} bytes were kept.</p>{{end}}
+{{- else}}
+<p class="muted">No body.</p>
+{{- end}}
+{{end}}
+
+{{define "request"}}{{template "header" .}}
+</head>
+<body>
+<p><a href="../">&larr; All requests</a></p>
+<h1>#{{.Request.ID}} {{.Request.Method}} {{.Request.URI}}</h1>
+<p>
+	{{status .Request.Status}} in {{duration .Request.Duration}}, at {{time .Request.Time}} UTC from {{.Request.RemoteAddr}}.
+	{{- if .Request.ReplayOf}} Replay of <a href="{{.Request.ReplayOf}}">#{{.Request.ReplayOf}}</a>.{{end}}
+</p>
+
+<h2>Request</h2>
+<pre>{{.Request.Method}} {{.Request.URI}} {{.Request.Proto}}
+Host: {{.Request.Host}}
+{{headerText .RequestHeader}}</pre>
+{{template "body" .RequestBody}}
+
+<h2>Response</h2>
+{{- if .Request.Status}}
+<pre>{{status .Request.Status}}
+{{headerText .ResponseHeader}}</pre>
+{{template "body" .ResponseBody}}
+{{- else}}
+<p class="muted">No response was sent.</p>
+{{- end}}
+
+<h2>Replay</h2>
+<form method="post" action="{{.Request.ID}}/replay">
+	<p>
+		<input name="method" value="{{.Request.Method}}" size="8">
+		<input name="uri" value="{{.Request.URI}}" size="80">
+	</p>
+	<p>Headers, one per line:</p>
+	<textarea name="headers" rows="10">Host: {{.Request.Host}}
+{{headerText .RequestHeader}}</textarea>
+	{{- if .RequestBody.Editable}}
+	<p>Body:</p>
+	<textarea name="body" rows="10">
+{{.RequestBody.Text}}</textarea>
+	{{- else}}
+	<p class="muted">The body can not be edited, and is sent as it was captured.</p>
+	{{- end}}
+	<p><button type="submit">Replay</button></p>
+</form>
+</body>
+</html>
+{{end}}
+`
@@ -0,0 +1,183 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package httpsrv
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+// visitorBucketsSweepInterval is how often the buckets of visitors that
+// stopped sending requests are dropped.
+const visitorBucketsSweepInterval = time.Minute
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per
+// second. Each request takes a token.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit params.RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   limit.Rate,
+		burst:  float64(limit.Burst),
+		tokens: float64(limit.Burst),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// wait returns how long until a token is available. The bucket must be
+// refilled first.
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// rateLimiter limits the requests accepted by a vhost, from all visitors
+// and from each visitor IP address.
+type rateLimiter struct {
+	tunnel       *tokenBucket
+	visitorLimit params.RateLimit
+	visitors     map[netip.Addr]*tokenBucket
+	lastSweep    time.Time
+
+	mux sync.Mutex
+}
+
+// newRateLimiter returns nil if neither limit is enabled.
+func newRateLimiter(tunnel, visitor params.RateLimit) *rateLimiter {
+	if !tunnel.Enabled() && !visitor.Enabled() {
+		return nil
+	}
+
+	now := time.Now()
+	limiter := &rateLimiter{
+		visitorLimit: visitor,
+		visitors:     map[netip.Addr]*tokenBucket{},
+		lastSweep:    now,
+	}
+	if tunnel.Enabled() {
+		limiter.tunnel = newTokenBucket(tunnel, now)
+	}
+	return limiter
+}
+
+// allow takes a token for a request from addr. If the request must be
+// refused, it returns false and how long the visitor should wait before
+// trying again.
+func (l *rateLimiter) allow(addr netip.Addr) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := time.Now()
+	buckets := make([]*tokenBucket, 0, 2)
+	if l.tunnel != nil {
+		buckets = append(buckets, l.tunnel)
+	}
+	if l.visitorLimit.Enabled() {
+		l.sweepLocked(now)
+		visitor, ok := l.visitors[addr]
+		if !ok {
+			visitor = newTokenBucket(l.visitorLimit, now)
+			l.visitors[addr] = visitor
+		}
+		buckets = append(buckets, visitor)
+	}
+
+	// Tokens are only taken if the request is accepted, so visitors
+	// refused by the limit of the tunnel keep their own tokens.
+	var wait time.Duration
+	for _, bucket := range buckets {
+		bucket.refill(now)
+		wait = max(wait, bucket.wait())
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return true, 0
+}
+
+// sweepLocked drops the buckets of visitors that are full again, as they
+// are no different from new ones. The caller must hold l.mux.
+func (l *rateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < visitorBucketsSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for addr, bucket := range l.visitors {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(l.visitors, addr)
+		}
+	}
+}
+
+// remoteIP returns the IP address of remoteAddr. Requests with an address
+// that can not be parsed share the zero address.
+func remoteIP(remoteAddr string) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
+
+// writeTooManyRequests replies to a visitor that exceeded a limit of the
+// tunnel.
+func writeTooManyRequests(w http.ResponseWriter, hostname string, retryAfter time.Duration) {
+	seconds := max(1, int(math.Ceil(retryAfter.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(tooManyRequestsHTML(hostname))
+}
+
+// logLimited reports a request refused by a limit in the log stream of the
+// tunnel.
+func (v *vhost) logLimited(r *http.Request, reason string) {
+	logMsg := fmt.Sprintf("%s - - %s \"%s %s %s\" 429 %s", remoteIP(r.RemoteAddr),
+		time.Now().UTC().Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, r.URL.Path, r.Proto, reason)
+	v.notify(params.NotifyMessage{
+		MessageType: params.NotifyMessageLog,
+		Payload:     []byte(logMsg),
+	})
+}
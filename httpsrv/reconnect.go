@@ -0,0 +1,68 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package httpsrv
+
+import (
+	"net/http"
+	"time"
+)
+
+// lookupVhost returns the vhost registered for hostname. Requests for a
+// tunnel whose owner lost their connection are held until the owner
+// reconnects, in which case the vhost registered by the new session is
+// returned.
+func (h *HTTPServer) lookupVhost(r *http.Request, hostname string) (*vhost, bool) {
+	val, ok := h.vhosts.Load(hostname)
+	if !ok {
+		return nil, false
+	}
+	v := val.(*vhost)
+	held := v.heldChan()
+	if held == nil {
+		return v, true
+	}
+	if v.private || v.passthrough {
+		return nil, false
+	}
+
+	cfg := h.cfg.Load().Reconnect
+	if v.waiting.Add(1) > int64(cfg.MaxHeld()) {
+		v.waiting.Add(-1)
+		return nil, false
+	}
+	defer v.waiting.Add(-1)
+
+	timer := time.NewTimer(cfg.RequestTimeout())
+	defer timer.Stop()
+	select {
+	case <-held:
+	case <-timer.C:
+		return nil, false
+	case <-r.Context().Done():
+		return nil, false
+	}
+
+	// The vhost is released when the owner reconnects, or when the
+	// grace period ends and the tunnel is gone.
+	val, ok = h.vhosts.Load(hostname)
+	if !ok {
+		return nil, false
+	}
+	v = val.(*vhost)
+	if v.heldChan() != nil {
+		return nil, false
+	}
+	return v, true
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package httpsrv
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errClientHelloPeeked = errors.New("client hello peeked")
+
+// readOnlyConn is a net.Conn that can only be read from. It is used to
+// feed the ClientHello of a connection to crypto/tls without allowing the
+// TLS stack to answer on the real connection.
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekServerName reads the TLS ClientHello from r and returns the server
+// name the client asked for, along with every byte read from r.
+func peekServerName(r io.Reader) (string, []byte, error) {
+	var buf bytes.Buffer
+	var serverName string
+	err := tls.Server(readOnlyConn{reader: io.TeeReader(r, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloPeeked
+		},
+	}).Handshake()
+	if !errors.Is(err, errClientHelloPeeked) {
+		return "", buf.Bytes(), err
+	}
+	return strings.ToLower(serverName), buf.Bytes(), nil
+}
+
+// peekedConn replays the bytes consumed while peeking at the ClientHello
+// before reading from the underlying connection.
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func newPeekedConn(conn net.Conn, peeked []byte) *peekedConn {
+	return &peekedConn{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(peeked), conn),
+	}
+}
+
+// sniListener wraps the TLS listener of the reverse proxy. It peeks at the
+// ClientHello of every incoming connection and splices connections meant
+// for passthrough tunnels straight into the tunnel. All other connections
+// are returned by Accept, for the HTTP server to terminate TLS as usual.
+type sniListener struct {
+	net.Listener
+
+	lookup func(serverName string) (*vhost, bool)
+	splice func(target *vhost, conn net.Conn)
+	conns  chan net.Conn
+	quit   chan struct{}
+	once   sync.Once
+}
+
+func newSNIListener(ln net.Listener, lookup func(serverName string) (*vhost, bool), splice func(target *vhost, conn net.Conn)) *sniListener {
+	l := &sniListener{
+		Listener: ln,
+		lookup:   lookup,
+		splice:   splice,
+		conns:    make(chan net.Conn),
+		quit:     make(chan struct{}),
+	}
+	go l.loop()
+	return l
+}
+
+func (l *sniListener) loop() {
+	defer l.Close()
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("failed to accept TLS connection: %s", err)
+			}
+			return
+		}
+		go l.handleConn(conn)
+	}
+}
+
+func (l *sniListener) handleConn(conn net.Conn) {
+	// Do not let clients hold the connection open without ever sending
+	// a ClientHello.
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	serverName, peeked, err := peekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	wrapped := newPeekedConn(conn, peeked)
+	if err == nil {
+		if target, ok := l.lookup(serverName); ok && target.passthrough {
+			l.splice(target, wrapped)
+			return
+		}
+	}
+
+	// Anything we could not route, including connections that are not
+	// TLS at all, is handed to the HTTP server to deal with.
+	select {
+	case l.conns <- wrapped:
+	case <-l.quit:
+		conn.Close()
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.quit:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sniListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.quit)
+		err = l.Listener.Close()
+	})
+	return err
+}
@@ -40,6 +40,76 @@ var badRequestTemplate = `
 </html>
 `
 
+var blockedTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+	<title>Error 403 - {{.Hostname}}</title>
+	<style>
+		.center {
+			text-align: center;
+		}
+    </style>
+
+</head>
+
+<body>
+<div class="center">
+        <h1>Error 403 - Access Denied</h1>
+        <p>Visitors from your network or location are not allowed to reach {{.Hostname}}.</p>
+</div>
+</body>
+</html>
+`
+
+var tooManyRequestsTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+	<title>Error 429 - {{.Hostname}}</title>
+	<style>
+		.center {
+			text-align: center;
+		}
+    </style>
+
+</head>
+
+<body>
+<div class="center">
+        <h1>Error 429 - Too Many Requests</h1>
+        <p>{{.Hostname}} is receiving too many requests. Please try again later.</p>
+</div>
+</body>
+</html>
+`
+
+func tooManyRequestsHTML(hostname string) []byte {
+	fallback := []byte("Too Many Requests")
+	tpl, err := template.New("").Parse(tooManyRequestsTemplate)
+	if err != nil {
+		return fallback
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, struct{ Hostname string }{Hostname: hostname}); err != nil {
+		return fallback
+	}
+	return buf.Bytes()
+}
+
+func blockedHTML(hostname string) []byte {
+	fallback := []byte("Access Denied")
+	tpl, err := template.New("").Parse(blockedTemplate)
+	if err != nil {
+		return fallback
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, struct{ Hostname string }{Hostname: hostname}); err != nil {
+		return fallback
+	}
+	return buf.Bytes()
+}
+
 func badRequestHTML(hostname string) []byte {
 	fallback := []byte("Bad Gateway")
 	tpl, err := template.New("").Parse(badRequestTemplate)
@@ -0,0 +1,220 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package httpsrv
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gabriel-samfira/localshow/config"
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+// stickyCookieName is the cookie used to pin visitors of a load balanced
+// tunnel to the same member.
+const stickyCookieName = "localshow_backend"
+
+func newVhost(event params.TunnelEvent, cfg config.HTTPServer, member *proxyTarget, capture *capture) *vhost {
+	return &vhost{
+		subdomain:    event.RequestedSubdomain,
+		passthrough:  event.Passthrough,
+		private:      event.Private,
+		pool:         event.Pool,
+		customDomain: event.CustomDomain,
+		reserved:     event.Reserved,
+		options:      event.Options,
+		strategy:     cfg.PoolStrategy,
+		sticky:       cfg.PoolStickySessions,
+		members:      []*proxyTarget{member},
+		limiter:      newRateLimiter(event.Options.RateLimit, event.Options.VisitorRateLimit),
+		capture:      capture,
+	}
+}
+
+// vhost holds the tunnels registered for a hostname. Regular tunnels have a
+// single member. Load balanced (pool) tunnels may have several members,
+// between which visitors are balanced. The options of a pool are the ones
+// set by its first member.
+type vhost struct {
+	subdomain   string
+	passthrough bool
+	private     bool
+	pool        bool
+	// customDomain is set if the vhost is served on a custom domain, and
+	// reserved if its subdomain is reserved for the key of its owner.
+	customDomain bool
+	reserved     bool
+	options      params.TunnelOptions
+	strategy     string
+	sticky       bool
+
+	members []*proxyTarget
+	next    int
+	mux     sync.Mutex
+
+	// blocked is the number of visitors refused by the visitor filters.
+	blocked atomic.Int64
+	// limiter is nil if the requests of the vhost are not rate limited.
+	limiter *rateLimiter
+	// capture is nil unless the owner enabled request capture.
+	capture *capture
+
+	// held is set once the owner of the tunnel lost their connection.
+	// It is closed when they reconnect and a new vhost replaces this
+	// one, or when the grace period ends.
+	held chan struct{}
+	// waiting is the number of requests held until the owner reconnects.
+	waiting atomic.Int64
+}
+
+// hold marks the vhost as waiting for its owner to reconnect.
+func (v *vhost) hold() {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if v.held == nil {
+		v.held = make(chan struct{})
+	}
+}
+
+// heldChan returns the channel that is closed once the vhost is released,
+// or nil if the vhost is not held.
+func (v *vhost) heldChan() chan struct{} {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	return v.held
+}
+
+// release wakes up the requests held for the vhost.
+func (v *vhost) release() {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if v.held == nil {
+		return
+	}
+	select {
+	case <-v.held:
+	default:
+		close(v.held)
+	}
+}
+
+func (v *vhost) addMember(member *proxyTarget) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	v.members = append(v.members, member)
+}
+
+// removeMember ejects the member with the given tunnel ID. It returns true
+// if no members are left.
+func (v *vhost) removeMember(tunnelID string) bool {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	for idx, member := range v.members {
+		if member.tunnelID == tunnelID {
+			v.members = append(v.members[:idx], v.members[idx+1:]...)
+			break
+		}
+	}
+	return len(v.members) == 0
+}
+
+// pickLocked returns the next member according to the balancing strategy.
+// The caller must hold v.mux.
+func (v *vhost) pickLocked() *proxyTarget {
+	if len(v.members) == 0 {
+		return nil
+	}
+
+	if v.strategy == config.PoolStrategyLeastConnections {
+		picked := v.members[0]
+		for _, member := range v.members[1:] {
+			if member.active.Load() < picked.active.Load() {
+				picked = member
+			}
+		}
+		return picked
+	}
+
+	v.next = (v.next + 1) % len(v.members)
+	return v.members[v.next]
+}
+
+// pick returns the member that should handle r. When sticky sessions are
+// enabled for a pool, the member recorded in the visitor's cookie is
+// preferred and the cookie is set on w if a different member was picked.
+func (v *vhost) pick(w http.ResponseWriter, r *http.Request) *proxyTarget {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if !v.pool || !v.sticky {
+		return v.pickLocked()
+	}
+
+	if cookie, err := r.Cookie(stickyCookieName); err == nil {
+		for _, member := range v.members {
+			if member.id == cookie.Value {
+				return member
+			}
+		}
+	}
+
+	member := v.pickLocked()
+	if member != nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:     stickyCookieName,
+			Value:    member.id,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return member
+}
+
+// notify sends msg to the log stream of all members, without blocking.
+func (v *vhost) notify(msg params.NotifyMessage) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	for _, member := range v.members {
+		if member.msgChan == nil {
+			continue
+		}
+		select {
+		case member.msgChan <- msg:
+		default:
+		}
+	}
+}
+
+// splice hands a raw visitor connection to one of the members.
+func (v *vhost) splice(conn net.Conn) {
+	v.mux.Lock()
+	member := v.pickLocked()
+	v.mux.Unlock()
+
+	if member == nil {
+		conn.Close()
+		return
+	}
+	member.splice(conn)
+}
@@ -14,7 +14,18 @@
 
 package params
 
-import "encoding/json"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type EventType string
 type NotifyMessageType string
@@ -28,28 +39,459 @@ const (
 	NotifyMessageLog NotifyMessageType = "log"
 	NotifyMessageURL NotifyMessageType = "url"
 	NofityMessageRaw NotifyMessageType = "raw"
+	// NotifyMessageWarning messages are shown to the client even if
+	// logging is disabled.
+	NotifyMessageWarning NotifyMessageType = "warning"
 )
 
+const (
+	// LogFormatCombined is the Apache combined log format, followed by
+	// the size of the request body, the latencies and the TLS version.
+	LogFormatCombined = "combined"
+	// LogFormatJSON logs each request as a JSON object.
+	LogFormatJSON = "json"
+)
+
+// TunnelDialer opens a connection to the client of a tunnel, over the SSH
+// connection the tunnel was registered on. Origin is the address of the
+// visitor the connection is opened for, and may be nil.
+type TunnelDialer func(ctx context.Context, origin net.Addr) (net.Conn, error)
+
 type TunnelEvent struct {
-	EventType          EventType
-	NotifyChan         chan NotifyMessage
-	ErrorChan          chan error
-	BindAddr           string
+	EventType  EventType
+	NotifyChan chan NotifyMessage
+	ErrorChan  chan error
+	// TunnelID identifies the tunnel among the members of a pool.
+	TunnelID string
+	// Dial opens a connection to the client of the tunnel. It is only
+	// set on TunnelReady events.
+	Dial TunnelDialer
+	// Admit returns an error if new visitors of the tunnel are refused,
+	// like once the transfer quota of its owner is exhausted. Requests
+	// may reuse connections dialed earlier, so it is checked for each
+	// request. It is only set on TunnelReady events.
+	Admit              func() error
 	RequestedPort      uint32
 	RequestedSubdomain string
+	// Passthrough marks tunnels that receive the raw TLS stream of
+	// visitors, routed by SNI.
+	Passthrough bool
+	// Private tunnels are only reachable over SSH local forwarding.
+	Private bool
+	// Pool tunnels share their subdomain with other pool tunnels
+	// registered by the same key.
+	Pool bool
+	// CustomDomain is set if RequestedSubdomain is a verified custom
+	// domain, rather than a subdomain of the domain of the server.
+	CustomDomain bool
+	// Reserved is set if RequestedSubdomain is reserved for the key of
+	// the owner.
+	Reserved bool
+	// Held is set on TunnelClosed events when the connection of the
+	// owner was lost, and the subdomain is kept until they reconnect or
+	// the grace period ends.
+	Held bool
+	// Options are the options set by the client for this tunnel.
+	Options TunnelOptions
+}
+
+// TunnelOptions are set by clients when connecting, through SSH env
+// requests or on the command line.
+type TunnelOptions struct {
+	// BasicAuthUser and BasicAuthPassword are the credentials visitors
+	// must provide through HTTP basic auth.
+	BasicAuthUser     string `json:"basic_auth_user,omitempty"`
+	BasicAuthPassword string `json:"-"`
+	// Token is accepted from visitors as a bearer token, or through
+	// the localshow_token query parameter.
+	Token string `json:"-"`
+	// VisitorFilter restricts the visitors of the tunnel by IP address
+	// and country.
+	VisitorFilter
+	// HostHeader replaces the Host header of requests sent to the
+	// tunnel.
+	HostHeader string `json:"host_header,omitempty"`
+	// TTL is the time after which the tunnel is closed.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// Inspect sends the headers of requests and responses to the log
+	// stream of the tunnel.
+	Inspect bool `json:"inspect,omitempty"`
+	// Capture keeps the recent requests of the tunnel, which the owner
+	// may look at and replay using the request inspector.
+	Capture bool `json:"capture,omitempty"`
+	// RateLimit limits the requests accepted by the tunnel from all
+	// visitors. VisitorRateLimit limits the requests accepted from a
+	// single visitor IP address.
+	RateLimit        RateLimit `json:"rate_limit,omitzero"`
+	VisitorRateLimit RateLimit `json:"visitor_rate_limit,omitzero"`
+	// MaxConcurrent is the number of requests each member of the tunnel
+	// handles at the same time.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	// LogFormat is the format of the request logs sent to the owner of
+	// the tunnel. Defaults to LogFormatCombined.
+	LogFormat string `json:"log_format,omitempty"`
+}
+
+// HasCredentials returns true if the owner of the tunnel requires visitors
+// to authenticate.
+func (o TunnelOptions) HasCredentials() bool {
+	return o.BasicAuthUser != "" || o.Token != ""
+}
+
+// Summary returns a short, human readable description of the options
+// that are set.
+func (o TunnelOptions) Summary() string {
+	var ret []string
+	if o.BasicAuthUser != "" {
+		ret = append(ret, fmt.Sprintf("basic auth (user %s)", o.BasicAuthUser))
+	}
+	if o.Token != "" {
+		ret = append(ret, "token auth")
+	}
+	if len(o.AllowedCIDRs) > 0 {
+		ret = append(ret, fmt.Sprintf("allowed from %s", joinPrefixes(o.AllowedCIDRs)))
+	}
+	if len(o.DeniedCIDRs) > 0 {
+		ret = append(ret, fmt.Sprintf("denied from %s", joinPrefixes(o.DeniedCIDRs)))
+	}
+	if len(o.AllowedCountries) > 0 {
+		ret = append(ret, fmt.Sprintf("allowed countries %s", strings.Join(o.AllowedCountries, ", ")))
+	}
+	if len(o.DeniedCountries) > 0 {
+		ret = append(ret, fmt.Sprintf("denied countries %s", strings.Join(o.DeniedCountries, ", ")))
+	}
+	if o.HostHeader != "" {
+		ret = append(ret, fmt.Sprintf("host header %s", o.HostHeader))
+	}
+	if o.TTL > 0 {
+		ret = append(ret, fmt.Sprintf("expires in %s", o.TTL))
+	}
+	if o.Inspect {
+		ret = append(ret, "request inspection")
+	}
+	if o.Capture {
+		ret = append(ret, "request capture")
+	}
+	if o.RateLimit.Enabled() {
+		ret = append(ret, fmt.Sprintf("rate limit %s", o.RateLimit))
+	}
+	if o.VisitorRateLimit.Enabled() {
+		ret = append(ret, fmt.Sprintf("visitor rate limit %s", o.VisitorRateLimit))
+	}
+	if o.MaxConcurrent > 0 {
+		ret = append(ret, fmt.Sprintf("max %d concurrent requests", o.MaxConcurrent))
+	}
+	if o.LogFormat != "" && o.LogFormat != LogFormatCombined {
+		ret = append(ret, fmt.Sprintf("%s logs", o.LogFormat))
+	}
+	return strings.Join(ret, "; ")
+}
+
+// RateLimit is a token bucket limit. Rate is the number of requests
+// accepted per second, and Burst the number of requests that may be
+// accepted at once. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+// Enabled returns true if the limit applies.
+func (r RateLimit) Enabled() bool {
+	return r.Rate > 0
+}
+
+// Tighten returns the strictest of the limits set in r and other. When
+// neither sets a burst, it defaults to the rate, rounded up.
+func (r RateLimit) Tighten(other RateLimit) RateLimit {
+	ret := RateLimit{
+		Rate:  minNonZero(r.Rate, other.Rate),
+		Burst: minNonZero(r.Burst, other.Burst),
+	}
+	if !ret.Enabled() {
+		return RateLimit{}
+	}
+	if ret.Burst == 0 {
+		ret.Burst = max(1, int(math.Ceil(ret.Rate)))
+	}
+	return ret
+}
+
+func (r RateLimit) String() string {
+	return fmt.Sprintf("%s req/s (burst %d)", strconv.FormatFloat(r.Rate, 'f', -1, 64), r.Burst)
+}
+
+// minNonZero returns the lowest of a and b, ignoring values that are not
+// set.
+func minNonZero[T int | float64](a, b T) T {
+	switch {
+	case a <= 0:
+		return max(b, 0)
+	case b <= 0:
+		return a
+	default:
+		return min(a, b)
+	}
+}
+
+func joinPrefixes(prefixes []netip.Prefix) string {
+	ret := make([]string, len(prefixes))
+	for idx, prefix := range prefixes {
+		ret[idx] = prefix.String()
+	}
+	return strings.Join(ret, ", ")
+}
+
+// VisitorFilter restricts visitors by IP address and by country. Empty
+// allow lists allow everyone. Deny lists take precedence over allow lists.
+type VisitorFilter struct {
+	AllowedCIDRs []netip.Prefix `json:"allowed_cidrs,omitempty"`
+	DeniedCIDRs  []netip.Prefix `json:"denied_cidrs,omitempty"`
+	// AllowedCountries and DeniedCountries hold ISO 3166-1 alpha-2
+	// country codes.
+	AllowedCountries []string `json:"allowed_countries,omitempty"`
+	DeniedCountries  []string `json:"denied_countries,omitempty"`
+}
+
+// UsesCountries returns true if the filter needs the country of visitors.
+func (f VisitorFilter) UsesCountries() bool {
+	return len(f.AllowedCountries) > 0 || len(f.DeniedCountries) > 0
+}
+
+// Check returns an error describing why a visitor from addr, located in
+// country, is blocked. Country is empty if it is not known.
+func (f VisitorFilter) Check(addr netip.Addr, country string) error {
+	addr = addr.Unmap()
+	for _, cidr := range f.DeniedCIDRs {
+		if cidr.Contains(addr) {
+			return fmt.Errorf("address %s is denied", addr)
+		}
+	}
+	if len(f.AllowedCIDRs) > 0 && !slices.ContainsFunc(f.AllowedCIDRs, func(cidr netip.Prefix) bool {
+		return cidr.Contains(addr)
+	}) {
+		return fmt.Errorf("address %s is not allowed", addr)
+	}
+
+	if country != "" && slices.Contains(f.DeniedCountries, country) {
+		return fmt.Errorf("country %s is denied", country)
+	}
+	if len(f.AllowedCountries) > 0 && !slices.Contains(f.AllowedCountries, country) {
+		if country == "" {
+			return fmt.Errorf("country of %s is unknown", addr)
+		}
+		return fmt.Errorf("country %s is not allowed", country)
+	}
+	return nil
+}
+
+// AccessLogEntry describes a request proxied to a tunnel, once the
+// response was sent.
+type AccessLogEntry struct {
+	Time time.Time `json:"time"`
+	Host string    `json:"host"`
+	// RemoteIP is the address of the visitor.
+	RemoteIP   string `json:"remote_ip"`
+	Method     string `json:"method"`
+	URI        string `json:"uri"`
+	Proto      string `json:"proto"`
+	TLSVersion string `json:"tls_version,omitempty"`
+	Status     int    `json:"status"`
+	// BytesIn is the size of the request body, and BytesOut the size of
+	// the response body.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// Upstream is the time the tunnel took to send the response
+	// headers, and Duration the time it took to handle the request.
+	Upstream  time.Duration `json:"upstream"`
+	Duration  time.Duration `json:"duration"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+}
+
+// Format returns the entry in the given log format.
+func (a AccessLogEntry) Format(format string) []byte {
+	if format == LogFormatJSON {
+		line, err := json.Marshal(a)
+		if err == nil {
+			return line
+		}
+	}
+	return []byte(a.Combined())
+}
+
+// Combined returns the entry in the Apache combined log format, followed
+// by the size of the request body, the latencies and the TLS version.
+func (a AccessLogEntry) Combined() string {
+	bytesOut := "-"
+	if a.BytesOut > 0 {
+		bytesOut = strconv.FormatInt(a.BytesOut, 10)
+	}
+	tlsVersion := "-"
+	if a.TLSVersion != "" {
+		tlsVersion = strings.ReplaceAll(a.TLSVersion, " ", "")
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\" in=%d upstream=%dus time=%dus tls=%s",
+		a.RemoteIP, a.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		a.Method, escapeLogField(a.URI), a.Proto, a.Status, bytesOut,
+		escapeLogField(orDash(a.Referer)), escapeLogField(orDash(a.UserAgent)),
+		a.BytesIn, a.Upstream.Microseconds(), a.Duration.Microseconds(), tlsVersion)
+}
+
+// escapeLogField escapes the quotes and control characters in a field of
+// a log line sent by a visitor.
+func escapeLogField(val string) string {
+	quoted := strconv.Quote(val)
+	return quoted[1 : len(quoted)-1]
+}
+
+func orDash(val string) string {
+	if val == "" {
+		return "-"
+	}
+	return val
 }
 
 type URLs struct {
 	HTTP  string `json:"http"`
 	HTTPS string `json:"https"`
+	TCP   string `json:"tcp,omitempty"`
+	// SSH holds the command used to reach a private tunnel.
+	SSH string `json:"ssh,omitempty"`
+	// Inspector is the address of the request inspector of the tunnel.
+	// It is only set if request capture is enabled.
+	Inspector string `json:"inspector,omitempty"`
+	// Options is a summary of the options set for the tunnel.
+	Options string `json:"options,omitempty"`
+}
+
+// Warning is sent in place of the text of a NotifyMessageWarning to clients
+// that asked for JSON output.
+type Warning struct {
+	Warning string `json:"warning"`
 }
 
 type NotifyMessage struct {
 	MessageType NotifyMessageType
-	Payload     json.RawMessage
+	// TunnelID identifies the tunnel a NotifyMessageURL message is about.
+	TunnelID string
+	Payload  json.RawMessage
 }
 
 type Datapoint struct {
 	Name  string `json:"name"`
 	Count int64  `json:"count"`
 }
+
+// TransferUsage is the traffic of the tunnels of a key during a month.
+type TransferUsage struct {
+	Fingerprint string `json:"fingerprint"`
+	Month       string `json:"month"`
+	// BytesIn is the traffic sent by visitors, and BytesOut the traffic
+	// sent back to them.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// Quota is the monthly transfer quota of the key. Zero means no
+	// limit.
+	Quota int64 `json:"quota,omitempty"`
+}
+
+// Total returns the traffic in both directions.
+func (u TransferUsage) Total() int64 {
+	return u.BytesIn + u.BytesOut
+}
+
+// QuotaExhausted returns true if the key may not transfer any more traffic
+// this month.
+func (u TransferUsage) QuotaExhausted() bool {
+	return u.Quota > 0 && u.Total() >= u.Quota
+}
+
+// TransferQuota is the monthly transfer quota set for a key.
+type TransferQuota struct {
+	Fingerprint  string `json:"fingerprint"`
+	MonthlyBytes int64  `json:"monthly_bytes"`
+}
+
+type Reservation struct {
+	Pattern      string   `json:"pattern"`
+	Fingerprints []string `json:"fingerprints"`
+}
+
+const (
+	// CustomDomainTXTPrefix is prefixed to a custom domain to get the
+	// name of the TXT record holding its verification token.
+	CustomDomainTXTPrefix = "_localshow-challenge."
+)
+
+// CustomDomain is a hostname outside of the domain of the server, owned by
+// a key. Tunnels may only use it once it is verified.
+type CustomDomain struct {
+	Hostname    string `json:"hostname"`
+	Fingerprint string `json:"fingerprint"`
+	// Token is the value the owner publishes to prove they control
+	// the hostname.
+	Token      string     `json:"token"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+}
+
+// Verified returns true if the ownership of the hostname was verified.
+func (d CustomDomain) Verified() bool {
+	return d.VerifiedAt != nil
+}
+
+// Tunnel describes a tunnel, as listed by the "list" command.
+type Tunnel struct {
+	Type string `json:"type"`
+	// Subdomain is empty for raw TCP tunnels.
+	Subdomain string `json:"subdomain,omitempty"`
+	// Port is the port requested by the client. For raw TCP tunnels,
+	// this is the public port of the tunnel.
+	Port        uint32    `json:"port"`
+	URL         string    `json:"url"`
+	Passthrough bool      `json:"passthrough"`
+	Private     bool      `json:"private"`
+	Pool        bool      `json:"pool"`
+	CreatedAt   time.Time `json:"created_at"`
+	// BytesIn is the traffic sent by visitors to the tunnel, and
+	// BytesOut the traffic sent back to them.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// SessionStatus is returned by the "status" command.
+type SessionStatus struct {
+	Version     string `json:"version"`
+	User        string `json:"user"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	RemoteAddr  string `json:"remote_addr"`
+	Tunnels     int    `json:"tunnels"`
+	MaxTunnels  int    `json:"max_tunnels"`
+	// Transfer is the traffic of the key during the current month. It
+	// is not set for anonymous users.
+	Transfer *TransferUsage `json:"transfer,omitempty"`
+}
+
+const (
+	// CertificateSourceFile is the source of certificates loaded from the
+	// tls section of the config.
+	CertificateSourceFile = "file"
+	// CertificateSourceCustomDomain is the source of certificates loaded
+	// from the certificates dir of custom domains.
+	CertificateSourceCustomDomain = "custom_domain"
+	// CertificateSourceACME is the source of certificates obtained using
+	// ACME.
+	CertificateSourceACME = "acme"
+)
+
+// CertificateStatus describes a TLS certificate served by the server.
+type CertificateStatus struct {
+	Source    string    `json:"source"`
+	Names     []string  `json:"names"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	// ExpiresSoon is set once the certificate is within the expiry
+	// warning window.
+	ExpiresSoon bool `json:"expires_soon"`
+	Expired     bool `json:"expired"`
+}
@@ -0,0 +1,180 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// headerTimeout is how long trusted sources have to send the header.
+	headerTimeout = 10 * time.Second
+	// maxPendingHeaders is the number of connections that may wait for
+	// their header at once. Further connections of trusted sources are
+	// accepted once one of them is done.
+	maxPendingHeaders = 256
+	// maxAcceptDelay is the longest time to wait before accepting again,
+	// after Accept failed.
+	maxAcceptDelay = time.Second
+)
+
+// Conn is a connection accepted from a trusted source. Its remote address
+// is the one of the client, as sent in the PROXY protocol header.
+type Conn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the address of the client.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// ProxyAddr returns the address of the load balancer the connection came
+// through.
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// Listener reads the PROXY protocol header of connections accepted from
+// trusted sources. Connections from other sources are returned as they
+// are. Headers are read in the background, so slow clients do not hold up
+// Accept.
+type Listener struct {
+	net.Listener
+
+	trusted func(addr net.Addr) bool
+	conns   chan net.Conn
+	// pending limits the connections waiting for their header.
+	pending chan struct{}
+	quit    chan struct{}
+	once    sync.Once
+}
+
+// NewListener wraps ln. The trusted function is called for every accepted
+// connection, and returns true if the header must be read from it.
+func NewListener(ln net.Listener, trusted func(addr net.Addr) bool) *Listener {
+	l := &Listener{
+		Listener: ln,
+		trusted:  trusted,
+		conns:    make(chan net.Conn),
+		pending:  make(chan struct{}, maxPendingHeaders),
+		quit:     make(chan struct{}),
+	}
+	go l.loop()
+	return l
+}
+
+func (l *Listener) loop() {
+	defer l.Close()
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Errors like running out of file descriptors go away
+			// once connections are closed, so accepting is retried
+			// like net/http does.
+			delay = min(max(2*delay, 5*time.Millisecond), maxAcceptDelay)
+			log.Printf("failed to accept connection: %s; retrying in %s", err, delay)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-l.quit:
+				return
+			}
+		}
+		delay = 0
+
+		if !l.trusted(conn.RemoteAddr()) {
+			go l.deliver(conn)
+			continue
+		}
+		select {
+		case l.pending <- struct{}{}:
+		case <-l.quit:
+			conn.Close()
+			return
+		}
+		go func() {
+			conn, ok := l.readHeader(conn)
+			<-l.pending
+			if ok {
+				l.deliver(conn)
+			}
+		}()
+	}
+}
+
+// readHeader reads the header of a connection from a trusted source. The
+// connection is closed if the header is invalid.
+func (l *Listener) readHeader(conn net.Conn) (net.Conn, bool) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	addr, err := ReadHeader(reader)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Printf("rejecting connection from %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return nil, false
+	}
+	if addr == nil {
+		addr = conn.RemoteAddr()
+	}
+	return &Conn{
+		Conn:       conn,
+		reader:     reader,
+		remoteAddr: addr,
+	}, true
+}
+
+// deliver hands conn to Accept.
+func (l *Listener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.quit:
+		conn.Close()
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.quit:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.quit)
+		err = l.Listener.Close()
+	})
+	return err
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+// Package proxyproto parses the PROXY protocol header sent by load
+// balancers in front of the listeners of localshow, so the address of the
+// real client is reported as the remote address of connections.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	// signatureV2 starts every PROXY protocol v2 header.
+	signatureV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	// prefixV1 starts every PROXY protocol v1 header.
+	prefixV1 = []byte("PROXY ")
+
+	errNoHeader = errors.New("missing PROXY protocol header")
+)
+
+const (
+	// maxV1HeaderLen is the longest v1 header allowed by the spec,
+	// including the trailing CRLF.
+	maxV1HeaderLen = 107
+
+	v2CmdLocal    = 0x0
+	v2CmdProxy    = 0x1
+	v2FamInet     = 0x1
+	v2FamInet6    = 0x2
+	v2Unspec      = 0x00
+	v2TransStream = 0x1
+	v2AddrLen4    = 12
+	v2AddrLen6    = 36
+	v2HeaderLen   = 16
+)
+
+// ReadHeader reads the PROXY protocol header from r. It returns the source
+// address the header carries, or nil if the header does not carry one,
+// like for the health checks of the load balancer.
+func ReadHeader(r *bufio.Reader) (net.Addr, error) {
+	peeked, err := r.Peek(len(prefixV1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if bytes.Equal(peeked, prefixV1) {
+		return readV1(r)
+	}
+
+	peeked, err = r.Peek(len(signatureV2))
+	if err != nil {
+		return nil, errNoHeader
+	}
+	if bytes.Equal(peeked, signatureV2) {
+		return readV2(r)
+	}
+	return nil, errNoHeader
+}
+
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= maxV1HeaderLen {
+			return nil, fmt.Errorf("header is too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("header does not end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid header %q", line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid header %q", line)
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid source address %q", fields[2])
+	}
+	if addr.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("source address %q does not match %s", fields[2], fields[1])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %q", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var header [v2HeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if header[12]>>4 != 0x2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	switch header[12] & 0xf {
+	case v2CmdLocal:
+		return nil, nil
+	case v2CmdProxy:
+	default:
+		return nil, fmt.Errorf("unsupported command %d", header[12]&0xf)
+	}
+
+	// The listener only accepts TCP, so the addresses of datagram
+	// transports can not describe the connection. A fully unspecified
+	// protocol carries no address, and the real one is used.
+	if header[13] != v2Unspec && header[13]&0xf != v2TransStream {
+		return nil, fmt.Errorf("unsupported transport protocol %d", header[13]&0xf)
+	}
+
+	// Only TCP over IPv4 and IPv6 carries an address we can use. The
+	// TLVs following the addresses are ignored.
+	switch header[13] >> 4 {
+	case v2FamInet:
+		if len(payload) < v2AddrLen4 {
+			return nil, fmt.Errorf("address block is too short")
+		}
+		addr := netip.AddrFrom4([4]byte(payload[0:4]))
+		port := binary.BigEndian.Uint16(payload[8:10])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+	case v2FamInet6:
+		if len(payload) < v2AddrLen6 {
+			return nil, fmt.Errorf("address block is too short")
+		}
+		addr := netip.AddrFrom16([16]byte(payload[0:16])).Unmap()
+		port := binary.BigEndian.Uint16(payload[32:34])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,488 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package sshsrv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gabriel-samfira/localshow/config"
+	"github.com/gabriel-samfira/localshow/database"
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+const (
+	// usageFlushInterval is how often the traffic of keys is recorded in
+	// the database. Quotas changed in the database are picked up at the
+	// same interval.
+	usageFlushInterval = 30 * time.Second
+
+	// quotaWarningPercent is the share of the monthly transfer quota
+	// after which the owner of a key is warned.
+	quotaWarningPercent = 90
+)
+
+func currentMonth() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+// trafficCounter counts the traffic of a tunnel or of a channel. In is the
+// traffic sent by visitors, and out the traffic sent back to them.
+type trafficCounter struct {
+	in  atomic.Int64
+	out atomic.Int64
+}
+
+func (t *trafficCounter) add(in, out int64) {
+	t.in.Add(in)
+	t.out.Add(out)
+}
+
+// byteLimiter shapes traffic to a number of bytes per second. Up to one
+// second worth of traffic may be sent at once.
+type byteLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	mux sync.Mutex
+}
+
+// newByteLimiter returns nil if rate is zero.
+func newByteLimiter(rate config.ByteSize) *byteLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &byteLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes may be sent.
+func (l *byteLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mux.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	// Writers that go over the limit leave the bucket in debt, which
+	// later writers wait for as well.
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mux.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// meteredWriter shapes and accounts the traffic written to w.
+type meteredWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *byteLimiter
+	account func(n int64)
+}
+
+func (m *meteredWriter) Write(p []byte) (int, error) {
+	if err := m.limiter.wait(m.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	n, err := m.w.Write(p)
+	if n > 0 {
+		m.account(int64(n))
+	}
+	return n, err
+}
+
+// meteredReader shapes and accounts the traffic read from r.
+type meteredReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *byteLimiter
+	account func(n int64)
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	if n > 0 {
+		m.account(int64(n))
+		if waitErr := m.limiter.wait(m.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// keyUsage is the traffic of a key during a month.
+type keyUsage struct {
+	usage params.TransferUsage
+	// pendingIn and pendingOut are not recorded in the database yet.
+	pendingIn  int64
+	pendingOut int64
+	// warned and exhausted are set once the owner of the key was
+	// notified, and refused once they were told that visitors are
+	// refused.
+	warned    bool
+	exhausted bool
+	refused   bool
+}
+
+func (k *keyUsage) overWarning() bool {
+	return k.usage.Quota > 0 && k.usage.Total()*100 >= k.usage.Quota*quotaWarningPercent
+}
+
+// resetNotices marks the notices that no longer need to be sent, after the
+// usage was loaded or the quota changed.
+func (k *keyUsage) resetNotices() {
+	k.warned = k.overWarning()
+	k.exhausted = k.usage.QuotaExhausted()
+	k.refused = false
+}
+
+// usageTracker accounts the traffic of the tunnels of each key during the
+// current month, and records it in the database.
+type usageTracker struct {
+	dbConn    *database.SQLDatabase
+	appConfig *atomic.Pointer[config.Config]
+	keys      map[string]*keyUsage
+
+	mux sync.Mutex
+}
+
+func newUsageTracker(dbConn *database.SQLDatabase, appConfig *atomic.Pointer[config.Config]) *usageTracker {
+	return &usageTracker{
+		dbConn:    dbConn,
+		appConfig: appConfig,
+		keys:      map[string]*keyUsage{},
+	}
+}
+
+// quota returns the monthly transfer quota of the key identified by
+// fingerprint.
+func (u *usageTracker) quota(fingerprint string) (int64, error) {
+	quota, ok, err := u.dbConn.GetTransferQuota(fingerprint)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get transfer quota: %w", err)
+	}
+	if !ok {
+		quota = int64(u.appConfig.Load().Bandwidth.MonthlyQuota)
+	}
+	return quota, nil
+}
+
+// get returns the usage of the key identified by fingerprint, loading it
+// from the database on first use. The caller must not hold u.mux.
+func (u *usageTracker) get(fingerprint string) (*keyUsage, error) {
+	u.mux.Lock()
+	ku, ok := u.keys[fingerprint]
+	u.mux.Unlock()
+	if ok {
+		return ku, nil
+	}
+
+	usage, err := u.dbConn.GetTransferUsage(fingerprint, currentMonth())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfer usage: %w", err)
+	}
+	usage.Quota, err = u.quota(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if ku, ok := u.keys[fingerprint]; ok {
+		return ku, nil
+	}
+	ku = &keyUsage{usage: usage}
+	ku.resetNotices()
+	u.keys[fingerprint] = ku
+	return ku, nil
+}
+
+// usage returns the traffic of the key identified by fingerprint during
+// the current month.
+func (u *usageTracker) usage(fingerprint string) (params.TransferUsage, error) {
+	ku, err := u.get(fingerprint)
+	if err != nil {
+		return params.TransferUsage{}, err
+	}
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	return ku.usage, nil
+}
+
+// add accounts traffic of the key identified by fingerprint. It returns a
+// notice for the owner of the key if the traffic crossed the warning
+// threshold or exhausted the quota of the key.
+func (u *usageTracker) add(fingerprint string, in, out int64) (string, error) {
+	ku, err := u.get(fingerprint)
+	if err != nil {
+		return "", err
+	}
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	// The key may have been dropped by flush at the end of the month.
+	// The traffic is then accounted to the usage of the new month.
+	for u.keys[fingerprint] != ku {
+		u.mux.Unlock()
+		ku, err = u.get(fingerprint)
+		u.mux.Lock()
+		if err != nil {
+			return "", err
+		}
+	}
+	ku.usage.BytesIn += in
+	ku.usage.BytesOut += out
+	ku.pendingIn += in
+	ku.pendingOut += out
+
+	quota := config.ByteSize(ku.usage.Quota)
+	switch {
+	case ku.usage.QuotaExhausted() && !ku.exhausted:
+		ku.exhausted = true
+		ku.warned = true
+		return fmt.Sprintf("The monthly transfer quota of %s of your key is exhausted. New visitors are refused until the end of the month.", quota), nil
+	case ku.overWarning() && !ku.warned:
+		ku.warned = true
+		return fmt.Sprintf("Your key used %s of its monthly transfer quota of %s.", config.ByteSize(ku.usage.Total()), quota), nil
+	}
+	return "", nil
+}
+
+// flush records the pending traffic in the database, and refreshes the
+// quotas of the keys. Keys are dropped once the month is over, and the
+// usage of the new month is loaded on their next use.
+func (u *usageTracker) flush() {
+	u.mux.Lock()
+	fingerprints := make([]string, 0, len(u.keys))
+	for fingerprint := range u.keys {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	u.mux.Unlock()
+
+	month := currentMonth()
+	for _, fingerprint := range fingerprints {
+		u.mux.Lock()
+		ku, ok := u.keys[fingerprint]
+		if !ok {
+			u.mux.Unlock()
+			continue
+		}
+		in, out, usageMonth := ku.pendingIn, ku.pendingOut, ku.usage.Month
+		ku.pendingIn, ku.pendingOut = 0, 0
+		u.mux.Unlock()
+
+		if in > 0 || out > 0 {
+			if err := u.dbConn.AddTransferUsage(fingerprint, usageMonth, in, out); err != nil {
+				log.Printf("failed to record transfer usage of %s: %s", fingerprint, err)
+				u.mux.Lock()
+				ku.pendingIn += in
+				ku.pendingOut += out
+				u.mux.Unlock()
+				continue
+			}
+		}
+		if usageMonth != month {
+			// The key is dropped once all its traffic of the past
+			// month is recorded. Traffic accounted in the meantime
+			// is recorded by the next flush.
+			u.mux.Lock()
+			if u.keys[fingerprint] == ku && ku.pendingIn == 0 && ku.pendingOut == 0 {
+				delete(u.keys, fingerprint)
+			}
+			u.mux.Unlock()
+			continue
+		}
+
+		quota, err := u.quota(fingerprint)
+		if err != nil {
+			log.Printf("failed to refresh quota of %s: %s", fingerprint, err)
+			continue
+		}
+		u.mux.Lock()
+		if ku.usage.Quota != quota {
+			ku.usage.Quota = quota
+			ku.resetNotices()
+		}
+		u.mux.Unlock()
+	}
+}
+
+// flushUsage periodically records the traffic of keys in the database,
+// until the server stops.
+func (s *sshServer) flushUsage() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.usage.flush()
+		case <-s.ctx.Done():
+			s.usage.flush()
+			return
+		case <-s.quit:
+			s.usage.flush()
+			return
+		}
+	}
+}
+
+// accountTraffic accounts traffic of a channel of the tunnel fw, and
+// notifies the owner of the tunnel if the quota of their key is running
+// out.
+func (s *sshServer) accountTraffic(fw *forwarderDetails, channel *trafficCounter, in, out int64) {
+	channel.add(in, out)
+	fw.traffic.add(in, out)
+	if fw.fingerprint == "" {
+		return
+	}
+
+	notice, err := s.usage.add(fw.fingerprint, in, out)
+	if err != nil {
+		log.Printf("failed to account traffic: %s", err)
+		return
+	}
+	if notice != "" {
+		s.notifyKey(fw.fingerprint, notice)
+	}
+}
+
+// meter returns a writer that shapes and accounts the traffic written to
+// w by a channel of the tunnel fw. In is set for the traffic sent by
+// visitors.
+func (s *sshServer) meter(ctx context.Context, w io.Writer, fw *forwarderDetails, channel *trafficCounter, in bool) io.Writer {
+	limiter := fw.shapeOut
+	if in {
+		limiter = fw.shapeIn
+	}
+	return &meteredWriter{
+		ctx:     ctx,
+		w:       w,
+		limiter: limiter,
+		account: func(n int64) {
+			if in {
+				s.accountTraffic(fw, channel, n, 0)
+			} else {
+				s.accountTraffic(fw, channel, 0, n)
+			}
+		},
+	}
+}
+
+// meterReader returns a reader that shapes and accounts the traffic sent
+// by the client of the tunnel fw, read from r by a channel of the tunnel.
+func (s *sshServer) meterReader(ctx context.Context, r io.Reader, fw *forwarderDetails, channel *trafficCounter) io.Reader {
+	return &meteredReader{
+		ctx:     ctx,
+		r:       r,
+		limiter: fw.shapeOut,
+		account: func(n int64) {
+			s.accountTraffic(fw, channel, 0, n)
+		},
+	}
+}
+
+// refuse returns true if the key identified by fingerprint exhausted its
+// monthly transfer quota, so new visitors of its tunnels are refused.
+// Notify is set the first time visitors are refused since the usage was
+// loaded or the quota changed.
+func (u *usageTracker) refuse(fingerprint string) (refused, notify bool, err error) {
+	ku, err := u.get(fingerprint)
+	if err != nil {
+		return false, false, err
+	}
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if !ku.usage.QuotaExhausted() {
+		return false, false, nil
+	}
+	notify = !ku.refused
+	ku.refused = true
+	return true, notify, nil
+}
+
+// checkQuota returns an error if the key that registered fw exhausted its
+// monthly transfer quota. The owner is notified the first time a visitor
+// is refused.
+func (s *sshServer) checkQuota(fw *forwarderDetails) error {
+	if fw.fingerprint == "" {
+		return nil
+	}
+	refused, notify, err := s.usage.refuse(fw.fingerprint)
+	if err != nil {
+		// Visitors are not refused because of database errors.
+		log.Printf("failed to check transfer quota: %s", err)
+		return nil
+	}
+	if !refused {
+		return nil
+	}
+	if notify {
+		s.notifyKey(fw.fingerprint, "Visitors are refused, as the monthly transfer quota of your key is exhausted.")
+	}
+	return fmt.Errorf("monthly transfer quota of %s exhausted", fw.fingerprint)
+}
+
+// notifyKey sends notice to the connections that registered tunnels using
+// the key identified by fingerprint.
+func (s *sshServer) notifyKey(fingerprint, notice string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	notified := map[chan params.NotifyMessage]bool{}
+	for _, fw := range s.forwarders {
+		if fw.fingerprint != fingerprint || notified[fw.msgChan] {
+			continue
+		}
+		notified[fw.msgChan] = true
+		sendNotice(fw.msgChan, notice)
+	}
+}
+
+// sendNotice sends a warning to the client, without blocking.
+func sendNotice(msgChan chan params.NotifyMessage, notice string) {
+	select {
+	case msgChan <- params.NotifyMessage{
+		MessageType: params.NotifyMessageWarning,
+		Payload:     []byte(notice),
+	}:
+	default:
+	}
+}
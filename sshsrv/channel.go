@@ -0,0 +1,141 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package sshsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var errTunnelClosed = errors.New("tunnel closed")
+
+// channelConn is a forwarded-tcpip channel opened to the client of a
+// tunnel, used as a net.Conn. The traffic is shaped and accounted as the
+// traffic of the tunnel, and the channel is closed with the tunnel.
+type channelConn struct {
+	ch       ssh.Channel
+	reader   io.Reader
+	writer   io.Writer
+	sshConn  *ssh.ServerConn
+	origin   string
+	traffic  *trafficCounter
+	stop     func() bool
+	once     sync.Once
+	closeErr error
+}
+
+func (c *channelConn) Read(p []byte) (int, error)  { return c.reader.Read(p) }
+func (c *channelConn) Write(p []byte) (int, error) { return c.writer.Write(p) }
+func (c *channelConn) CloseWrite() error           { return c.ch.CloseWrite() }
+func (c *channelConn) LocalAddr() net.Addr         { return c.sshConn.LocalAddr() }
+func (c *channelConn) RemoteAddr() net.Addr        { return c.sshConn.RemoteAddr() }
+
+// SSH channels have no deadlines. Callers bound the time spent on the
+// connection with the context they dialed it with, or by closing it.
+func (c *channelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *channelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *channelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *channelConn) Close() error {
+	c.once.Do(func() {
+		c.stop()
+		c.closeErr = c.ch.Close()
+		log.Printf("closed channel for %s (%d bytes in, %d bytes out)",
+			c.origin, c.traffic.in.Load(), c.traffic.out.Load())
+	})
+	return c.closeErr
+}
+
+// dialForwarder opens a forwarded-tcpip channel to the client of the tunnel
+// fw, for a visitor connecting from origin.
+func (s *sshServer) dialForwarder(ctx context.Context, fw *forwarderDetails, origin net.Addr) (net.Conn, error) {
+	if fw.ctx.Err() != nil {
+		return nil, errTunnelClosed
+	}
+	if err := s.checkQuota(fw); err != nil {
+		return nil, err
+	}
+
+	originAddr, originPort := "127.0.0.1", 0
+	if tcpAddr, ok := origin.(*net.TCPAddr); ok {
+		originAddr = tcpAddr.IP.String()
+		originPort = tcpAddr.Port
+	}
+	payload := ssh.Marshal(&remoteForwardChannelData{
+		DestAddr: fw.requestedAddr,
+		// Not the actual port we're listening on.
+		DestPort:   fw.requestedPort,
+		OriginAddr: originAddr,
+		OriginPort: uint32(originPort),
+	})
+
+	// OpenChannel waits for the client to accept the channel, and does
+	// not take a context.
+	type result struct {
+		ch   ssh.Channel
+		reqs <-chan *ssh.Request
+		err  error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		ch, reqs, err := fw.sshConn.OpenChannel(forwardedTCPChannelType, payload)
+		opened <- result{ch, reqs, err}
+	}()
+
+	var res result
+	select {
+	case res = <-opened:
+	case <-ctx.Done():
+		go func() {
+			if res := <-opened; res.err == nil {
+				res.ch.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case <-fw.ctx.Done():
+		go func() {
+			if res := <-opened; res.err == nil {
+				res.ch.Close()
+			}
+		}()
+		return nil, errTunnelClosed
+	}
+	if res.err != nil {
+		return nil, fmt.Errorf("failed to open channel: %w", res.err)
+	}
+	go ssh.DiscardRequests(res.reqs)
+
+	traffic := &trafficCounter{}
+	conn := &channelConn{
+		ch:      res.ch,
+		reader:  s.meterReader(fw.ctx, res.ch, fw, traffic),
+		writer:  s.meter(fw.ctx, res.ch, fw, traffic, true),
+		sshConn: fw.sshConn,
+		origin:  fmt.Sprintf("%s:%d", originAddr, originPort),
+		traffic: traffic,
+	}
+	// Channels do not outlive their tunnel.
+	conn.stop = context.AfterFunc(fw.ctx, func() { conn.Close() })
+	log.Printf("opened channel for %s", conn.origin)
+	return conn, nil
+}
@@ -0,0 +1,274 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package sshsrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+// benchBodySize is the size of the responses used to measure throughput.
+const benchBodySize = 4 << 20
+
+// benchTunnel is a tunnel registered over an in-process SSH connection.
+// The client side forwards the channels it is sent to an HTTP backend, like
+// ssh -R does.
+type benchTunnel struct {
+	srv *sshServer
+	fw  *forwarderDetails
+}
+
+func newBenchTunnel(b *testing.B) *benchTunnel {
+	b.Helper()
+
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	body := bytes.Repeat([]byte("x"), benchBodySize)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.Write(body)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	b.Cleanup(backend.Close)
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		b.Fatal(err)
+	}
+	serverCfg := &ssh.ServerConfig{NoClientAuth: true}
+	serverCfg.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	type accepted struct {
+		conn *ssh.ServerConn
+		err  error
+	}
+	serverConns := make(chan accepted, 1)
+	go func() {
+		nConn, err := listener.Accept()
+		if err != nil {
+			serverConns <- accepted{err: err}
+			return
+		}
+		conn, chans, reqs, err := ssh.NewServerConn(nConn, serverCfg)
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				for ch := range chans {
+					ch.Reject(ssh.Prohibited, "no channels")
+				}
+			}()
+		}
+		serverConns <- accepted{conn, err}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "bench",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { client.Close() })
+	res := <-serverConns
+	if res.err != nil {
+		b.Fatal(res.err)
+	}
+	b.Cleanup(func() { res.conn.Close() })
+
+	go func() {
+		for newChannel := range client.HandleChannelOpen(forwardedTCPChannelType) {
+			ch, reqs, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				defer ch.Close()
+				conn, err := net.Dial("tcp", backend.Listener.Addr().String())
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				go func() {
+					io.Copy(conn, ch)
+					conn.(*net.TCPConn).CloseWrite()
+				}()
+				io.Copy(ch, conn)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Cleanup(cancel)
+	return &benchTunnel{
+		srv: &sshServer{},
+		fw: &forwarderDetails{
+			tunnelType:    tunnelTypeHTTP,
+			key:           "bench",
+			ctx:           ctx,
+			cancel:        cancel,
+			sshConn:       res.conn,
+			requestedAddr: "localhost",
+			requestedPort: 80,
+			traffic:       &trafficCounter{},
+			msgChan:       make(chan params.NotifyMessage, 10),
+		},
+	}
+}
+
+// directTransport dials the tunnel the way the HTTP server does now, by
+// opening a channel for each connection.
+func (t *benchTunnel) directTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return t.srv.dialForwarder(ctx, t.fw, nil)
+		},
+	}
+}
+
+// loopbackTransport dials the tunnel the way the HTTP server used to, through
+// a listener on a loopback address that opens a channel for each connection
+// it accepts and copies the traffic between the two.
+func (t *benchTunnel) loopbackTransport(b *testing.B) *http.Transport {
+	b.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				tcpAddr := c.RemoteAddr().(*net.TCPAddr)
+				payload := ssh.Marshal(&remoteForwardChannelData{
+					DestAddr:   t.fw.requestedAddr,
+					DestPort:   t.fw.requestedPort,
+					OriginAddr: tcpAddr.IP.String(),
+					OriginPort: uint32(tcpAddr.Port),
+				})
+				ch, reqs, err := t.fw.sshConn.OpenChannel(forwardedTCPChannelType, payload)
+				if err != nil {
+					return
+				}
+				defer ch.Close()
+				go ssh.DiscardRequests(reqs)
+
+				traffic := &trafficCounter{}
+				go func() {
+					defer ch.Close()
+					defer c.Close()
+					io.Copy(t.srv.meter(t.fw.ctx, ch, t.fw, traffic, true), c)
+				}()
+				io.Copy(t.srv.meter(t.fw.ctx, c, t.fw, traffic, false), ch)
+			}()
+		}
+	}()
+
+	addr := listener.Addr().String()
+	var dialer net.Dialer
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func benchGet(b *testing.B, client *http.Client, path string) {
+	resp, err := client.Get("http://tunnel.localshow.test" + path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		b.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		b.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+func benchTransports(b *testing.B, run func(b *testing.B, transport *http.Transport)) {
+	b.Run("loopback", func(b *testing.B) {
+		t := newBenchTunnel(b)
+		transport := t.loopbackTransport(b)
+		defer transport.CloseIdleConnections()
+		run(b, transport)
+	})
+	b.Run("direct", func(b *testing.B) {
+		t := newBenchTunnel(b)
+		transport := t.directTransport()
+		defer transport.CloseIdleConnections()
+		run(b, transport)
+	})
+}
+
+// BenchmarkTunnelLatency measures small requests, each sent on a new
+// connection, as visitors that do not reuse connections would.
+func BenchmarkTunnelLatency(b *testing.B) {
+	benchTransports(b, func(b *testing.B, transport *http.Transport) {
+		transport.DisableKeepAlives = true
+		client := &http.Client{Transport: transport}
+		for b.Loop() {
+			benchGet(b, client, "/")
+		}
+	})
+}
+
+// BenchmarkTunnelThroughput measures large responses sent over a reused
+// connection.
+func BenchmarkTunnelThroughput(b *testing.B) {
+	benchTransports(b, func(b *testing.B, transport *http.Transport) {
+		client := &http.Client{Transport: transport}
+		b.SetBytes(benchBodySize)
+		for b.Loop() {
+			benchGet(b, client, "/large")
+		}
+	})
+}
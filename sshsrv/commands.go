@@ -0,0 +1,545 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package sshsrv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	terminal "golang.org/x/term"
+
+	"github.com/gabriel-samfira/localshow/config"
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+// Exit statuses returned to clients that run commands through exec
+// requests (ssh host <command>).
+const (
+	exitStatusOK             uint32 = 0
+	exitStatusError          uint32 = 1
+	exitStatusUsage          uint32 = 2
+	exitStatusUnknownCommand uint32 = 127
+)
+
+const commandsHelp = `Available commands:
+  status [--json]             show details about this connection
+  list [--json]               list the tunnels registered by your key
+  close <subdomain|port>      close a tunnel registered by your key
+  domains [--json]            list the custom domains of your key
+  domains add <hostname>      register a custom domain for your key
+  domains verify <hostname>   verify that you control a custom domain
+  domains remove <hostname>   remove a custom domain
+  har <subdomain>             export the captured requests of a tunnel as a HAR file
+  logs                        show the request logs of the tunnels of this connection
+  nologs                      stop showing request logs
+  version                     show the server version
+  quit                        close the session
+`
+
+var errInvalidUsage = errors.New("invalid usage")
+
+// commandSession holds the state of the session a command runs in. The
+// same commands are available in the interactive prompt and through exec
+// requests.
+type commandSession struct {
+	conn       *ssh.ServerConn
+	msgHandler *messageHandler
+	stdout     io.Writer
+	stderr     io.Writer
+
+	// interactive is set for shell sessions. consumerID is the id the
+	// terminal of a shell session is registered with in msgHandler.
+	interactive bool
+	consumerID  string
+	// quit is set by the quit command.
+	quit bool
+}
+
+type execRequest struct {
+	Command string
+}
+
+type envRequest struct {
+	Name  string
+	Value string
+}
+
+type exitStatusRequest struct {
+	Status uint32
+}
+
+// handleSession services the requests of a session channel. Shell requests
+// start the interactive prompt, while exec requests run a single command
+// and report its exit status. Env requests set tunnel options.
+func (s *sshServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request, conn *ssh.ServerConn, msgHandler *messageHandler, user string, connOpts *connOptions) {
+	policy := newKeyPolicy(conn.Permissions)
+	started := false
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			req.Reply(!policy.noPTY, nil)
+		case "env":
+			var payload envRequest
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			isOption, err := connOpts.setEnv(payload.Name, payload.Value)
+			if err != nil {
+				log.Printf("invalid tunnel option from %s: %s", conn.RemoteAddr(), err)
+				connOpts.warnLate(msgHandler.msgChan, err)
+			}
+			req.Reply(isOption && err == nil, nil)
+		case "shell":
+			if started {
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			connOpts.settle()
+			req.Reply(true, nil)
+			go s.runShell(channel, conn, msgHandler, user)
+		case "exec":
+			var payload execRequest
+			if started || ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+			go s.runExec(channel, conn, msgHandler, connOpts, payload.Command)
+		default:
+			req.Reply(false, nil)
+			log.Printf("unexpected request type: %s", req.Type)
+		}
+	}
+}
+
+// runShell runs the interactive prompt. The prompt shows the URLs of the
+// tunnels of this connection, and closes the connection when it exits.
+func (s *sshServer) runShell(channel ssh.Channel, conn *ssh.ServerConn, msgHandler *messageHandler, user string) {
+	var prompt string
+	if user != "api" {
+		prompt = "> "
+	}
+
+	defer channel.Close()
+	defer conn.Close()
+	term := terminal.NewTerminal(channel, prompt)
+	messageID := msgHandler.Register(term)
+	defer msgHandler.Unregister(messageID)
+	msgHandler.Urls(messageID)
+
+	go func() {
+		defer channel.Close()
+		defer conn.Close()
+		defer msgHandler.Close()
+		err := msgHandler.Wait()
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+
+	sess := &commandSession{
+		conn:        conn,
+		msgHandler:  msgHandler,
+		stdout:      term,
+		stderr:      term,
+		interactive: true,
+		consumerID:  messageID,
+	}
+	for !sess.quit {
+		line, err := term.ReadLine()
+		if err != nil {
+			break
+		}
+		s.runCommand(sess, line)
+	}
+}
+
+// runExec runs command and sends its exit status to the client. Commands
+// that start with a dash set tunnel options, after which the tunnel URLs
+// are shown until the connection is closed:
+//
+//	ssh -R 80:localhost:3000 host -- --auth bob:secret --ttl 2h
+func (s *sshServer) runExec(channel ssh.Channel, conn *ssh.ServerConn, msgHandler *messageHandler, connOpts *connOptions, command string) {
+	defer channel.Close()
+
+	sess := &commandSession{
+		conn:       conn,
+		msgHandler: msgHandler,
+		stdout:     channel,
+		stderr:     channel.Stderr(),
+	}
+
+	var status uint32
+	if args := strings.Fields(command); len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		err := connOpts.setArgs(args)
+		connOpts.settle()
+		connOpts.warnLate(msgHandler.msgChan, err)
+		if err != nil {
+			fmt.Fprintf(sess.stderr, "invalid tunnel options: %s\n", err)
+			status = exitStatusUsage
+		} else if err := s.streamTunnels(sess, false); err != nil {
+			status = exitStatusError
+		}
+	} else {
+		connOpts.settle()
+		status = s.runCommand(sess, command)
+	}
+	if _, err := channel.SendRequest("exit-status", false, ssh.Marshal(&exitStatusRequest{status})); err != nil {
+		log.Printf("failed to send exit status: %s", err)
+	}
+}
+
+// runCommand runs the command in line and returns its exit status. Errors
+// are written to the stderr of the session.
+func (s *sshServer) runCommand(sess *commandSession, line string) uint32 {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return exitStatusOK
+	}
+
+	var err error
+	switch args[0] {
+	case "help":
+		_, err = io.WriteString(sess.stdout, commandsHelp)
+	case "status":
+		err = s.cmdStatus(sess, args[1:])
+	case "list", "tunnels":
+		err = s.cmdList(sess, args[1:])
+	case "close":
+		err = s.cmdClose(sess, args[1:])
+	case "domains":
+		err = s.cmdDomains(sess, args[1:])
+	case "har":
+		err = s.cmdHAR(sess, args[1:])
+	case "logs":
+		err = s.cmdLogs(sess)
+	case "nologs":
+		if sess.interactive {
+			sess.msgHandler.SetLogging(sess.consumerID, false)
+			_, err = io.WriteString(sess.stdout, "Logging disabled\n")
+		}
+	case "version":
+		_, err = fmt.Fprintf(sess.stdout, "%s\n", s.version)
+	case "quit", "exit":
+		sess.quit = true
+	default:
+		fmt.Fprintf(sess.stderr, "unknown command %q, run \"help\" for a list of commands\n", args[0])
+		return exitStatusUnknownCommand
+	}
+
+	if err != nil {
+		fmt.Fprintf(sess.stderr, "%s: %s\n", args[0], err)
+		if errors.Is(err, errInvalidUsage) {
+			return exitStatusUsage
+		}
+		return exitStatusError
+	}
+	return exitStatusOK
+}
+
+// parseJSONFlag returns true if args holds the --json flag, which is the
+// only argument accepted by commands that can output JSON.
+func parseJSONFlag(args []string) (bool, error) {
+	switch {
+	case len(args) == 0:
+		return false, nil
+	case len(args) == 1 && args[0] == "--json":
+		return true, nil
+	default:
+		return false, fmt.Errorf("%w: unexpected arguments %q", errInvalidUsage, strings.Join(args, " "))
+	}
+}
+
+func writeJSON(wr io.Writer, v any) error {
+	asJs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal output: %w", err)
+	}
+	_, err = fmt.Fprintf(wr, "%s\n", asJs)
+	return err
+}
+
+// ownedForwarders returns the keys of the tunnels registered by the key
+// conn authenticated with. Anonymous clients only own the tunnels of their
+// own connection.
+func (s *sshServer) ownedForwarders(conn *ssh.ServerConn) []string {
+	fingerprint := connFingerprint(conn)
+	connTag := conn.RemoteAddr().String()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var ret []string
+	for fwKey, fw := range s.forwarders {
+		if fingerprint != "" && fw.fingerprint == fingerprint {
+			ret = append(ret, fwKey)
+			continue
+		}
+		if fingerprint == "" && strings.HasPrefix(fwKey, connTag+":") {
+			ret = append(ret, fwKey)
+		}
+	}
+	return ret
+}
+
+// tunnelInfo returns the description of the tunnel registered under fwKey.
+func (s *sshServer) tunnelInfo(fwKey string) (params.Tunnel, bool) {
+	s.mux.Lock()
+	fw, ok := s.forwarders[fwKey]
+	s.mux.Unlock()
+	if !ok {
+		return params.Tunnel{}, false
+	}
+
+	cfg := s.appConfig.Load().HTTPServer
+	info := params.Tunnel{
+		Type:        string(fw.tunnelType),
+		Subdomain:   fw.subdomain,
+		Port:        fw.bindPort,
+		Passthrough: fw.passthrough,
+		Private:     fw.private,
+		Pool:        fw.pool,
+		CreatedAt:   fw.createdAt,
+		BytesIn:     fw.traffic.in.Load(),
+		BytesOut:    fw.traffic.out.Load(),
+	}
+
+	hostname := s.tunnelHostname(fw)
+	switch {
+	case fw.tunnelType == tunnelTypeTCP:
+		info.URL = fmt.Sprintf("tcp://%s:%d", cfg.DomainName, fw.bindPort)
+	case fw.private:
+		// Private tunnels have no public URL.
+	case cfg.UseTLS:
+		info.URL = fmt.Sprintf("https://%s", hostname)
+		if port := cfg.EffectiveTLSPort(); port != 443 {
+			info.URL = fmt.Sprintf("%s:%d", info.URL, port)
+		}
+	default:
+		info.URL = fmt.Sprintf("http://%s", hostname)
+		if port := cfg.EffectivePort(); port != 80 {
+			info.URL = fmt.Sprintf("%s:%d", info.URL, port)
+		}
+	}
+	return info, true
+}
+
+func (s *sshServer) cmdStatus(sess *commandSession, args []string) error {
+	asJSON, err := parseJSONFlag(args)
+	if err != nil {
+		return err
+	}
+
+	status := params.SessionStatus{
+		Version:     s.version,
+		User:        sess.conn.User(),
+		Fingerprint: connFingerprint(sess.conn),
+		RemoteAddr:  sess.conn.RemoteAddr().String(),
+		Tunnels:     len(s.ownedForwarders(sess.conn)),
+		MaxTunnels:  s.appConfig.Load().SSHServer.MaxTunnels(),
+	}
+	if status.Fingerprint != "" {
+		usage, err := s.usage.usage(status.Fingerprint)
+		if err != nil {
+			return err
+		}
+		status.Transfer = &usage
+	}
+	if asJSON {
+		return writeJSON(sess.stdout, status)
+	}
+
+	fingerprint := status.Fingerprint
+	if fingerprint == "" {
+		fingerprint = "none"
+	}
+	tw := tabwriter.NewWriter(sess.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Version:\t%s\n", status.Version)
+	fmt.Fprintf(tw, "User:\t%s\n", status.User)
+	fmt.Fprintf(tw, "Key:\t%s\n", fingerprint)
+	fmt.Fprintf(tw, "Remote address:\t%s\n", status.RemoteAddr)
+	fmt.Fprintf(tw, "Tunnels:\t%d (max %d per connection)\n", status.Tunnels, status.MaxTunnels)
+	if transfer := status.Transfer; transfer != nil {
+		quota := "no quota"
+		if transfer.Quota > 0 {
+			quota = fmt.Sprintf("quota %s", config.ByteSize(transfer.Quota))
+		}
+		fmt.Fprintf(tw, "Transfer (%s):\t%s in, %s out (%s)\n", transfer.Month,
+			config.ByteSize(transfer.BytesIn), config.ByteSize(transfer.BytesOut), quota)
+	}
+	return tw.Flush()
+}
+
+func (s *sshServer) cmdList(sess *commandSession, args []string) error {
+	asJSON, err := parseJSONFlag(args)
+	if err != nil {
+		return err
+	}
+
+	tunnels := []params.Tunnel{}
+	for _, fwKey := range s.ownedForwarders(sess.conn) {
+		if info, ok := s.tunnelInfo(fwKey); ok {
+			tunnels = append(tunnels, info)
+		}
+	}
+	slices.SortStableFunc(tunnels, func(a, b params.Tunnel) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	if asJSON {
+		return writeJSON(sess.stdout, tunnels)
+	}
+
+	if len(tunnels) == 0 {
+		_, err := io.WriteString(sess.stdout, "No tunnels registered\n")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(sess.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tNAME\tPORT\tFLAGS\tURL\tUPTIME\tIN\tOUT")
+	for _, tun := range tunnels {
+		name := tun.Subdomain
+		if name == "" {
+			name = "-"
+		}
+		var flags []string
+		if tun.Passthrough {
+			flags = append(flags, "passthrough")
+		}
+		if tun.Private {
+			flags = append(flags, "private")
+		}
+		if tun.Pool {
+			flags = append(flags, "pool")
+		}
+		if len(flags) == 0 {
+			flags = append(flags, "-")
+		}
+		url := tun.URL
+		if url == "" {
+			url = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", tun.Type, name, tun.Port,
+			strings.Join(flags, ","), url, time.Since(tun.CreatedAt).Round(time.Second),
+			config.ByteSize(tun.BytesIn), config.ByteSize(tun.BytesOut))
+	}
+	return tw.Flush()
+}
+
+// cmdClose closes the tunnels registered by the key of the session for a
+// subdomain, or the raw TCP tunnel listening on a public port.
+func (s *sshServer) cmdClose(sess *commandSession, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: close <subdomain|port>", errInvalidUsage)
+	}
+	target := strings.ToLower(args[0])
+	port, portErr := strconv.ParseUint(target, 10, 32)
+
+	var closed int
+	for _, fwKey := range s.ownedForwarders(sess.conn) {
+		s.mux.Lock()
+		fw, ok := s.forwarders[fwKey]
+		s.mux.Unlock()
+		if !ok {
+			continue
+		}
+
+		switch fw.tunnelType {
+		case tunnelTypeTCP:
+			if portErr != nil || fw.bindPort != uint32(port) {
+				continue
+			}
+		default:
+			if fw.subdomain != target {
+				continue
+			}
+		}
+
+		log.Printf("closing tunnel %s at the request of %s", fwKey, sess.conn.RemoteAddr())
+		s.unregisterForwarder(fwKey)
+		closed++
+	}
+
+	if closed == 0 {
+		return fmt.Errorf("no tunnel found for %q", args[0])
+	}
+	_, err := fmt.Fprintf(sess.stdout, "Closed %d tunnel(s)\n", closed)
+	return err
+}
+
+// tunnelHostname returns the hostname an HTTP tunnel is served on.
+func (s *sshServer) tunnelHostname(fw *forwarderDetails) string {
+	if fw.customDomain {
+		return fw.subdomain
+	}
+	return fmt.Sprintf("%s.%s", fw.subdomain, s.appConfig.Load().HTTPServer.DomainName)
+}
+
+// cmdHAR writes the requests captured for a tunnel registered by the key of
+// the session to stdout, as a HAR file:
+//
+//	ssh host har <subdomain> > out.har
+func (s *sshServer) cmdHAR(sess *commandSession, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: har <subdomain>", errInvalidUsage)
+	}
+	target := strings.ToLower(args[0])
+
+	for _, fwKey := range s.ownedForwarders(sess.conn) {
+		s.mux.Lock()
+		fw, ok := s.forwarders[fwKey]
+		s.mux.Unlock()
+		if !ok || fw.tunnelType != tunnelTypeHTTP || fw.subdomain != target {
+			continue
+		}
+		if fw.private || fw.passthrough {
+			return fmt.Errorf("request capture is not available for %q", args[0])
+		}
+		return s.httpTunnels.WriteHAR(sess.stdout, s.tunnelHostname(fw))
+	}
+	return fmt.Errorf("no tunnel found for %q", args[0])
+}
+
+// cmdLogs enables the request logs in the interactive prompt. Through an
+// exec request, it streams the tunnel URLs and request logs of this
+// connection until the connection is closed.
+func (s *sshServer) cmdLogs(sess *commandSession) error {
+	if sess.interactive {
+		sess.msgHandler.SetLogging(sess.consumerID, true)
+		_, err := io.WriteString(sess.stdout, "Logging enabled\n")
+		return err
+	}
+	return s.streamTunnels(sess, true)
+}
+
+// streamTunnels writes the tunnel URLs of this connection, and the request
+// logs if logs is set, to the session until the connection is closed.
+func (s *sshServer) streamTunnels(sess *commandSession, logs bool) error {
+	messageID := sess.msgHandler.Register(sess.stdout)
+	defer sess.msgHandler.Unregister(messageID)
+	sess.msgHandler.Urls(messageID)
+	sess.msgHandler.SetLogging(messageID, logs)
+	return sess.msgHandler.Wait()
+}
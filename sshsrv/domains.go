@@ -0,0 +1,197 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package sshsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gabriel-samfira/localshow/config"
+	"github.com/gabriel-samfira/localshow/database"
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+// customDomainVerifyTimeout is how long the domains verify command waits
+// for the DNS lookup.
+const customDomainVerifyTimeout = 30 * time.Second
+
+// checkCustomDomain returns an error if details may not register a tunnel
+// on the custom domain hostname. The custom domain must be registered and
+// verified by the key of details. It returns the hostname in canonical
+// form.
+func (s *sshServer) checkCustomDomain(hostname string, details forwarderDetails) (string, error) {
+	cfg := s.appConfig.Load()
+	if !cfg.CustomDomains.Enabled {
+		return "", fmt.Errorf("invalid subdomain %q", hostname)
+	}
+	hostname, err := config.ParseHostname(hostname)
+	if err != nil {
+		return "", err
+	}
+	if details.fingerprint == "" {
+		return "", fmt.Errorf("custom domains require public key authentication")
+	}
+	if details.private {
+		return "", fmt.Errorf("custom domains can not be used for private tunnels")
+	}
+
+	domain, err := s.dbConn.GetCustomDomain(hostname)
+	if err != nil {
+		if errors.Is(err, database.ErrCustomDomainNotFound) {
+			return "", fmt.Errorf("custom domain %q is not registered", hostname)
+		}
+		log.Printf("failed to fetch custom domain %s: %s", hostname, err)
+		return "", fmt.Errorf("failed to check custom domains")
+	}
+	if domain.Fingerprint != details.fingerprint {
+		return "", fmt.Errorf("custom domain %q is registered by a different key", hostname)
+	}
+	if !domain.Verified() {
+		return "", fmt.Errorf("custom domain %q is not verified, run \"domains verify %s\"", hostname, hostname)
+	}
+	return hostname, nil
+}
+
+// cmdDomains manages the custom domains of the key of the session.
+func (s *sshServer) cmdDomains(sess *commandSession, args []string) error {
+	cfg := s.appConfig.Load()
+	if !cfg.CustomDomains.Enabled {
+		return fmt.Errorf("custom domains are not enabled on this server")
+	}
+	fingerprint := connFingerprint(sess.conn)
+	if fingerprint == "" {
+		return fmt.Errorf("custom domains require public key authentication")
+	}
+
+	if len(args) == 0 || args[0] == "--json" {
+		return s.listDomains(sess, fingerprint, args)
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("%w: domains [--json|add|verify|remove <hostname>]", errInvalidUsage)
+	}
+
+	hostname, err := config.ParseHostname(args[1])
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "add":
+		if cfg.HTTPServer.IsOwnDomain(hostname) {
+			return fmt.Errorf("%s is part of the domain of this server", hostname)
+		}
+		domain, err := s.dbConn.AddCustomDomain(hostname, fingerprint, false)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(sess.stdout, `Custom domain %s registered. Prove that you control it by creating
+a TXT record named %s%s with the value %s
+Then run: domains verify %s
+`, domain.Hostname, params.CustomDomainTXTPrefix, domain.Hostname, domain.Token, domain.Hostname)
+		return err
+	case "verify":
+		if err := s.ownsCustomDomain(hostname, fingerprint); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(s.ctx, customDomainVerifyTimeout)
+		defer cancel()
+		if err := VerifyCustomDomain(ctx, cfg, s.dbConn, hostname); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(sess.stdout, "Custom domain %s verified\n", hostname)
+		return err
+	case "remove":
+		if err := s.dbConn.RemoveCustomDomain(hostname, fingerprint); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(sess.stdout, "Custom domain %s removed\n", hostname)
+		return err
+	default:
+		return fmt.Errorf("%w: unknown subcommand %q", errInvalidUsage, args[0])
+	}
+}
+
+// VerifyCustomDomain checks that the owner of hostname published its token
+// in a TXT record named CustomDomainTXTPrefix+hostname, and marks the
+// custom domain as verified if so. Only the key that registered hostname
+// was given the token, so the record ties the hostname to that key.
+func VerifyCustomDomain(ctx context.Context, cfg *config.Config, db *database.SQLDatabase, hostname string) error {
+	domain, err := db.GetCustomDomain(hostname)
+	if err != nil {
+		return err
+	}
+	if domain.Verified() {
+		return nil
+	}
+
+	name := params.CustomDomainTXTPrefix + domain.Hostname
+	records, err := cfg.CustomDomains.Resolver().LookupTXT(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to look up TXT record %s: %w", name, err)
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == domain.Token {
+			return db.MarkCustomDomainVerified(hostname)
+		}
+	}
+	return fmt.Errorf("TXT record %s does not hold the token of %s", name, hostname)
+}
+
+// ownsCustomDomain returns an error if hostname is not a custom domain
+// registered by the key identified by fingerprint.
+func (s *sshServer) ownsCustomDomain(hostname, fingerprint string) error {
+	domain, err := s.dbConn.GetCustomDomain(hostname)
+	if err != nil {
+		return err
+	}
+	if domain.Fingerprint != fingerprint {
+		return database.ErrCustomDomainNotFound
+	}
+	return nil
+}
+
+func (s *sshServer) listDomains(sess *commandSession, fingerprint string, args []string) error {
+	asJSON, err := parseJSONFlag(args)
+	if err != nil {
+		return err
+	}
+	domains, err := s.dbConn.ListCustomDomains(fingerprint)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return writeJSON(sess.stdout, domains)
+	}
+
+	if len(domains) == 0 {
+		_, err := io.WriteString(sess.stdout, "No custom domains registered\n")
+		return err
+	}
+	tw := tabwriter.NewWriter(sess.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOSTNAME\tVERIFIED\tTOKEN")
+	for _, domain := range domains {
+		verified := "no"
+		if domain.Verified() {
+			verified = domain.VerifiedAt.Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", domain.Hostname, verified, domain.Token)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,278 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package sshsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gabriel-samfira/localshow/config"
+	"github.com/gabriel-samfira/localshow/params"
+)
+
+const (
+	// tunnelOptionsEnvPrefix is the prefix of the environment variables
+	// clients may use to set tunnel options. LOCALSHOW_HOST_HEADER sets
+	// the host-header option.
+	tunnelOptionsEnvPrefix = "LOCALSHOW_"
+
+	// tunnelOptionsTimeout is how long we wait for a client to start a
+	// shell or run a command before its tunnels are announced with the
+	// options received so far. Clients that only forward ports (ssh -N)
+	// never do either. OpenSSH clients tell us so, in which case the
+	// options are settled right away.
+	tunnelOptionsTimeout = 2 * time.Second
+)
+
+// errOptionsSettled is returned for options sent after the tunnels of the
+// connection were announced.
+var errOptionsSettled = errors.New("tunnel options can only be set when connecting")
+
+// boolTunnelOptions may be set on the command line without a value.
+var boolTunnelOptions = map[string]bool{
+	"inspect": true,
+	"capture": true,
+}
+
+// setTunnelOption parses value and sets the option called name in opts.
+func setTunnelOption(opts *params.TunnelOptions, name, value string) error {
+	switch name {
+	case "auth":
+		user, password, ok := strings.Cut(value, ":")
+		if !ok || user == "" || password == "" {
+			return fmt.Errorf("auth must be in the form user:password")
+		}
+		opts.BasicAuthUser = user
+		opts.BasicAuthPassword = password
+	case "token":
+		if value == "" {
+			return fmt.Errorf("token may not be empty")
+		}
+		opts.Token = value
+	case "allow", "deny":
+		for _, val := range splitList(value) {
+			prefix, err := config.ParseNetwork(val)
+			if err != nil {
+				return fmt.Errorf("invalid network %q in %s", val, name)
+			}
+			if name == "allow" {
+				opts.AllowedCIDRs = append(opts.AllowedCIDRs, prefix)
+			} else {
+				opts.DeniedCIDRs = append(opts.DeniedCIDRs, prefix)
+			}
+		}
+	case "allow-countries", "deny-countries":
+		for _, val := range splitList(value) {
+			code, err := config.ParseCountryCode(val)
+			if err != nil {
+				return err
+			}
+			if name == "allow-countries" {
+				opts.AllowedCountries = append(opts.AllowedCountries, code)
+			} else {
+				opts.DeniedCountries = append(opts.DeniedCountries, code)
+			}
+		}
+	case "host-header":
+		if value == "" || strings.ContainsAny(value, " /\t\r\n") {
+			return fmt.Errorf("invalid host header %q", value)
+		}
+		opts.HostHeader = value
+	case "ttl":
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid ttl %q", value)
+		}
+		opts.TTL = ttl
+	case "inspect":
+		inspect, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for inspect", value)
+		}
+		opts.Inspect = inspect
+	case "capture":
+		capture, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for capture", value)
+		}
+		opts.Capture = capture
+	case "rate-limit", "visitor-rate-limit":
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+			return fmt.Errorf("invalid %s %q, expected requests per second", name, value)
+		}
+		// Owners only set the rate. The burst defaults to the rate,
+		// rounded up.
+		limit := params.RateLimit{Rate: rate}.Tighten(params.RateLimit{})
+		if name == "rate-limit" {
+			opts.RateLimit = limit
+		} else {
+			opts.VisitorRateLimit = limit
+		}
+	case "max-concurrent":
+		maxConcurrent, err := strconv.Atoi(value)
+		if err != nil || maxConcurrent <= 0 {
+			return fmt.Errorf("invalid max-concurrent %q", value)
+		}
+		opts.MaxConcurrent = maxConcurrent
+	case "log-format":
+		switch value {
+		case params.LogFormatCombined, params.LogFormatJSON:
+		default:
+			return fmt.Errorf("invalid log-format %q, expected %s or %s", value, params.LogFormatCombined, params.LogFormatJSON)
+		}
+		opts.LogFormat = value
+	default:
+		return fmt.Errorf("unknown tunnel option %q", name)
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, skipping empty entries.
+func splitList(value string) []string {
+	var ret []string
+	for _, val := range strings.Split(value, ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			ret = append(ret, val)
+		}
+	}
+	return ret
+}
+
+// connOptions collects the tunnel options sent by a client. They apply to
+// all tunnels of the connection, and can be set until they are settled.
+// Options are settled when the client starts a shell or runs a command,
+// when it tells us it will not open sessions, or after
+// tunnelOptionsTimeout. Tunnels are only announced once the options
+// are settled.
+type connOptions struct {
+	options params.TunnelOptions
+	err     error
+
+	settled chan struct{}
+	once    sync.Once
+	// lateOnce makes sure the client is warned once about options sent
+	// after they were settled.
+	lateOnce sync.Once
+	mux      sync.Mutex
+}
+
+func newConnOptions() *connOptions {
+	opts := &connOptions{
+		settled: make(chan struct{}),
+	}
+	time.AfterFunc(tunnelOptionsTimeout, opts.settle)
+	return opts
+}
+
+// setEnv sets the option named by an environment variable sent through an
+// env request. It returns false if the variable is not a tunnel option.
+func (c *connOptions) setEnv(name, value string) (bool, error) {
+	if !strings.HasPrefix(name, tunnelOptionsEnvPrefix) {
+		return false, nil
+	}
+	optName := strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(name, tunnelOptionsEnvPrefix)), "_", "-")
+	return true, c.set(optName, value)
+}
+
+// setArgs sets the options passed on the command line, in the form
+// --name value or --name=value. A leading "--" is ignored.
+func (c *connOptions) setArgs(args []string) error {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	for i := 0; i < len(args); i++ {
+		name, found := strings.CutPrefix(args[i], "--")
+		if !found || name == "" {
+			return fmt.Errorf("unexpected argument %q", args[i])
+		}
+		name, value, hasValue := strings.Cut(name, "=")
+		if !hasValue {
+			if boolTunnelOptions[name] && (i+1 == len(args) || strings.HasPrefix(args[i+1], "--")) {
+				value = "true"
+			} else if i+1 < len(args) {
+				i++
+				value = args[i]
+			} else {
+				return fmt.Errorf("missing value for --%s", name)
+			}
+		}
+		if err := c.set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *connOptions) set(name, value string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	select {
+	case <-c.settled:
+		return errOptionsSettled
+	default:
+	}
+
+	if err := setTunnelOption(&c.options, name, value); err != nil {
+		// Tunnels with an invalid option are not announced, rather
+		// than being exposed without the restrictions the client
+		// asked for.
+		if c.err == nil {
+			c.err = err
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *connOptions) settle() {
+	c.once.Do(func() {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		close(c.settled)
+	})
+}
+
+// warnLate warns the client through msgChan if err rejected options sent
+// after the tunnels were announced, so the client knows its tunnels run
+// without them. The warning is only sent once per connection.
+func (c *connOptions) warnLate(msgChan chan params.NotifyMessage, err error) {
+	if !errors.Is(err, errOptionsSettled) {
+		return
+	}
+	c.lateOnce.Do(func() {
+		sendNotice(msgChan, "Tunnel options sent after the tunnels were announced are ignored, the tunnels run without them.")
+	})
+}
+
+// wait blocks until the options are settled and returns them.
+func (c *connOptions) wait(ctx context.Context) (params.TunnelOptions, error) {
+	select {
+	case <-c.settled:
+	case <-ctx.Done():
+		return params.TunnelOptions{}, ctx.Err()
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.options, c.err
+}
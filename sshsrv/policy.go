@@ -0,0 +1,86 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package sshsrv
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gabriel-samfira/localshow/config"
+)
+
+// keyPolicy holds the restrictions attached to the key a client used to
+// authenticate, as derived from its authorized_keys options.
+type keyPolicy struct {
+	noPortForwarding bool
+	noPTY            bool
+	permitListen     []string
+	// maxTunnels is the maximum number of tunnels the key may have at
+	// the same time, across all connections. Zero means no limit.
+	maxTunnels int
+}
+
+func newKeyPolicy(perms *ssh.Permissions) keyPolicy {
+	var policy keyPolicy
+	if perms == nil {
+		return policy
+	}
+
+	ext := perms.Extensions
+	policy.noPortForwarding = ext[config.ExtensionNoPortForwarding] == "true"
+	policy.noPTY = ext[config.ExtensionNoPTY] == "true"
+	if val := ext[config.ExtensionPermitListen]; val != "" {
+		policy.permitListen = strings.Split(val, ",")
+	}
+	if val := ext[config.ExtensionMaxTunnels]; val != "" {
+		policy.maxTunnels, _ = strconv.Atoi(val)
+	}
+	return policy
+}
+
+// permitsListen returns true if the key may request a remote forward for
+// subdomain on port. Each permitlisten entry has the form [host:]port,
+// where host is matched against the subdomain and may contain wildcards.
+// Either part may be "*". An empty subdomain stands for a randomly
+// generated one, which is only allowed if any host is.
+func (p keyPolicy) permitsListen(subdomain string, port uint32) bool {
+	if len(p.permitListen) == 0 {
+		return true
+	}
+
+	for _, entry := range p.permitListen {
+		host, portStr := "*", entry
+		if idx := strings.LastIndex(entry, ":"); idx >= 0 {
+			host, portStr = entry[:idx], entry[idx+1:]
+		}
+
+		if portStr != "*" && portStr != strconv.FormatUint(uint64(port), 10) {
+			continue
+		}
+		if host == "" || host == "*" {
+			return true
+		}
+		if subdomain == "" {
+			continue
+		}
+		if matched, _ := path.Match(strings.ToLower(host), subdomain); matched {
+			return true
+		}
+	}
+	return false
+}
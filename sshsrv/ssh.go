@@ -19,36 +19,81 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	mrand "math/rand/v2"
 	"net"
 	"os"
-	"strconv"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gabriel-samfira/localshow/config"
 	"github.com/gabriel-samfira/localshow/database"
 	"github.com/gabriel-samfira/localshow/params"
+	"github.com/gabriel-samfira/localshow/proxyproto"
 	"golang.org/x/crypto/ssh"
-	terminal "golang.org/x/term"
-
-	"github.com/castillobgr/sententia"
 )
 
 const (
 	forwardedTCPChannelType = "forwarded-tcpip"
+	directTCPIPChannelType  = "direct-tcpip"
+
+	// noMoreSessionsRequestType is sent by OpenSSH clients that will not
+	// open any sessions on the connection, like ssh -N.
+	noMoreSessionsRequestType = "no-more-sessions@openssh.com"
+)
 
-	// maxForwardersPerClient limits how many tunnels a single SSH
-	// connection may register. This prevents a single client from
-	// exhausting server resources.
-	maxForwardersPerClient = 10
+type tunnelType string
+
+const (
+	tunnelTypeHTTP tunnelType = "http"
+	tunnelTypeTCP  tunnelType = "tcp"
 )
 
+// tunnelFlags holds the modifiers a client may prefix to the requested
+// subdomain.
+type tunnelFlags struct {
+	// passthrough routes TLS connections to the tunnel based on SNI,
+	// without terminating TLS on the server.
+	passthrough bool
+	// private tunnels are not exposed on the public HTTP(S) listeners.
+	// They can only be reached by authenticated users over SSH local
+	// forwarding (direct-tcpip).
+	private bool
+	// pool allows multiple sessions authenticated with the same key to
+	// register the same subdomain. Visitors are balanced between them.
+	pool bool
+}
+
+// parseBindAddr splits the bind address requested by the client into the
+// subdomain and the tunnel flags. Flags are prefixed to the subdomain and
+// separated by a "+" sign. For example, "passthrough+gitea" requests a TLS
+// passthrough tunnel on the gitea subdomain.
+func parseBindAddr(bindAddr string) (string, tunnelFlags, error) {
+	var flags tunnelFlags
+	parts := strings.Split(bindAddr, "+")
+	for _, flag := range parts[:len(parts)-1] {
+		switch strings.ToLower(flag) {
+		case "passthrough":
+			flags.passthrough = true
+		case "private":
+			flags.private = true
+		case "pool":
+			flags.pool = true
+		default:
+			return "", flags, fmt.Errorf("unknown tunnel flag %q", flag)
+		}
+	}
+	return parts[len(parts)-1], flags, nil
+}
+
 type remoteForwardDetails struct {
 	BindAddr string
 	BindPort uint32
@@ -62,6 +107,9 @@ type remoteForwardSuccess struct {
 	BindPort uint32
 }
 
+// remoteForwardChannelData is the payload of forwarded-tcpip channels. The
+// payload of direct-tcpip channels has the same layout, with DestAddr and
+// DestPort holding the host and port the client wants to connect to.
 type remoteForwardChannelData struct {
 	DestAddr   string
 	DestPort   uint32
@@ -115,46 +163,164 @@ func passwordAuthCallback(dbConn *database.SQLDatabase) config.PasswordAuthCallb
 	}
 }
 
-func NewSSHServer(ctx context.Context, cfg *config.Config, tunnelEvents chan params.TunnelEvent, dbConn *database.SQLDatabase) (*sshServer, error) {
+// HTTPTunnels gives access to the HTTP(S) tunnels served by the HTTP server.
+type HTTPTunnels interface {
+	// WriteHAR exports the requests captured for the tunnel served on
+	// hostname.
+	WriteHAR(w io.Writer, hostname string) error
+	// DialTunnel opens a connection to the tunnel served on hostname and
+	// port. Members of load balanced tunnels are picked the way visitors
+	// are balanced between them.
+	DialTunnel(ctx context.Context, hostname string, port uint32, origin net.Addr) (net.Conn, error)
+}
+
+func NewSSHServer(ctx context.Context, cfg *config.Config, tunnelEvents chan params.TunnelEvent, dbConn *database.SQLDatabase, httpTunnels HTTPTunnels, version string) (*sshServer, error) {
 	authCallback := passwordAuthCallback(dbConn)
 	config, err := cfg.SSHServer.SSHServerConfig(authCallback)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create ssh server config: %w", err)
 	}
-	return &sshServer{
-		config:       config,
+	srv := &sshServer{
 		quit:         make(chan struct{}),
 		ctx:          ctx,
 		forwarders:   make(map[string]*forwarderDetails),
-		subdomains:   make(map[string]struct{}),
+		subdomains:   make(map[string]*subdomainEntry),
 		connections:  make(chan net.Conn, 10),
-		appConfig:    cfg,
 		mux:          &sync.Mutex{},
 		wg:           &sync.WaitGroup{},
 		tunnelEvents: tunnelEvents,
 		dbConn:       dbConn,
-	}, nil
+		httpTunnels:  httpTunnels,
+		version:      version,
+	}
+	srv.config.Store(config)
+	srv.appConfig.Store(cfg)
+	srv.usage = newUsageTracker(dbConn, &srv.appConfig)
+	return srv, nil
 }
 
 type forwarderDetails struct {
-	listener  net.Listener
-	subdomain string
-	bindAddr  string
-	bindPort  uint32
+	tunnelType tunnelType
+	// key is the key the tunnel is registered under.
+	key string
+	// ctx is canceled when the tunnel is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// sshConn is the connection of the client. Visitors are sent to the
+	// client over forwarded-tcpip channels, with requestedAddr and
+	// requestedPort as the destination.
+	sshConn       *ssh.ServerConn
+	requestedAddr string
+	requestedPort uint32
+	// listener and bindAddr are only set for raw TCP tunnels, which
+	// have a public listener of their own.
+	listener    net.Listener
+	subdomain   string
+	bindAddr    string
+	bindPort    uint32
+	passthrough bool
+	private     bool
+	pool        bool
+	// customDomain is set if subdomain is a verified custom domain, and
+	// reserved if subdomain is reserved for the key of the client.
+	customDomain bool
+	reserved     bool
+	fingerprint  string
+	// username is the SSH username of the client.
+	username string
+	// maxTunnels is the tunnel limit of the key identified by
+	// fingerprint. Zero means no limit.
+	maxTunnels int
+	createdAt  time.Time
+	// options are set when the tunnel is announced. ttlTimer closes
+	// the tunnel when its TTL expires.
+	options   params.TunnelOptions
+	announced bool
+	ttlTimer  *time.Timer
+	// reattached is set if the tunnel took over a subdomain that was
+	// held after the connection of its owner was lost.
+	reattached bool
+	// blocked is the number of visitors that were refused by the
+	// visitor filters.
+	blocked int64
+	// traffic counts the traffic of the tunnel, which shapeIn and
+	// shapeOut limit in each direction.
+	traffic  *trafficCounter
+	shapeIn  *byteLimiter
+	shapeOut *byteLimiter
 
 	msgChan chan params.NotifyMessage
 	errChan chan error
 }
 
+// subdomainEntry tracks the tunnels registered for a subdomain. Only load
+// balanced (pool) tunnels may share a subdomain.
+type subdomainEntry struct {
+	pool        bool
+	passthrough bool
+	private     bool
+	port        uint32
+	fingerprint string
+	members     int
+	// generated is set if the subdomain was generated by the server.
+	generated bool
+	// graceTimer is set while the subdomain is held for its owner, after
+	// the connection of its last member was lost. It releases the
+	// subdomain when the grace period ends.
+	graceTimer *time.Timer
+}
+
+// held returns true if the subdomain is kept for its owner to reconnect.
+func (e *subdomainEntry) held() bool {
+	return e.graceTimer != nil
+}
+
+// canReattach returns an error if details may not take over the held
+// subdomain. Only the key that registered it may, using the same port and
+// flags.
+func (e *subdomainEntry) canReattach(details forwarderDetails) error {
+	if details.fingerprint == "" || details.fingerprint != e.fingerprint {
+		return fmt.Errorf("subdomain already registered")
+	}
+	if e.port != details.bindPort || e.passthrough != details.passthrough || e.private != details.private || e.pool != details.pool {
+		return fmt.Errorf("tunnel flags and port must match the tunnel that was disconnected")
+	}
+	return nil
+}
+
+// canJoin returns an error if details may not be added to the tunnels
+// already registered for this subdomain. Pools may be joined by the key
+// that created them, or by any key the subdomain is reserved for.
+func (e *subdomainEntry) canJoin(details forwarderDetails, reservedForKey bool) error {
+	if !e.pool || !details.pool {
+		return fmt.Errorf("subdomain already registered")
+	}
+	sameKey := details.fingerprint != "" && details.fingerprint == e.fingerprint
+	if !sameKey && !reservedForKey {
+		return fmt.Errorf("subdomain is registered by a different key")
+	}
+	if e.port != details.bindPort || e.passthrough != details.passthrough || e.private != details.private {
+		return fmt.Errorf("tunnel flags and port must match the existing members of the pool")
+	}
+	return nil
+}
+
 type sshServer struct {
-	appConfig    *config.Config
-	config       *ssh.ServerConfig
+	// appConfig and config are swapped when the configuration is
+	// reloaded. Connections keep using the ssh config they were
+	// accepted with.
+	appConfig    atomic.Pointer[config.Config]
+	config       atomic.Pointer[ssh.ServerConfig]
 	listener     net.Listener
-	subdomains   map[string]struct{}
+	subdomains   map[string]*subdomainEntry
 	forwarders   map[string]*forwarderDetails
 	mux          *sync.Mutex
 	tunnelEvents chan params.TunnelEvent
 	dbConn       *database.SQLDatabase
+	httpTunnels  HTTPTunnels
+	version      string
+	// usage accounts the traffic of the tunnels of each key.
+	usage *usageTracker
 
 	connections chan net.Conn
 
@@ -163,6 +329,24 @@ type sshServer struct {
 	quit chan struct{}
 }
 
+// connFingerprint returns the fingerprint of the public key used by the
+// client to authenticate, or an empty string for anonymous clients.
+func connFingerprint(conn *ssh.ServerConn) string {
+	if conn.Permissions == nil {
+		return ""
+	}
+	return conn.Permissions.Extensions["pubkey-fp"]
+}
+
+// connUsername returns the username of a client authenticated with a
+// public key or certificate, or an empty string for anonymous clients.
+func connUsername(conn *ssh.ServerConn) string {
+	if conn.Permissions == nil {
+		return ""
+	}
+	return conn.Permissions.Extensions["username"]
+}
+
 func (s *sshServer) loop() {
 	s.wg.Add(1)
 	defer func() {
@@ -224,10 +408,73 @@ func isValidSubdomain(s string) bool {
 	return true
 }
 
-func (s *sshServer) registerForwarder(connTag, fwKey string, details forwarderDetails) error {
+// checkReservation returns an error if subdomain is reserved and the key
+// identified by fingerprint is not allowed to use it. It returns true if
+// the subdomain is reserved for the key.
+func (s *sshServer) checkReservation(subdomain, fingerprint string) (bool, error) {
+	reservations, err := s.dbConn.GetReservationsForSubdomain(subdomain)
+	if err != nil {
+		log.Printf("failed to fetch reservations for %s: %s", subdomain, err)
+		return false, fmt.Errorf("failed to check reservations")
+	}
+	if len(reservations) == 0 {
+		return false, nil
+	}
+
+	if fingerprint != "" {
+		for _, reservation := range reservations {
+			if slices.Contains(reservation.Fingerprints, fingerprint) {
+				return true, nil
+			}
+		}
+	}
+	return false, fmt.Errorf("subdomain %q is reserved", subdomain)
+}
+
+// registerForwarder registers the tunnel described by details under fwKey,
+// and returns the registered tunnel. Reservations and custom domains are
+// looked up before taking s.mux, so registrations do not wait for the
+// database queries of each other.
+func (s *sshServer) registerForwarder(connTag, fwKey string, details forwarderDetails) (*forwarderDetails, error) {
+	details.key = fwKey
+	details.createdAt = time.Now()
+	details.traffic = &trafficCounter{}
+	tunnelRate := s.appConfig.Load().Bandwidth.TunnelRate
+	details.shapeIn = newByteLimiter(tunnelRate)
+	details.shapeOut = newByteLimiter(tunnelRate)
+
+	if details.tunnelType == tunnelTypeTCP {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		if err := s.checkTunnelLimits(connTag, details); err != nil {
+			return nil, err
+		}
+		// Raw TCP tunnels are identified by their public port, which
+		// the OS already guarantees to be unique.
+		if _, ok := s.forwarders[fwKey]; ok {
+			return nil, fmt.Errorf("forwarder already registered")
+		}
+		log.Printf("registering tcp tunnel with key %s on %s", fwKey, details.bindAddr)
+		s.forwarders[fwKey] = &details
+		return &details, nil
+	}
+
+	subdomain := strings.ToLower(details.subdomain)
+	if subdomain == "" || subdomain == "localhost" {
+		return s.registerGeneratedForwarder(connTag, details)
+	}
+	if err := s.resolveSubdomain(subdomain, &details); err != nil {
+		return nil, err
+	}
+
 	s.mux.Lock()
 	defer s.mux.Unlock()
+	return s.addHTTPForwarder(connTag, details, false)
+}
 
+// checkTunnelLimits returns an error if the client or the key of details
+// reached their tunnel limit. The caller must hold s.mux.
+func (s *sshServer) checkTunnelLimits(connTag string, details forwarderDetails) error {
 	// Per-client tunnel limit.
 	count := 0
 	for k := range s.forwarders {
@@ -235,52 +482,228 @@ func (s *sshServer) registerForwarder(connTag, fwKey string, details forwarderDe
 			count++
 		}
 	}
+	// This prevents a single client from exhausting server resources.
+	maxForwardersPerClient := s.appConfig.Load().SSHServer.MaxTunnels()
 	if count >= maxForwardersPerClient {
 		return fmt.Errorf("too many tunnels (max %d)", maxForwardersPerClient)
 	}
 
-	subdomain := strings.ToLower(details.subdomain)
-	if subdomain == "" || subdomain == "localhost" {
-		subdomain, _ = sententia.Make("{{ adjective }}-{{ noun }}")
+	// Per-key tunnel limit, set through authorized_keys options.
+	if details.maxTunnels > 0 {
+		keyCount := 0
+		for _, fw := range s.forwarders {
+			if fw.fingerprint == details.fingerprint {
+				keyCount++
+			}
+		}
+		if keyCount >= details.maxTunnels {
+			return fmt.Errorf("too many tunnels for this key (max %d)", details.maxTunnels)
+		}
+	}
+	return nil
+}
+
+// resolveSubdomain returns an error if details may not register a tunnel
+// on subdomain, which is either a subdomain of our domain or a custom
+// domain. Otherwise, it sets the subdomain of details in canonical form,
+// along with the flags that depend on it. It queries the database, so the
+// caller must not hold s.mux.
+func (s *sshServer) resolveSubdomain(subdomain string, details *forwarderDetails) error {
+	if strings.Contains(subdomain, ".") {
+		// Hostnames outside of our domain must be custom domains
+		// verified by the key of the client.
+		hostname, err := s.checkCustomDomain(subdomain, *details)
+		if err != nil {
+			return err
+		}
+		details.subdomain = hostname
+		details.customDomain = true
+		return nil
 	}
 
 	if !isValidSubdomain(subdomain) {
 		return fmt.Errorf("invalid subdomain %q", subdomain)
 	}
+	if slices.Contains(s.appConfig.Load().HTTPServer.ExcludedSubdomains, subdomain) {
+		return fmt.Errorf("subdomain %q is reserved", subdomain)
+	}
+	reservedForKey, err := s.checkReservation(subdomain, details.fingerprint)
+	if err != nil {
+		return err
+	}
+	details.subdomain = subdomain
+	details.reserved = reservedForKey
+	return nil
+}
 
-	for _, excluded := range s.appConfig.HTTPServer.ExcludedSubdomains {
-		if subdomain == excluded {
-			return fmt.Errorf("subdomain %q is reserved", subdomain)
+// addHTTPForwarder registers the HTTP tunnel described by details, whose
+// subdomain was resolved already. Generated is set if the subdomain was
+// generated by the server. The caller must hold s.mux.
+func (s *sshServer) addHTTPForwarder(connTag string, details forwarderDetails, generated bool) (*forwarderDetails, error) {
+	if err := s.checkTunnelLimits(connTag, details); err != nil {
+		return nil, err
+	}
+	if _, ok := s.forwarders[details.key]; ok {
+		return nil, fmt.Errorf("forwarder already registered")
+	}
+
+	entry, ok := s.subdomains[details.subdomain]
+	switch {
+	case ok && entry.held():
+		if err := entry.canReattach(details); err != nil {
+			return nil, err
+		}
+		log.Printf("tunnel with key %s reattached to %s", details.key, details.subdomain)
+		entry.graceTimer.Stop()
+		entry.graceTimer = nil
+		details.reattached = true
+	case ok:
+		if err := entry.canJoin(details, details.reserved); err != nil {
+			return nil, err
+		}
+	default:
+		entry = &subdomainEntry{
+			pool:        details.pool,
+			passthrough: details.passthrough,
+			private:     details.private,
+			port:        details.bindPort,
+			fingerprint: details.fingerprint,
+			generated:   generated,
 		}
+		s.subdomains[details.subdomain] = entry
 	}
 
-	details.subdomain = subdomain
+	log.Printf("registering tunnel with key %s", details.key)
+	entry.members++
+	s.forwarders[details.key] = &details
+	return &details, nil
+}
 
-	if _, ok := s.forwarders[fwKey]; ok {
-		return fmt.Errorf("forwarder already registered")
+// announceForwarder waits for the tunnel options of the connection to be
+// settled, and announces the tunnel registered under fwKey. HTTP tunnels
+// are announced to the HTTP server, while the URL of raw TCP tunnels is
+// sent to the client directly. Tunnels with invalid options are closed,
+// and the client is warned. The connection stays open.
+func (s *sshServer) announceForwarder(ctx context.Context, fwKey string, connOpts *connOptions) {
+	opts, optsErr := connOpts.wait(ctx)
+	if optsErr == nil && opts.UsesCountries() && !s.dbConn.HasGeoIP() {
+		optsErr = fmt.Errorf("filtering visitors by country is not available on this server")
 	}
 
-	if _, ok := s.subdomains[details.subdomain]; ok {
-		return fmt.Errorf("subdomain already registered")
+	s.mux.Lock()
+	fw, ok := s.forwarders[fwKey]
+	if !ok || fw.announced || optsErr != nil {
+		s.mux.Unlock()
+		if ok && optsErr != nil && ctx.Err() == nil {
+			s.unregisterForwarder(fwKey)
+			sendNotice(fw.msgChan, fmt.Sprintf("%s was closed: invalid tunnel options: %s", s.tunnelName(fw), optsErr))
+		}
+		return
 	}
 
-	log.Printf("registering tunnel with key %s", fwKey)
-	s.subdomains[details.subdomain] = struct{}{}
-	s.forwarders[fwKey] = &details
+	fw.options = opts
+	fw.announced = true
+	if opts.TTL > 0 {
+		fw.ttlTimer = time.AfterFunc(opts.TTL, func() {
+			s.expireForwarder(fwKey, fw)
+		})
+	}
+
+	if fw.tunnelType == tunnelTypeTCP {
+		s.mux.Unlock()
+		// Only the visitor filter and the TTL apply to raw TCP tunnels.
+		urls, err := s.tcpTunnelURLs(fw.bindPort, params.TunnelOptions{
+			VisitorFilter: opts.VisitorFilter,
+			TTL:           opts.TTL,
+		})
+		if err != nil {
+			log.Printf("failed to get urls: %s", err)
+			return
+		}
+		select {
+		case fw.msgChan <- params.NotifyMessage{
+			MessageType: params.NotifyMessageURL,
+			TunnelID:    fw.key,
+			Payload:     urls,
+		}:
+		case <-ctx.Done():
+		}
+		return
+	}
 
+	defer s.mux.Unlock()
 	s.tunnelEvents <- params.TunnelEvent{
-		EventType:          params.EventTypeTunnelReady,
-		NotifyChan:         details.msgChan,
-		ErrorChan:          details.errChan,
-		BindAddr:           details.bindAddr,
-		RequestedPort:      details.bindPort,
-		RequestedSubdomain: details.subdomain,
+		EventType:  params.EventTypeTunnelReady,
+		NotifyChan: fw.msgChan,
+		ErrorChan:  fw.errChan,
+		TunnelID:   fw.key,
+		Dial: func(ctx context.Context, origin net.Addr) (net.Conn, error) {
+			return s.dialForwarder(ctx, fw, origin)
+		},
+		Admit: func() error {
+			return s.checkQuota(fw)
+		},
+		RequestedPort:      fw.bindPort,
+		RequestedSubdomain: fw.subdomain,
+		Passthrough:        fw.passthrough,
+		Private:            fw.private,
+		Pool:               fw.pool,
+		CustomDomain:       fw.customDomain,
+		Reserved:           fw.reserved,
+		Options:            opts,
 	}
+}
 
-	return nil
+// expireForwarder closes the tunnel registered under fwKey once its TTL
+// has passed. Other tunnels of the connection are left alone.
+func (s *sshServer) expireForwarder(fwKey string, fw *forwarderDetails) {
+	s.mux.Lock()
+	current, ok := s.forwarders[fwKey]
+	s.mux.Unlock()
+	if !ok || current != fw {
+		return
+	}
+
+	log.Printf("tunnel with key %s expired", fwKey)
+	s.unregisterForwarder(fwKey)
+	sendNotice(fw.msgChan, fmt.Sprintf("%s expired after %s", s.tunnelName(fw), fw.options.TTL))
 }
 
+// tunnelName describes fw in the messages sent to its owner.
+func (s *sshServer) tunnelName(fw *forwarderDetails) string {
+	if fw.tunnelType == tunnelTypeTCP {
+		return fmt.Sprintf("TCP tunnel on port %d", fw.bindPort)
+	}
+	return "Tunnel " + s.tunnelHostname(fw)
+}
+
+// heldGeneratedSubdomain returns a generated subdomain held for the key of
+// details with the same port and flags, or an empty string if there is
+// none. The caller must hold s.mux.
+func (s *sshServer) heldGeneratedSubdomain(details forwarderDetails) string {
+	for subdomain, entry := range s.subdomains {
+		if entry.generated && entry.held() && entry.canReattach(details) == nil {
+			return subdomain
+		}
+	}
+	return ""
+}
+
+// unregisterForwarder closes the tunnel registered under fwKey and frees
+// its subdomain.
 func (s *sshServer) unregisterForwarder(fwKey string) {
+	s.removeForwarder(fwKey, false)
+}
+
+// dropForwarder closes the tunnel registered under fwKey after the
+// connection of its owner was lost. If a grace period is configured, the
+// subdomain of the last member of an HTTP tunnel is held for the key of
+// the owner, who may reattach to it by reconnecting.
+func (s *sshServer) dropForwarder(fwKey string) {
+	s.removeForwarder(fwKey, true)
+}
+
+func (s *sshServer) removeForwarder(fwKey string, hold bool) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 	fw, ok := s.forwarders[fwKey]
@@ -289,18 +712,86 @@ func (s *sshServer) unregisterForwarder(fwKey string) {
 	}
 
 	log.Printf("unregistering tunnel with key %s", fwKey)
-	fw.listener.Close()
+	fw.cancel()
+	if fw.listener != nil {
+		fw.listener.Close()
+	}
+	if fw.ttlTimer != nil {
+		fw.ttlTimer.Stop()
+	}
 	delete(s.forwarders, fwKey)
-	delete(s.subdomains, fw.subdomain)
+	if fw.tunnelType == tunnelTypeTCP {
+		// TCP tunnels are not known to the HTTP server.
+		return
+	}
+
+	held := false
+	if entry, ok := s.subdomains[fw.subdomain]; ok {
+		entry.members--
+		if entry.members <= 0 {
+			gracePeriod := s.appConfig.Load().Reconnect.GracePeriod
+			if hold && gracePeriod > 0 && fw.fingerprint != "" && (fw.announced || fw.reattached) {
+				s.holdSubdomain(fw, entry, gracePeriod)
+				held = true
+			} else {
+				delete(s.subdomains, fw.subdomain)
+			}
+		}
+	}
+	if !fw.announced && !fw.reattached {
+		// The HTTP server never heard of this tunnel.
+		return
+	}
+	// A tunnel that reattached to a held subdomain, but was closed
+	// before it was announced, releases the subdomain in the HTTP
+	// server as well.
 	s.tunnelEvents <- params.TunnelEvent{
 		EventType:          params.EventTypeTunnelClosed,
 		NotifyChan:         nil,
 		ErrorChan:          nil,
-		BindAddr:           fw.bindAddr,
+		TunnelID:           fw.key,
 		RequestedSubdomain: fw.subdomain,
+		CustomDomain:       fw.customDomain,
+		Held:               held,
 	}
 }
 
+// holdSubdomain keeps the subdomain of fw for its owner during gracePeriod.
+// The subdomain is released if the owner does not reconnect in time. The
+// caller must hold s.mux.
+func (s *sshServer) holdSubdomain(fw *forwarderDetails, entry *subdomainEntry, gracePeriod time.Duration) {
+	log.Printf("holding subdomain %s for %s", fw.subdomain, gracePeriod)
+	var timer *time.Timer
+	timer = time.AfterFunc(gracePeriod, func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		if s.subdomains[fw.subdomain] != entry || entry.graceTimer != timer {
+			// The owner reconnected in the meantime.
+			return
+		}
+
+		log.Printf("grace period of subdomain %s ended", fw.subdomain)
+		delete(s.subdomains, fw.subdomain)
+		select {
+		case s.tunnelEvents <- params.TunnelEvent{
+			EventType:          params.EventTypeTunnelClosed,
+			TunnelID:           fw.key,
+			RequestedSubdomain: fw.subdomain,
+			CustomDomain:       fw.customDomain,
+		}:
+		case <-s.ctx.Done():
+		}
+	})
+	entry.graceTimer = timer
+}
+
+func (s *sshServer) forwarder(fwKey string) (*forwarderDetails, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	fw, ok := s.forwarders[fwKey]
+	return fw, ok
+}
+
 func (s *sshServer) hasForwarder(fwKey string) bool {
 	s.mux.Lock()
 	defer s.mux.Unlock()
@@ -308,133 +799,398 @@ func (s *sshServer) hasForwarder(fwKey string) bool {
 	return ok
 }
 
-func (s *sshServer) handleSSHRequest(ctx context.Context, req *ssh.Request, sshConn *ssh.ServerConn, msgChan chan params.NotifyMessage, errChan chan error) {
-	switch req.Type {
-	case "tcpip-forward":
-		var reqPayload remoteForwardDetails
-		if err := ssh.Unmarshal(req.Payload, &reqPayload); err != nil {
-			log.Print(err)
-			req.Reply(false, nil)
-			return
+// handleDirectTCPIP connects a local forward of an authenticated client
+// (ssh -L 8080:<subdomain>:80) to the tunnel registered for <subdomain> on
+// the destination port. This is the only way to reach private tunnels.
+func (s *sshServer) handleDirectTCPIP(newChannel ssh.NewChannel, sshConn *ssh.ServerConn) {
+	if connFingerprint(sshConn) == "" {
+		newChannel.Reject(ssh.Prohibited, "tunnel access requires public key authentication")
+		return
+	}
+
+	if newKeyPolicy(sshConn.Permissions).noPortForwarding {
+		newChannel.Reject(ssh.Prohibited, "port forwarding is not allowed for this key")
+		return
+	}
+
+	var payload remoteForwardChannelData
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "failed to parse payload")
+		return
+	}
+
+	// Accept both the bare subdomain and the fully qualified name.
+	hostname := strings.ToLower(payload.DestAddr)
+	if !strings.Contains(hostname, ".") {
+		hostname = fmt.Sprintf("%s.%s", hostname, s.appConfig.Load().HTTPServer.DomainName)
+	}
+
+	dialCtx, cancel := context.WithTimeout(s.ctx, 30*time.Second)
+	defer cancel()
+	backend, err := s.httpTunnels.DialTunnel(dialCtx, hostname, payload.DestPort, sshConn.RemoteAddr())
+	if err != nil {
+		log.Printf("failed to dial tunnel %s:%d: %s", hostname, payload.DestPort, err)
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := newChannel.Accept()
+	if err != nil {
+		log.Printf("could not accept channel: %s", err)
+		backend.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	log.Printf("%s connected to tunnel %s over %s", sshConn.RemoteAddr(), hostname, directTCPIPChannelType)
+	go func() {
+		defer ch.Close()
+		defer backend.Close()
+		io.Copy(ch, backend)
+	}()
+	go func() {
+		defer ch.Close()
+		defer backend.Close()
+		io.Copy(backend, ch)
+	}()
+}
+
+// listenTCPTunnel binds the public listener of a raw TCP tunnel. The
+// requested port is used if it is part of the configured range and is
+// free. Otherwise, the first free port in the range is allocated,
+// starting from a random offset.
+func (s *sshServer) listenTCPTunnel(requested uint32) (net.Listener, error) {
+	cfg := s.appConfig.Load().TCPTunnels
+	if requested != 0 && cfg.InRange(requested) {
+		ln, err := net.Listen("tcp", net.JoinHostPort(cfg.BindAddress, fmt.Sprintf("%d", requested)))
+		if err == nil {
+			return ln, nil
 		}
+	}
 
-		if reqPayload.BindPort != 80 && reqPayload.BindPort != 443 {
-			// We only support forwarding http and https.
-			errChan <- fmt.Errorf("unsupported port: %d", reqPayload.BindPort)
-			req.Reply(false, nil)
-			return
+	size := cfg.PortRangeEnd - cfg.PortRangeStart + 1
+	offset := mrand.IntN(size)
+	for i := 0; i < size; i++ {
+		port := cfg.PortRangeStart + (offset+i)%size
+		ln, err := net.Listen("tcp", net.JoinHostPort(cfg.BindAddress, fmt.Sprintf("%d", port)))
+		if err != nil {
+			continue
 		}
+		return ln, nil
+	}
+	return nil, fmt.Errorf("no free port in range %d-%d", cfg.PortRangeStart, cfg.PortRangeEnd)
+}
 
-		connTag := sshConn.RemoteAddr().String()
-		fwKey := reqPayload.forwarderKey(connTag)
-		if s.hasForwarder(fwKey) {
-			// We're already forwarding this host:port pair from the same client.
-			req.Reply(false, nil)
+func (s *sshServer) tcpTunnelURLs(port uint32, opts params.TunnelOptions) ([]byte, error) {
+	return json.Marshal(params.URLs{
+		TCP:     fmt.Sprintf("tcp://%s:%d", s.appConfig.Load().HTTPServer.DomainName, port),
+		Options: opts.Summary(),
+	})
+}
+
+// checkVisitor returns an error if the visitor connecting from addr may not
+// reach the raw TCP tunnel registered under fwKey. Both the server wide
+// visitor filter and the one set by the owner of the tunnel apply. Blocked
+// visitors are counted and reported in the log stream of the tunnel.
+func (s *sshServer) checkVisitor(fwKey string, addr net.Addr) error {
+	s.mux.Lock()
+	fw, ok := s.forwarders[fwKey]
+	if !ok || fw.tunnelType != tunnelTypeTCP {
+		s.mux.Unlock()
+		// HTTP tunnels are only reached through the HTTP server,
+		// which enforces their options.
+		return nil
+	}
+	filter := fw.options.VisitorFilter
+	s.mux.Unlock()
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("unexpected address %s", addr)
+	}
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+
+	serverFilter, err := s.appConfig.Load().VisitorFilter.Filter()
+	if err != nil {
+		return err
+	}
+	var country string
+	if filter.UsesCountries() || serverFilter.UsesCountries() {
+		country, _ = s.dbConn.CountryCode(ip)
+	}
+
+	err = serverFilter.Check(ip, country)
+	if err == nil {
+		err = filter.Check(ip, country)
+	}
+	if err == nil {
+		return nil
+	}
+
+	s.mux.Lock()
+	fw.blocked++
+	blocked := fw.blocked
+	s.mux.Unlock()
+
+	logMsg := fmt.Sprintf("%s - - %s \"blocked: %s\" (%d blocked)", ip,
+		time.Now().UTC().Format("02/Jan/2006:15:04:05 -0700"), err, blocked)
+	select {
+	case fw.msgChan <- params.NotifyMessage{
+		MessageType: params.NotifyMessageLog,
+		Payload:     []byte(logMsg),
+	}:
+	default:
+	}
+	return err
+}
+
+// serveForwarder accepts connections on the public listener of a raw TCP
+// tunnel and sends them to the client over forwarded-tcpip channels.
+func (s *sshServer) serveForwarder(ctx context.Context, fw *forwarderDetails) {
+	go func() {
+		<-fw.ctx.Done()
+		fw.listener.Close()
+	}()
+	defer s.closeForwarder(ctx, fw)
+
+	log.Printf("Listening on address %s", fw.listener.Addr())
+	for {
+		c, err := fw.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("failed to accept: %s", err)
+			}
 			return
 		}
 
-		// Listen and register synchronously so we know the outcome
-		// before replying to the client. This avoids a data race on
-		// req.Reply and prevents telling the client the tunnel is up
-		// when it actually failed.
-		ln, err := net.Listen("tcp", "127.0.11.1:0")
-		if err != nil {
-			log.Printf("failed to listen: %s", err)
+		if err := s.checkVisitor(fw.key, c.RemoteAddr()); err != nil {
+			log.Printf("rejected connection from %s: %s", c.RemoteAddr(), err)
+			c.Close()
+			continue
+		}
+
+		log.Printf("accepted connection from %s", c.RemoteAddr())
+		go func() {
+			defer c.Close()
+			dialCtx, cancel := context.WithTimeout(fw.ctx, 30*time.Second)
+			backend, err := s.dialForwarder(dialCtx, fw, c.RemoteAddr())
+			cancel()
+			if err != nil {
+				log.Printf("rejected connection from %s: %s", c.RemoteAddr(), err)
+				return
+			}
+			defer backend.Close()
+
+			var copies sync.WaitGroup
+			copies.Add(2)
+			go func() {
+				defer copies.Done()
+				defer backend.Close()
+				io.Copy(backend, c)
+			}()
+			go func() {
+				defer copies.Done()
+				defer c.Close()
+				io.Copy(c, backend)
+			}()
+			copies.Wait()
+		}()
+	}
+}
+
+// watchForwarder closes the HTTP tunnel fw once its owner disconnects.
+// HTTP tunnels have no listener of their own, visitors are sent to them by
+// the HTTP server.
+func (s *sshServer) watchForwarder(ctx context.Context, fw *forwarderDetails) {
+	<-fw.ctx.Done()
+	s.closeForwarder(ctx, fw)
+}
+
+// closeForwarder unregisters fw, unless it was already unregistered. If
+// ctx, the context of the SSH connection, is done, the connection was lost.
+func (s *sshServer) closeForwarder(ctx context.Context, fw *forwarderDetails) {
+	if current, ok := s.forwarder(fw.key); !ok || current != fw {
+		return
+	}
+	if ctx.Err() != nil {
+		// The connection was lost.
+		s.dropForwarder(fw.key)
+		return
+	}
+	s.unregisterForwarder(fw.key)
+}
+
+func (s *sshServer) handleHTTPForward(ctx context.Context, req *ssh.Request, reqPayload remoteForwardDetails, sshConn *ssh.ServerConn, msgChan chan params.NotifyMessage, errChan chan error, connOpts *connOptions) {
+	connTag := sshConn.RemoteAddr().String()
+	fwKey := reqPayload.forwarderKey(connTag)
+	if s.hasForwarder(fwKey) {
+		// We're already forwarding this host:port pair from the same client.
+		req.Reply(false, nil)
+		return
+	}
+
+	subdomain, flags, err := parseBindAddr(reqPayload.BindAddr)
+	if err != nil {
+		errChan <- err
+		req.Reply(false, nil)
+		return
+	}
+
+	policy := newKeyPolicy(sshConn.Permissions)
+	requested := strings.ToLower(subdomain)
+	if requested == "localhost" {
+		requested = ""
+	}
+	if !policy.permitsListen(requested, reqPayload.BindPort) {
+		errChan <- fmt.Errorf("remote forward for %s:%d is not permitted for this key", reqPayload.BindAddr, reqPayload.BindPort)
+		req.Reply(false, nil)
+		return
+	}
+
+	fingerprint := connFingerprint(sshConn)
+	if flags.pool && fingerprint == "" {
+		errChan <- fmt.Errorf("load balanced tunnels require public key authentication")
+		req.Reply(false, nil)
+		return
+	}
+
+	if flags.passthrough {
+		if !s.appConfig.Load().HTTPServer.UseTLS {
+			errChan <- fmt.Errorf("tls passthrough requires TLS to be enabled on the server")
 			req.Reply(false, nil)
 			return
 		}
-
-		destPort := ln.Addr().(*net.TCPAddr).Port
-		if err := s.registerForwarder(connTag, fwKey, forwarderDetails{
-			listener:  ln,
-			subdomain: reqPayload.BindAddr,
-			bindAddr:  fmt.Sprintf("127.0.11.1:%d", destPort),
-			bindPort:  reqPayload.BindPort,
-			msgChan:   msgChan,
-			errChan:   errChan,
-		}); err != nil {
-			log.Printf("failed to register forwarder: %s", err)
-			errChan <- fmt.Errorf("failed to register forwarder: %w", err)
-			ln.Close()
+		if reqPayload.BindPort != 443 {
+			errChan <- fmt.Errorf("tls passthrough is only supported on port 443")
 			req.Reply(false, nil)
 			return
 		}
+	}
+
+	// Register synchronously so we know the outcome before replying to
+	// the client. This avoids a data race on req.Reply and prevents
+	// telling the client the tunnel is up when it actually failed.
+	fwCtx, fwCancel := context.WithCancel(ctx)
+	fw, err := s.registerForwarder(connTag, fwKey, forwarderDetails{
+		tunnelType:    tunnelTypeHTTP,
+		ctx:           fwCtx,
+		cancel:        fwCancel,
+		sshConn:       sshConn,
+		requestedAddr: reqPayload.BindAddr,
+		requestedPort: reqPayload.BindPort,
+		subdomain:     subdomain,
+		bindPort:      reqPayload.BindPort,
+		passthrough:   flags.passthrough,
+		private:       flags.private,
+		pool:          flags.pool,
+		fingerprint:   fingerprint,
+		username:      connUsername(sshConn),
+		maxTunnels:    policy.maxTunnels,
+		msgChan:       msgChan,
+		errChan:       errChan,
+	})
+	if err != nil {
+		log.Printf("failed to register forwarder: %s", err)
+		errChan <- fmt.Errorf("failed to register forwarder: %w", err)
+		fwCancel()
+		req.Reply(false, nil)
+		return
+	}
 
-		req.Reply(true, ssh.Marshal(&remoteForwardSuccess{uint32(reqPayload.BindPort)}))
+	req.Reply(true, ssh.Marshal(&remoteForwardSuccess{uint32(reqPayload.BindPort)}))
+	go s.announceForwarder(ctx, fwKey, connOpts)
+	go s.watchForwarder(ctx, fw)
+}
 
-		go func(reqPayload remoteForwardDetails) {
-			quit := make(chan struct{})
-			defer close(quit)
-			defer s.unregisterForwarder(fwKey)
+func (s *sshServer) handleTCPForward(ctx context.Context, req *ssh.Request, reqPayload remoteForwardDetails, sshConn *ssh.ServerConn, msgChan chan params.NotifyMessage, errChan chan error, connOpts *connOptions) {
+	if !s.appConfig.Load().TCPTunnels.Enabled {
+		// Without TCP tunnels, we only support forwarding http and https.
+		errChan <- fmt.Errorf("unsupported port: %d", reqPayload.BindPort)
+		req.Reply(false, nil)
+		return
+	}
 
-			go func() {
-				select {
-				case <-quit:
-				case <-ctx.Done():
-				}
-				ln.Close()
-			}()
+	policy := newKeyPolicy(sshConn.Permissions)
+	if !policy.permitsListen("", reqPayload.BindPort) {
+		errChan <- fmt.Errorf("remote forward for port %d is not permitted for this key", reqPayload.BindPort)
+		req.Reply(false, nil)
+		return
+	}
 
-			log.Printf("Listening on local address 127.0.11.1:%d", destPort)
-			for {
-				c, err := ln.Accept()
-				if err != nil {
-					if !errors.Is(err, net.ErrClosed) {
-						log.Printf("failed to accept: %s", err)
-					}
-					return
-				}
+	connTag := sshConn.RemoteAddr().String()
+	if reqPayload.BindPort != 0 && s.hasForwarder(reqPayload.forwarderKey(connTag)) {
+		// We're already forwarding this host:port pair from the same client.
+		req.Reply(false, nil)
+		return
+	}
 
-				log.Printf("accepted connection from %s", c.RemoteAddr())
-				originAddr, orignPortStr, _ := net.SplitHostPort(c.RemoteAddr().String())
-				originPort, _ := strconv.Atoi(orignPortStr)
-				payload := ssh.Marshal(&remoteForwardChannelData{
-					DestAddr: reqPayload.BindAddr,
-					// Not the actual port we're listening on.
-					DestPort:   uint32(reqPayload.BindPort),
-					OriginAddr: originAddr,
-					OriginPort: uint32(originPort),
-				})
-
-				go func() {
-					log.Printf("opening channel for %s:%d", originAddr, originPort)
-					ch, reqs, err := sshConn.OpenChannel(forwardedTCPChannelType, payload)
-					if err != nil {
-						log.Println(err)
-						c.Close()
-						return
-					}
-					log.Printf("opened channel for %s:%d", reqPayload.BindAddr, reqPayload.BindPort)
-					go func() {
-						defer ch.Close()
-						defer c.Close()
-						for {
-							select {
-							case <-ctx.Done():
-								return
-							case <-quit:
-								return
-							case req := <-reqs:
-								if req == nil {
-									return
-								}
-								log.Printf("Got request of type: %s", req.Type)
-							}
-						}
-					}()
-					go func() {
-						defer ch.Close()
-						defer c.Close()
-						io.Copy(ch, c)
-					}()
-					go func() {
-						defer ch.Close()
-						defer c.Close()
-						io.Copy(c, ch)
-					}()
-				}()
-			}
-		}(reqPayload)
+	ln, err := s.listenTCPTunnel(reqPayload.BindPort)
+	if err != nil {
+		log.Printf("failed to listen: %s", err)
+		errChan <- fmt.Errorf("failed to allocate tcp tunnel: %w", err)
+		req.Reply(false, nil)
+		return
+	}
+
+	publicPort := uint32(ln.Addr().(*net.TCPAddr).Port)
+	// Clients that request port 0 use the port we reply with to match
+	// incoming forwarded-tcpip channels to their local target.
+	if reqPayload.BindPort == 0 {
+		reqPayload.BindPort = publicPort
+	}
+
+	fwKey := reqPayload.forwarderKey(connTag)
+	fwCtx, fwCancel := context.WithCancel(ctx)
+	fw, err := s.registerForwarder(connTag, fwKey, forwarderDetails{
+		tunnelType:    tunnelTypeTCP,
+		ctx:           fwCtx,
+		cancel:        fwCancel,
+		sshConn:       sshConn,
+		requestedAddr: reqPayload.BindAddr,
+		requestedPort: reqPayload.BindPort,
+		listener:      ln,
+		bindAddr:      ln.Addr().String(),
+		bindPort:      publicPort,
+		fingerprint:   connFingerprint(sshConn),
+		maxTunnels:    policy.maxTunnels,
+		msgChan:       msgChan,
+		errChan:       errChan,
+	})
+	if err != nil {
+		log.Printf("failed to register forwarder: %s", err)
+		errChan <- fmt.Errorf("failed to register forwarder: %w", err)
+		fwCancel()
+		ln.Close()
+		req.Reply(false, nil)
+		return
+	}
+
+	req.Reply(true, ssh.Marshal(&remoteForwardSuccess{publicPort}))
+	go s.announceForwarder(ctx, fwKey, connOpts)
+	go s.serveForwarder(ctx, fw)
+}
+
+func (s *sshServer) handleSSHRequest(ctx context.Context, req *ssh.Request, sshConn *ssh.ServerConn, msgChan chan params.NotifyMessage, errChan chan error, connOpts *connOptions) {
+	switch req.Type {
+	case "tcpip-forward":
+		var reqPayload remoteForwardDetails
+		if err := ssh.Unmarshal(req.Payload, &reqPayload); err != nil {
+			log.Print(err)
+			req.Reply(false, nil)
+			return
+		}
+
+		if newKeyPolicy(sshConn.Permissions).noPortForwarding {
+			errChan <- fmt.Errorf("port forwarding is not allowed for this key")
+			req.Reply(false, nil)
+			return
+		}
+
+		if reqPayload.BindPort == 80 || reqPayload.BindPort == 443 {
+			s.handleHTTPForward(ctx, req, reqPayload, sshConn, msgChan, errChan, connOpts)
+		} else {
+			s.handleTCPForward(ctx, req, reqPayload, sshConn, msgChan, errChan, connOpts)
+		}
 	case "cancel-tcpip-forward":
 		var reqPayload remoteForwardDetails
 		if err := ssh.Unmarshal(req.Payload, &reqPayload); err != nil {
@@ -463,7 +1219,7 @@ func (s *sshServer) handleConnection(nConn net.Conn) {
 	// Set a deadline for the SSH handshake to prevent slow connections
 	// from holding resources indefinitely.
 	nConn.SetDeadline(time.Now().Add(30 * time.Second))
-	conn, chans, reqs, err := ssh.NewServerConn(nConn, s.config)
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, s.config.Load())
 	// Clear the deadline after the handshake so the connection can
 	// remain open indefinitely.
 	nConn.SetDeadline(time.Time{})
@@ -477,11 +1233,17 @@ func (s *sshServer) handleConnection(nConn net.Conn) {
 	var user string
 	if conn.Permissions != nil {
 		user = conn.Permissions.Extensions["username"]
+		if keyID, ok := conn.Permissions.Extensions[config.ExtensionCertKeyID]; ok {
+			log.Printf("connection from %s authenticated as %q using certificate %q (principals: %s)",
+				conn.RemoteAddr(), user, keyID, conn.Permissions.Extensions[config.ExtensionCertPrincipals])
+		}
 	}
 
 	quit := make(chan struct{})
+	connOpts := newConnOptions()
 	msgChan := make(chan params.NotifyMessage, 10)
 	errChan := make(chan error, 1)
+	noMoreSessions := make(chan struct{}, 1)
 	// The incoming Request channel must be serviced.
 	go func() {
 		for {
@@ -490,7 +1252,17 @@ func (s *sshServer) handleConnection(nConn net.Conn) {
 				if req == nil {
 					return
 				}
-				s.handleSSHRequest(ctx, req, conn, msgChan, errChan)
+				if req.Type == noMoreSessionsRequestType {
+					// Handled by the channel loop below, which knows
+					// whether a session was opened.
+					req.Reply(true, nil)
+					select {
+					case noMoreSessions <- struct{}{}:
+					default:
+					}
+					continue
+				}
+				s.handleSSHRequest(ctx, req, conn, msgChan, errChan, connOpts)
 			case <-quit:
 				log.Printf("closing connection from %s", conn.RemoteAddr())
 				return
@@ -503,94 +1275,71 @@ func (s *sshServer) handleConnection(nConn net.Conn) {
 	if user == "api" {
 		logFmt = jsonFormat
 	}
-	msgHandler := newMessageHandler(ctx, msgChan, errChan, logFmt, s.appConfig.HTTPServer.UseTLS)
+	msgHandler := newMessageHandler(ctx, msgChan, errChan, logFmt, s.appConfig.Load().HTTPServer.UseTLS, s.hasForwarder)
 	defer msgHandler.Close()
 
 	// Service the incoming Channel channel.
-	for newChannel := range chans {
+	sessionOpened := false
+channels:
+	for {
+		var newChannel ssh.NewChannel
+		select {
+		case <-noMoreSessions:
+			// Clients like ssh -N tell us they will not open sessions,
+			// so no options can arrive through env requests or
+			// commands. Channels opened before the request are queued
+			// ahead of it.
+			if !sessionOpened && len(chans) == 0 {
+				connOpts.settle()
+			}
+			continue
+		case ch, ok := <-chans:
+			if !ok {
+				break channels
+			}
+			newChannel = ch
+		}
+
 		// Channels have a type, depending on the application level
 		// protocol intended. In the case of a shell, the type is
 		// "session" and ServerShell may be used to present a simple
-		// terminal interface.
+		// terminal interface. Local forwards (ssh -L) open "direct-tcpip"
+		// channels, which we route to tunnels.
+		if newChannel.ChannelType() == directTCPIPChannelType {
+			go s.handleDirectTCPIP(newChannel, conn)
+			continue
+		}
 		if newChannel.ChannelType() != "session" {
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 			continue
 		}
+		sessionOpened = true
 		channel, requests, err := newChannel.Accept()
 		if err != nil {
 			log.Printf("Could not accept channel: %v", err)
 			return
 		}
 
-		// Sessions have out-of-band requests such as "shell",
-		// "pty-req" and "env".  Here we handle only the
-		// "shell" request.
-		go func(in <-chan *ssh.Request) {
-			for req := range in {
-				switch req.Type {
-				case "shell", "pty-req":
-					req.Reply(true, nil)
-				default:
-					req.Reply(false, nil)
-					log.Printf("unexpected request type: %s", req.Type)
-				}
-			}
-		}(requests)
-
-		var prompt string
-		if user != "api" {
-			prompt = "> "
-		}
-
-		go func() {
-			defer channel.Close()
-			defer conn.Close()
-			var messageID string
-			term := terminal.NewTerminal(channel, prompt)
-			messageID = msgHandler.Register(term)
-			defer msgHandler.Unregister(messageID)
-			msgHandler.Urls(messageID)
-
-			go func() {
-				defer channel.Close()
-				defer conn.Close()
-				defer msgHandler.Close()
-				err := msgHandler.Wait()
-				if err != nil {
-					log.Print(err)
-				}
-			}()
-
-			for {
-				line, err := term.ReadLine()
-				if err != nil {
-					break
-				}
-				switch line {
-				case "logs":
-					msgHandler.SetLogging(messageID, true)
-					term.Write([]byte("Logging enabled\n"))
-				case "nologs":
-					msgHandler.SetLogging(messageID, false)
-					term.Write([]byte("Logging disabled\n"))
-				case "quit":
-					return
-				}
-			}
-		}()
+		go s.handleSession(channel, requests, conn, msgHandler, user, connOpts)
 	}
 	close(quit)
 	log.Printf("closed connection from %s", conn.RemoteAddr())
 }
 
 func (s *sshServer) Start() error {
-	listener, err := net.Listen("tcp", net.JoinHostPort(s.appConfig.SSHServer.BindAddress, fmt.Sprintf("%d", s.appConfig.SSHServer.BindPort)))
+	listener, err := net.Listen("tcp", net.JoinHostPort(s.appConfig.Load().SSHServer.BindAddress, fmt.Sprintf("%d", s.appConfig.Load().SSHServer.BindPort)))
 	if err != nil {
 		return fmt.Errorf("failed to listen for connection: %w", err)
 	}
 
-	s.listener = listener
+	// The PROXY protocol settings are read for every connection, so they
+	// can be changed without a restart.
+	s.listener = proxyproto.NewListener(listener, func(addr net.Addr) bool {
+		return s.appConfig.Load().SSHServer.ProxyProtocol.Trusted(addr)
+	})
 	go s.loop()
+	s.wg.Add(1)
+	go s.flushUsage()
 	return nil
 }
 
@@ -608,6 +1357,23 @@ func (s *sshServer) Wait() error {
 	return nil
 }
 
+// PrepareReload builds the SSH server config for cfg, without changing the
+// running server. The returned function applies cfg, and can not fail. The
+// new SSH server config, including the host key and the authorized keys
+// and CA settings, is used for new connections. Existing connections and
+// tunnels are not affected.
+func (s *sshServer) PrepareReload(cfg *config.Config) (func(), error) {
+	sshConfig, err := cfg.SSHServer.SSHServerConfig(passwordAuthCallback(s.dbConn))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ssh server config: %w", err)
+	}
+
+	return func() {
+		s.config.Store(sshConfig)
+		s.appConfig.Store(cfg)
+	}, nil
+}
+
 func (s *sshServer) Stop() error {
 	close(s.quit)
 	return nil
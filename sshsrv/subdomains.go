@@ -0,0 +1,124 @@
+// Copyright 2023 Gabriel Adrian Samfira
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package sshsrv
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+
+	"github.com/castillobgr/sententia"
+
+	"github.com/gabriel-samfira/localshow/config"
+)
+
+const (
+	// maxSubdomainAttempts is the number of subdomains generated for a
+	// tunnel before giving up.
+	maxSubdomainAttempts = 10
+	// stableSubdomainLength is the length of subdomains derived from the
+	// key or username of a client.
+	stableSubdomainLength = 12
+)
+
+// subdomainEncoding encodes stable subdomains using lowercase letters and
+// digits only.
+var subdomainEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// registerGeneratedForwarder registers the HTTP tunnel described by details
+// on a generated subdomain. A generated subdomain held for the key of the
+// client is given back. Otherwise, candidates are generated according to
+// the configured strategy until one is free. The caller must not hold
+// s.mux.
+func (s *sshServer) registerGeneratedForwarder(connTag string, details forwarderDetails) (*forwarderDetails, error) {
+	s.mux.Lock()
+	held := s.heldGeneratedSubdomain(details)
+	s.mux.Unlock()
+	if held != "" {
+		if fw, ok, err := s.tryGeneratedSubdomain(connTag, held, details); ok {
+			return fw, err
+		}
+	}
+
+	seed := subdomainSeed(s.appConfig.Load().HTTPServer.SubdomainStrategy, details)
+	for attempt := range maxSubdomainAttempts {
+		var candidate string
+		if seed != "" {
+			candidate = stableSubdomain(seed, attempt)
+		} else {
+			candidate, _ = sententia.Make("{{ adjective }}-{{ noun }}")
+		}
+		if fw, ok, err := s.tryGeneratedSubdomain(connTag, candidate, details); ok {
+			return fw, err
+		}
+	}
+	return nil, fmt.Errorf("failed to allocate a subdomain after %d attempts", maxSubdomainAttempts)
+}
+
+// tryGeneratedSubdomain registers details on the generated subdomain
+// candidate. It returns false if candidate can not be used, in which case
+// another one should be tried.
+func (s *sshServer) tryGeneratedSubdomain(connTag, candidate string, details forwarderDetails) (*forwarderDetails, bool, error) {
+	// Excluded and reserved subdomains are skipped before taking s.mux.
+	if err := s.resolveSubdomain(candidate, &details); err != nil {
+		return nil, false, nil
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.subdomainAvailable(candidate, details) {
+		return nil, false, nil
+	}
+	fw, err := s.addHTTPForwarder(connTag, details, true)
+	return fw, true, err
+}
+
+// subdomainSeed returns the value stable subdomains are derived from, or
+// an empty string if the subdomain should be random. Anonymous clients
+// always get random subdomains.
+func subdomainSeed(strategy string, details forwarderDetails) string {
+	switch strategy {
+	case config.SubdomainStrategyFingerprint:
+		if details.fingerprint != "" {
+			return "fingerprint:" + details.fingerprint
+		}
+	case config.SubdomainStrategyUsername:
+		if details.fingerprint != "" && details.username != "" {
+			return "username:" + details.username
+		}
+	}
+	return ""
+}
+
+// stableSubdomain derives a subdomain from seed. The first attempt always
+// gives the same subdomain. Later attempts are used when it is taken.
+func stableSubdomain(seed string, attempt int) string {
+	if attempt > 0 {
+		seed = fmt.Sprintf("%s:%d", seed, attempt)
+	}
+	sum := sha256.Sum256([]byte(seed))
+	return subdomainEncoding.EncodeToString(sum[:])[:stableSubdomainLength]
+}
+
+// subdomainAvailable returns true if details may register the generated
+// subdomain, which is free or held for the key of details. The caller must
+// hold s.mux.
+func (s *sshServer) subdomainAvailable(subdomain string, details forwarderDetails) bool {
+	entry, ok := s.subdomains[subdomain]
+	if !ok {
+		return true
+	}
+	return entry.held() && entry.canReattach(details) == nil
+}
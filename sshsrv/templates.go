@@ -2,9 +2,23 @@ package sshsrv
 
 var tunnelSuccessfulBannerTemplate = `
 ###
+{{- if .HTTP}}
 ### HTTP tunnel successfully created on {{.HTTP}}
+{{- end}}
 {{- if .HTTPS}}
 ### HTTPS tunnel successfully created on {{.HTTPS}}
 {{- end}}
+{{- if .SSH}}
+### Private tunnel successfully created. Connect to it using: {{.SSH}}
+{{- end}}
+{{- if .TCP}}
+### TCP tunnel successfully created on {{.TCP}}
+{{- end}}
+{{- if .Inspector}}
+### Inspect and replay requests on {{.Inspector}}
+{{- end}}
+{{- if .Options}}
+### Tunnel options: {{.Options}}
+{{- end}}
 ###
 `
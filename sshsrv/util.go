@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"slices"
 	"sync"
 	"text/template"
 
@@ -18,6 +19,10 @@ import (
 
 type messageFormat string
 
+// maxPendingWarnings is the number of warnings kept for consumers that
+// register late.
+const maxPendingWarnings = 10
+
 const (
 	stringFormat messageFormat = "string"
 	jsonFormat   messageFormat = "json"
@@ -47,12 +52,15 @@ func (c *consumer) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
-func newMessageHandler(ctx context.Context, msgs chan params.NotifyMessage, errs chan error, format messageFormat, tlsEnabled bool) *messageHandler {
+// newMessageHandler returns a handler for the messages of a connection. The
+// live function returns true while the tunnel with the given ID is open.
+func newMessageHandler(ctx context.Context, msgs chan params.NotifyMessage, errs chan error, format messageFormat, tlsEnabled bool, live func(tunnelID string) bool) *messageHandler {
 	han := &messageHandler{
 		msgChan:    msgs,
 		errChan:    errs,
 		format:     format,
 		tlsEnabled: tlsEnabled,
+		live:       live,
 		quit:       make(chan struct{}),
 		consumers:  map[string]*consumer{},
 		ctx:        ctx,
@@ -62,11 +70,24 @@ func newMessageHandler(ctx context.Context, msgs chan params.NotifyMessage, errs
 	return han
 }
 
+// tunnelBanner holds the formatted URLs of a tunnel.
+type tunnelBanner struct {
+	tunnelID string
+	text     []byte
+}
+
 type messageHandler struct {
 	msgChan   chan params.NotifyMessage
 	errChan   chan error
 	consumers map[string]*consumer
-	urls      []byte
+	// banners are the URLs of the tunnels of the connection, sent to
+	// consumers that register late.
+	banners []tunnelBanner
+	live    func(tunnelID string) bool
+	// warnings were sent while no consumer was registered, and are
+	// written to the next one. Only the last maxPendingWarnings are
+	// kept.
+	warnings [][]byte
 
 	format     messageFormat
 	tlsEnabled bool
@@ -92,13 +113,87 @@ func (l *messageHandler) Urls(id string) {
 	if id == "" {
 		return
 	}
+	l.pruneBanners()
 	l.mux.Lock()
 	defer l.mux.Unlock()
 
 	wr, ok := l.consumers[id]
-	if ok && len(l.urls) > 0 {
-		wr.wr.Write(l.urls)
+	if ok {
+		if urls := l.urlsLocked(); len(urls) > 0 {
+			wr.wr.Write(urls)
+		}
+		for _, warning := range l.warnings {
+			wr.wr.Write(warning)
+		}
+		l.warnings = nil
+	}
+	// Errors that closed the handler before the consumer registered
+	// would otherwise never reach the client.
+	if ok && l.err != nil {
+		wr.wr.Write([]byte(color.Ize(color.Red, fmt.Sprintf("%s\n", l.err))))
+	}
+}
+
+// pruneBanners drops the banners of the tunnels that were closed. The
+// liveness of tunnels is checked without holding l.mux, as the SSH server
+// may wait for the message loop while holding its own lock.
+func (l *messageHandler) pruneBanners() {
+	l.mux.Lock()
+	ids := make([]string, 0, len(l.banners))
+	for _, banner := range l.banners {
+		ids = append(ids, banner.tunnelID)
+	}
+	l.mux.Unlock()
+
+	closed := map[string]bool{}
+	for _, id := range ids {
+		if !l.live(id) {
+			closed[id] = true
+		}
+	}
+	if len(closed) == 0 {
+		return
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.banners = slices.DeleteFunc(l.banners, func(b tunnelBanner) bool {
+		return closed[b.tunnelID]
+	})
+}
+
+// urlsLocked returns the banners of the tunnels of the connection. JSON
+// consumers get a single object if the connection has one tunnel, and an
+// array of them otherwise. The caller must hold l.mux.
+func (l *messageHandler) urlsLocked() []byte {
+	if len(l.banners) == 0 {
+		return nil
 	}
+
+	texts := make([][]byte, 0, len(l.banners))
+	for _, banner := range l.banners {
+		texts = append(texts, banner.text)
+	}
+	if l.format != jsonFormat {
+		return append(bytes.Join(texts, []byte("\n")), '\n')
+	}
+	if len(texts) == 1 {
+		return append(texts[0], '\n')
+	}
+	ret := append([]byte("["), bytes.Join(texts, []byte(","))...)
+	return append(ret, "]\n"...)
+}
+
+// setBannerLocked stores the banner of a tunnel, replacing the previous
+// one. The caller must hold l.mux.
+func (l *messageHandler) setBannerLocked(tunnelID string, text []byte) {
+	for idx := range l.banners {
+		if l.banners[idx].tunnelID == tunnelID {
+			l.banners[idx].text = text
+			return
+		}
+	}
+	l.banners = append(l.banners, tunnelBanner{tunnelID: tunnelID, text: text})
 }
 
 func (l *messageHandler) Unregister(id string) {
@@ -131,10 +226,21 @@ func (l *messageHandler) formatURLsMessage(urls json.RawMessage, format messageF
 		return nil, fmt.Errorf("failed to unmarshal urls: %w", err)
 	}
 
-	urlsObj.HTTP = color.Ize(color.Green, urlsObj.HTTP)
-	if l.tlsEnabled {
+	if urlsObj.HTTP != "" {
+		urlsObj.HTTP = color.Ize(color.Green, urlsObj.HTTP)
+	}
+	if l.tlsEnabled && urlsObj.HTTPS != "" {
 		urlsObj.HTTPS = color.Ize(color.Green, urlsObj.HTTPS)
 	}
+	if urlsObj.SSH != "" {
+		urlsObj.SSH = color.Ize(color.Green, urlsObj.SSH)
+	}
+	if urlsObj.TCP != "" {
+		urlsObj.TCP = color.Ize(color.Green, urlsObj.TCP)
+	}
+	if urlsObj.Inspector != "" {
+		urlsObj.Inspector = color.Ize(color.Green, urlsObj.Inspector)
+	}
 
 	tpl, err := template.New("").Parse(tunnelSuccessfulBannerTemplate)
 	if err != nil {
@@ -156,6 +262,14 @@ func (l *messageHandler) broadcast(p []byte) {
 	}
 }
 
+// broadcastLocked writes p to all consumers, even those that have logging
+// disabled. The caller must hold l.mux.
+func (l *messageHandler) broadcastLocked(p []byte) {
+	for _, consumer := range l.consumers {
+		consumer.wr.Write(p)
+	}
+}
+
 func (l *messageHandler) loop() {
 	for {
 		select {
@@ -165,8 +279,10 @@ func (l *messageHandler) loop() {
 		case <-l.quit:
 			return
 		case err := <-l.errChan:
-			l.broadcast([]byte(color.Ize(color.Red, fmt.Sprintf("%s\n", err))))
+			l.mux.Lock()
+			l.broadcastLocked([]byte(color.Ize(color.Red, fmt.Sprintf("%s\n", err))))
 			l.err = err
+			l.mux.Unlock()
 			l.Close()
 			return
 		case msg, ok := <-l.msgChan:
@@ -182,9 +298,38 @@ func (l *messageHandler) loop() {
 					log.Printf("failed to format urls: %s", err)
 					continue
 				}
+				// Keep the URLs of every open tunnel of this
+				// connection, so consumers that register late see
+				// all of them. Tunnels are announced once their
+				// options are settled, which may happen after
+				// consumers registered.
 				l.mux.Lock()
-				l.urls = termMsg
+				l.setBannerLocked(msg.TunnelID, termMsg)
+				l.broadcastLocked([]byte(fmt.Sprintf("%s\n", termMsg)))
 				l.mux.Unlock()
+				continue
+			case params.NotifyMessageWarning:
+				// Warnings concern the owner of the tunnels, and are
+				// shown even if logging is disabled.
+				if l.format == jsonFormat {
+					termMsg, err = json.Marshal(params.Warning{Warning: string(msg.Payload)})
+					if err != nil {
+						log.Printf("failed to format warning: %s", err)
+						continue
+					}
+				} else {
+					termMsg = []byte(color.Ize(color.Yellow, string(msg.Payload)))
+				}
+				l.mux.Lock()
+				if len(l.consumers) == 0 {
+					l.warnings = append(l.warnings, []byte(fmt.Sprintf("%s\n", termMsg)))
+					if len(l.warnings) > maxPendingWarnings {
+						l.warnings = l.warnings[1:]
+					}
+				}
+				l.broadcastLocked([]byte(fmt.Sprintf("%s\n", termMsg)))
+				l.mux.Unlock()
+				continue
 			default:
 				termMsg = msg.Payload
 			}
@@ -207,5 +352,7 @@ func (l *messageHandler) Wait() error {
 	case <-l.quit:
 	case <-l.ctx.Done():
 	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
 	return l.err
 }